@@ -0,0 +1,393 @@
+package mbserver
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Limits of the values read or written with a single Modbus request.
+const (
+	maxReadBits       = 2000
+	maxReadRegisters  = 125
+	maxWriteBits      = 1968
+	maxWriteRegisters = 123
+)
+
+// TableValues is the body of REST API table requests and responses. Bits are
+// 0 or 1.
+type TableValues struct {
+	UnitID  uint8    `json:"unit_id"`
+	Table   string   `json:"table"`
+	Address uint16   `json:"address"`
+	Values  []uint16 `json:"values"`
+}
+
+// PointValue is the body of REST API point responses.
+type PointValue struct {
+	Name     string      `json:"name"`
+	Table    string      `json:"table"`
+	Address  uint16      `json:"address"`
+	Type     string      `json:"type"`
+	Writable bool        `json:"writable"`
+	Value    interface{} `json:"value"`
+}
+
+// APIHandler returns the handler of the REST API:
+//
+//	GET /api/units/{unit}/{table}?address=0&count=10  read a range of a table
+//	PUT /api/units/{unit}/{table}?address=0           write {"values": [...]}
+//	GET /api/points                                   read all points of the Profile
+//	GET /api/points/{name}                            read a point of the Profile
+//	GET /api/connections                              list the TCP connections
+//	GET /api/stats                                    summarize the Metrics
+//	GET /api/live                                     stream changes over a WebSocket
+//
+// Tables are "coils", "discrete_inputs", "holding_registers" and
+// "input_registers". Coils and registers are read and written with Modbus
+// requests for the unit ID from the HTTP client, so that they pass the
+// Policy, Mapping and Gateway and are recorded like requests from Modbus
+// clients. Discrete inputs and input registers, which Modbus cannot write,
+// are written directly. Modbus exceptions are returned as status 400, or 502
+// for gateway exceptions, with a JSON body {"error": name, "exception": code}.
+//
+// A live view client sends {"watch": [{"table": t, "address": a, "count": n}]}
+// to choose the ranges it watches and receives LiveMessages with their values,
+// their changes, whether written by clients or by the application, and the
+// requests handled by the server. Browsers on other origins are rejected.
+func (s *Server) APIHandler() http.Handler {
+	return http.HandlerFunc(s.serveAPI)
+}
+
+// ListenAPI serves the REST API on "address:port" until the server is closed.
+// The API has no authentication of its own.
+func (s *Server) ListenAPI(addressPort string) error {
+	return s.listenHTTP(addressPort, s.APIHandler())
+}
+
+type apiError struct {
+	Error     string `json:"error"`
+	Exception uint8  `json:"exception,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	if exception, ok := err.(Exception); ok {
+		status := http.StatusBadRequest
+		if exception == GatewayPathUnavailable || exception == GatewayTargetDeviceFailedtoRespond {
+			status = http.StatusBadGateway
+		}
+		writeJSON(w, status, apiError{exception.String(), uint8(exception)})
+		return
+	}
+	writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+}
+
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(path) < 2 || path[0] != "api" {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "not found"})
+		return
+	}
+
+	method := http.MethodGet
+	switch {
+	case path[1] == "units" && len(path) == 4:
+		if r.Method == http.MethodPut {
+			s.serveTablePut(w, r, path[2], path[3])
+			return
+		}
+		if r.Method == http.MethodGet {
+			s.serveTableGet(w, r, path[2], path[3])
+			return
+		}
+		method = "GET, PUT"
+	case path[1] == "points" && len(path) <= 3:
+		if r.Method == http.MethodGet {
+			s.servePoints(w, path[2:])
+			return
+		}
+	case path[1] == "live" && len(path) == 2:
+		if r.Method == http.MethodGet {
+			s.serveLive(w, r)
+			return
+		}
+	case path[1] == "connections" && len(path) == 2:
+		if r.Method == http.MethodGet {
+			writeJSON(w, http.StatusOK, s.Connections())
+			return
+		}
+	case path[1] == "stats" && len(path) == 2:
+		if r.Method == http.MethodGet {
+			stats := s.Metrics.Stats()
+			if s.Metrics == nil {
+				s.connsMutex.Lock()
+				stats.ActiveConnections = len(s.conns)
+				s.connsMutex.Unlock()
+			}
+			writeJSON(w, http.StatusOK, stats)
+			return
+		}
+	default:
+		writeJSON(w, http.StatusNotFound, apiError{Error: "not found"})
+		return
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed"})
+}
+
+// parseUnitTable parses the unit ID and table of a table request.
+func parseUnitTable(unit, name string) (uint8, Table, error) {
+	unitID, err := strconv.ParseUint(unit, 10, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid unit ID %q", unit)
+	}
+	table, err := ParseTable(name)
+	return uint8(unitID), table, err
+}
+
+func parseQueryUint16(r *http.Request, name string, def uint16) (uint16, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return uint16(n), nil
+}
+
+func (s *Server) serveTableGet(w http.ResponseWriter, r *http.Request, unit, name string) {
+	unitID, table, err := parseUnitTable(unit, name)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	address, err := parseQueryUint16(r, "address", 0)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	count, err := parseQueryUint16(r, "count", 1)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if count == 0 || int(address)+int(count) > 65536 {
+		writeAPIError(w, fmt.Errorf("addresses %d+%d are out of range", address, count))
+		return
+	}
+
+	values, err := s.apiRead(r, unitID, table, int(address), int(count))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, TableValues{unitID, table.String(), address, values})
+}
+
+func (s *Server) serveTablePut(w http.ResponseWriter, r *http.Request, unit, name string) {
+	unitID, table, err := parseUnitTable(unit, name)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	var body TableValues
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAPIError(w, fmt.Errorf("invalid body: %v", err))
+		return
+	}
+	address, err := parseQueryUint16(r, "address", body.Address)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if len(body.Values) == 0 || int(address)+len(body.Values) > 65536 {
+		writeAPIError(w, fmt.Errorf("addresses %d+%d are out of range", address, len(body.Values)))
+		return
+	}
+	for _, value := range body.Values {
+		if isBitTable(table) && value > 1 {
+			writeAPIError(w, fmt.Errorf("invalid %v value %d", table, value))
+			return
+		}
+	}
+
+	if err := s.apiWrite(r, unitID, table, int(address), body.Values); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, TableValues{unitID, table.String(), address, body.Values})
+}
+
+func (s *Server) servePoints(w http.ResponseWriter, names []string) {
+	if s.Profile == nil {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "no profile loaded"})
+		return
+	}
+	points := s.Profile.Points
+	if len(names) == 1 {
+		point := s.Profile.Point(names[0])
+		if point == nil {
+			writeJSON(w, http.StatusNotFound, apiError{Error: fmt.Sprintf("unknown point %q", names[0])})
+			return
+		}
+		points = []*Point{point}
+	}
+
+	values := make([]PointValue, len(points))
+	s.dataMutex.Lock()
+	for i, point := range points {
+		value, err := point.Get(s)
+		if err != nil {
+			value = err.Error()
+		}
+		values[i] = PointValue{point.Name, point.table.String(), point.Address, point.Type, point.write, value}
+	}
+	s.dataMutex.Unlock()
+
+	if len(names) == 1 {
+		writeJSON(w, http.StatusOK, values[0])
+		return
+	}
+	writeJSON(w, http.StatusOK, values)
+}
+
+// apiClient returns the request of the HTTP client for the unit ID, whose
+// frame is set for each Modbus request made on its behalf.
+func apiClient(r *http.Request, unitID uint8) *Request {
+	request := &Request{
+		frame:     &TCPFrame{Device: unitID},
+		transport: "http",
+		client:    r.RemoteAddr,
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		request.client = host
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		request.listener = addr.String()
+	}
+	return request
+}
+
+func (s *Server) apiRead(r *http.Request, unitID uint8, table Table, address int, count int) ([]uint16, error) {
+	return s.localRead(apiClient(r, unitID), table, address, count)
+}
+
+func (s *Server) apiWrite(r *http.Request, unitID uint8, table Table, address int, values []uint16) error {
+	return s.localWrite(apiClient(r, unitID), table, address, values)
+}
+
+// localRead reads count values of the table with Modbus requests made on
+// behalf of the client of another protocol.
+func (s *Server) localRead(client *Request, table Table, address int, count int) ([]uint16, error) {
+	max := maxReadRegisters
+	if isBitTable(table) {
+		max = maxReadBits
+	}
+	values := make([]uint16, 0, count)
+	for len(values) < count {
+		n := count - len(values)
+		if n > max {
+			n = max
+		}
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint16(data[0:2], uint16(address+len(values)))
+		binary.BigEndian.PutUint16(data[2:4], uint16(n))
+		response, err := s.localRequest(client, targetReadFunction(table), data)
+		if err != nil {
+			return nil, err
+		}
+		if len(response) < 1 {
+			return nil, fmt.Errorf("short response")
+		}
+		response = response[1:]
+		if isBitTable(table) {
+			if len(response) < (n+7)/8 {
+				return nil, fmt.Errorf("short response")
+			}
+			for i := 0; i < n; i++ {
+				values = append(values, uint16(response[i/8]>>(uint(i)%8)&1))
+			}
+		} else {
+			if len(response) < 2*n {
+				return nil, fmt.Errorf("short response")
+			}
+			values = append(values, BytesToUint16(response[:2*n])...)
+		}
+	}
+	return values, nil
+}
+
+// localWrite writes the values to the table on behalf of the client of
+// another protocol, with Modbus requests for coils and holding registers and
+// directly for the input tables.
+func (s *Server) localWrite(client *Request, table Table, address int, values []uint16) error {
+	switch table {
+	case DiscreteInputTable, InputRegisterTable:
+		s.dataMutex.Lock()
+		defer s.dataMutex.Unlock()
+		writer := ChangeEvent{UnitID: getDevice(client.frame), Client: client.client, Source: client.transport}
+		return s.writeTable(table, address, values, writer)
+	}
+
+	max := maxWriteRegisters
+	function := uint8(16)
+	if table == CoilTable {
+		max = maxWriteBits
+		function = 15
+	}
+	for written := 0; written < len(values); {
+		chunk := values[written:]
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		data := make([]byte, 5)
+		binary.BigEndian.PutUint16(data[0:2], uint16(address+written))
+		binary.BigEndian.PutUint16(data[2:4], uint16(len(chunk)))
+		if table == CoilTable {
+			packed := make([]byte, (len(chunk)+7)/8)
+			for i, value := range chunk {
+				packed[i/8] |= byte(value) << (uint(i) % 8)
+			}
+			data = append(data, packed...)
+		} else {
+			data = append(data, Uint16ToBytes(chunk)...)
+		}
+		data[4] = byte(len(data) - 5)
+		if _, err := s.localRequest(client, function, data); err != nil {
+			return err
+		}
+		written += len(chunk)
+	}
+	return nil
+}
+
+// localRequest passes a Modbus request of the client through the server's
+// request pipeline and returns the response data.
+func (s *Server) localRequest(client *Request, function uint8, data []byte) ([]byte, error) {
+	conn := &replayConn{response: make(chan []byte, 1)}
+	request := *client
+	request.conn = conn
+	request.frame = &TCPFrame{Device: getDevice(client.frame), Function: function, Data: data}
+	s.dispatch(&request)
+
+	response, err := NewTCPFrame(<-conn.response)
+	if err != nil {
+		return nil, err
+	}
+	if exception := GetException(response); exception != Success {
+		return nil, exception
+	}
+	return response.GetData(), nil
+}
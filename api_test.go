@@ -0,0 +1,179 @@
+package mbserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func apiCall(t *testing.T, method, url string, body interface{}, result interface{}) int {
+	reader := bytes.NewReader(nil)
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+	request, _ := http.NewRequest(method, url, reader)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer response.Body.Close()
+	if result != nil {
+		if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	return response.StatusCode
+}
+
+func TestAPITables(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	api := httptest.NewServer(s.APIHandler())
+	defer api.Close()
+	sub := s.Subscribe(100, DropNewest)
+
+	registers := make([]uint16, 300)
+	for i := range registers {
+		registers[i] = uint16(i + 1)
+	}
+	var got TableValues
+	status := apiCall(t, "PUT", api.URL+"/api/units/1/holding_registers?address=1000", TableValues{Values: registers}, &got)
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %v %v", status, got)
+	}
+	if !isEqual(registers, s.HoldingRegisters[1000:1300]) {
+		t.Errorf("expected the registers to be written")
+	}
+	status = apiCall(t, "GET", api.URL+"/api/units/1/holding_registers?address=1000&count=300", nil, &got)
+	if status != http.StatusOK || !isEqual(registers, got.Values) || got.Table != "holding_registers" || got.Address != 1000 {
+		t.Errorf("expected the registers, got %v %+v", status, got)
+	}
+
+	// Writes are reported like writes of Modbus clients.
+	event := <-sub.C
+	if event.Client != "127.0.0.1" || event.Address != 1000 || len(event.New) != maxWriteRegisters {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	coils := make([]uint16, 2100)
+	coils[0], coils[2099] = 1, 1
+	apiCall(t, "PUT", api.URL+"/api/units/1/coils", TableValues{Address: 10, Values: coils}, &got)
+	if s.Coils[10] != 1 || s.Coils[2109] != 1 || s.Coils[11] != 0 {
+		t.Errorf("expected the coils to be written")
+	}
+	apiCall(t, "GET", api.URL+"/api/units/1/coils?address=10&count=2100", nil, &got)
+	if !isEqual(coils, got.Values) {
+		t.Errorf("expected the coils")
+	}
+
+	// Input tables are written directly.
+	apiCall(t, "PUT", api.URL+"/api/units/1/input_registers?address=5", TableValues{Values: []uint16{42}}, &got)
+	if s.InputRegisters[5] != 42 {
+		t.Errorf("expected 42, got %v", s.InputRegisters[5])
+	}
+
+	var apiErr apiError
+	status = apiCall(t, "PUT", api.URL+"/api/units/1/coils", TableValues{Values: []uint16{2}}, &apiErr)
+	if status != http.StatusBadRequest || apiErr.Error != "invalid coils value 2" {
+		t.Errorf("expected 400, got %v %+v", status, apiErr)
+	}
+	status = apiCall(t, "GET", api.URL+"/api/units/1/registers", nil, &apiErr)
+	if status != http.StatusBadRequest {
+		t.Errorf("expected 400, got %v %+v", status, apiErr)
+	}
+	status = apiCall(t, "DELETE", api.URL+"/api/units/1/coils", nil, &apiErr)
+	if status != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %v %+v", status, apiErr)
+	}
+}
+
+func TestAPIPolicy(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Policy = NewPolicy(true)
+	s.Policy.AddRule(PolicyRule{UnitIDs: []uint8{2}})
+	api := httptest.NewServer(s.APIHandler())
+	defer api.Close()
+
+	var apiErr apiError
+	status := apiCall(t, "GET", api.URL+"/api/units/2/coils", nil, &apiErr)
+	if status != http.StatusBadRequest || apiErr.Error != "IllegalFunction" || apiErr.Exception != 1 {
+		t.Errorf("expected IllegalFunction, got %v %+v", status, apiErr)
+	}
+	status = apiCall(t, "GET", api.URL+"/api/units/1/coils", nil, nil)
+	if status != http.StatusOK {
+		t.Errorf("expected 200, got %v", status)
+	}
+}
+
+func TestAPINotCaptured(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	var out bytes.Buffer
+	capture, err := NewCapture(&out)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s.Capture = capture
+	headers := out.Len()
+	api := httptest.NewServer(s.APIHandler())
+	defer api.Close()
+
+	apiCall(t, "PUT", api.URL+"/api/units/1/holding_registers?address=5", TableValues{Values: []uint16{1}}, nil)
+	if s.HoldingRegisters[5] != 1 || out.Len() != headers {
+		t.Errorf("expected the write without capture, got %v and %d bytes", s.HoldingRegisters[5], out.Len()-headers)
+	}
+}
+
+func TestAPIPointsConnectionsStats(t *testing.T) {
+	profile, err := ParseProfile([]byte("points:\n  - {name: flow, table: input_registers, address: 0, type: float32, value: 2.5}\n"), "yaml")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s, err := NewServerFromProfile(profile)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer s.Close()
+	s.Metrics = NewMetrics()
+	api := httptest.NewServer(s.APIHandler())
+	defer api.Close()
+
+	var point PointValue
+	status := apiCall(t, "GET", api.URL+"/api/points/flow", nil, &point)
+	if status != http.StatusOK || point.Value != 2.5 || point.Type != "float32" || point.Writable {
+		t.Errorf("expected the point, got %v %+v", status, point)
+	}
+	var points []PointValue
+	apiCall(t, "GET", api.URL+"/api/points", nil, &points)
+	if len(points) != 1 || points[0].Name != "flow" {
+		t.Errorf("expected the points, got %+v", points)
+	}
+	if status := apiCall(t, "GET", api.URL+"/api/points/level", nil, nil); status != http.StatusNotFound {
+		t.Errorf("expected 404, got %v", status)
+	}
+
+	addr := getFreePort()
+	if err := s.ListenTCP(addr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	client := NewTCPClient(addr)
+	defer client.Close()
+	if _, err := client.ReadInputRegisters(0, 2); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	var connections []ConnectionInfo
+	apiCall(t, "GET", api.URL+"/api/connections", nil, &connections)
+	if len(connections) != 1 || connections[0].Local != addr {
+		t.Errorf("expected one connection to %v, got %+v", addr, connections)
+	}
+	var stats Stats
+	apiCall(t, "GET", api.URL+"/api/stats", nil, &stats)
+	if stats.Requests != 1 || stats.RequestsByFunction[4] != 1 || stats.ActiveConnections != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
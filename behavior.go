@@ -0,0 +1,191 @@
+package mbserver
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Behavior runs a Script when clients write to a range of coils or holding
+// registers, or periodically, so that device logic lives in the profile:
+//
+//	behaviors:
+//	  - name: ramp
+//	    every: 100ms
+//	    when: coils[10]
+//	    do: ir[5] += clamp(hr[20] - ir[5], -10, 10)
+//	  - name: reset
+//	    on: coils 11
+//	    when: value
+//	    do: |
+//	      ir[5] = 0
+//	      coils[11] = 0
+//
+// Write behaviors run once per written address of their range, after the
+// write and before the response, with the variables address, value and old
+// holding the address and its new and previous values.
+type Behavior struct {
+	Name string `json:"name" yaml:"name"`
+	// On is the range whose writes trigger the behavior, such as "coils 10"
+	// or "holding_registers 100-109".
+	On string `json:"on" yaml:"on"`
+	// Every is the interval of a periodic behavior, such as "100ms".
+	Every string `json:"every" yaml:"every"`
+	// When is an Expression, the behavior runs only when it is not zero.
+	When string `json:"when" yaml:"when"`
+	// Do is the Script run.
+	Do    string `json:"do" yaml:"do"`
+	table Table
+	first int
+	last  int
+	every time.Duration
+	when  *Expression
+	do    *Script
+}
+
+// behaviorVars are the variables of write behaviors.
+var behaviorVars = []string{"address", "value", "old"}
+
+// validate checks the behavior and compiles its scripts with the names of the
+// profile, which may be nil.
+func (b *Behavior) validate(p *Profile) error {
+	var vars []string
+	switch {
+	case b.On != "" && b.Every != "":
+		return errors.New("on and every are exclusive")
+	case b.On != "":
+		if err := b.parseOn(); err != nil {
+			return fmt.Errorf("on: %v", err)
+		}
+		vars = behaviorVars
+	case b.Every != "":
+		var err error
+		if b.every, err = parseDuration(b.Every, 0); err != nil {
+			return fmt.Errorf("every: %v", err)
+		}
+	default:
+		return errors.New("either on or every is required")
+	}
+
+	b.when = nil
+	if b.When != "" {
+		var err error
+		if b.when, err = CompileExpression(b.When, p, vars...); err != nil {
+			return fmt.Errorf("when: %v", err)
+		}
+	}
+	var err error
+	if b.do, err = CompileScript(b.Do, p, vars...); err != nil {
+		return fmt.Errorf("do: %v", err)
+	}
+	if len(b.do.statements) == 0 {
+		return errors.New("do: empty script")
+	}
+	return nil
+}
+
+// parseOn parses the range "table first[-last]" of a write behavior.
+func (b *Behavior) parseOn() error {
+	fields := strings.Fields(b.On)
+	if len(fields) != 2 {
+		return fmt.Errorf("expected a table and addresses, got %q", b.On)
+	}
+	var err error
+	if b.table, err = ParseTable(fields[0]); err != nil {
+		return err
+	}
+	if b.table != CoilTable && b.table != HoldingRegisterTable {
+		return fmt.Errorf("clients cannot write %v", b.table)
+	}
+	first, last, found := strings.Cut(fields[1], "-")
+	if !found {
+		last = first
+	}
+	n, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid address %q", first)
+	}
+	m, err := strconv.ParseUint(last, 10, 16)
+	if err != nil || m < n {
+		return fmt.Errorf("invalid address %q", last)
+	}
+	b.first, b.last = int(n), int(m)
+	return nil
+}
+
+// run runs the behavior if its condition holds. The caller holds the data
+// lock.
+func (b *Behavior) run(s *Server, vars map[string]float64) error {
+	if b.when != nil {
+		cond, err := b.when.eval(s, vars)
+		if err != nil || cond == 0 {
+			return err
+		}
+	}
+	return b.do.run(s, vars, "behavior "+b.Name)
+}
+
+// Behave starts the behaviors: write behaviors run on every write by clients
+// to their range and periodic behaviors run until the server is closed.
+// Points are resolved in the server's Profile. Script errors are logged.
+func (s *Server) Behave(behaviors ...*Behavior) error {
+	for i, b := range behaviors {
+		if err := b.validate(s.Profile); err != nil {
+			return fmt.Errorf("behaviors[%d] (%s): %v", i, b.Name, err)
+		}
+	}
+	for _, b := range behaviors {
+		if b.On != "" {
+			s.dataMutex.Lock()
+			s.behaviors = append(s.behaviors, b)
+			s.dataMutex.Unlock()
+		} else {
+			go s.behave(b)
+		}
+	}
+	return nil
+}
+
+func (s *Server) behave(b *Behavior) {
+	ticker := time.NewTicker(b.every)
+	defer ticker.Stop()
+	failed := false
+	for {
+		select {
+		case <-s.portsCloseChan:
+			return
+		case <-ticker.C:
+		}
+		s.dataMutex.Lock()
+		err := b.run(s, nil)
+		s.dataMutex.Unlock()
+		// Log the first of consecutive errors only.
+		if err != nil && !failed {
+			s.logger().Warn("behavior error", "behavior", b.Name, "error", err)
+		}
+		failed = err != nil
+	}
+}
+
+// triggerBehaviors runs the write behaviors for the addresses of the table
+// written by the request, whose previous values were old. The caller holds
+// the data lock.
+func (s *Server) triggerBehaviors(request *Request, table Table, address int, old []uint16) {
+	values := s.readTable(table, address, len(old))
+	for _, b := range s.behaviors {
+		if b.table != table || b.last < address || b.first >= address+len(old) {
+			continue
+		}
+		for i := range old {
+			if address+i < b.first || address+i > b.last {
+				continue
+			}
+			vars := map[string]float64{"address": float64(address + i), "value": float64(values[i]), "old": float64(old[i])}
+			if err := b.run(s, vars); err != nil {
+				s.logger().Warn("behavior error", append(requestFields(request), "behavior", b.Name, "error", err)...)
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package mbserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBehaviors(t *testing.T) {
+	profile, err := ParseProfile([]byte(`
+ranges:
+  - {table: coils, first: 0, last: 99}
+  - {table: holding_registers, first: 0, last: 199}
+points:
+  - {name: setpoint, table: holding_registers, address: 20, type: uint16}
+behaviors:
+  - name: ramp
+    every: 10ms
+    when: coils[10]
+    do: ir[5] += clamp(setpoint - ir[5], -10, 10)
+  - name: echo
+    on: holding_registers 100-101
+    when: value != old
+    do: ir[address] = value + 1
+  - name: reset
+    on: coils 11
+    when: value
+    do: |
+      ir[5] = 0
+      coils[10] = 0
+      coils[11] = 0
+`), "yaml")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s, err := NewServerFromProfile(profile)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer s.Close()
+	if err := s.Behave(profile.Behaviors...); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	s.handle(gatewayRequest(1, 6, 20, 25))
+	s.handle(gatewayRequest(1, 5, 10, 0xFF00))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.dataMutex.Lock()
+		value := s.InputRegisters[5]
+		s.dataMutex.Unlock()
+		if value == 25 {
+			break
+		}
+		if value > 25 || time.Now().After(deadline) {
+			t.Fatalf("expected input register 5 to ramp to 25, got %v", value)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var frame TCPFrame
+	frame.Function = 16
+	SetDataWithRegisterAndNumberAndValues(&frame, 99, 3, []uint16{7, 8, 9})
+	s.handle(&Request{frame: &frame})
+	if !isEqual([]uint16{0, 9, 10}, s.InputRegisters[99:102]) {
+		t.Errorf("expected %v, got %v", []uint16{0, 9, 10}, s.InputRegisters[99:102])
+	}
+	s.InputRegisters[100] = 0
+	s.handle(&Request{frame: &frame})
+	if s.InputRegisters[100] != 0 {
+		t.Errorf("expected unchanged writes to be ignored, got %v", s.InputRegisters[100])
+	}
+
+	// The reset runs before the response, stopping the ramp.
+	s.handle(gatewayRequest(1, 5, 11, 0xFF00))
+	s.dataMutex.Lock()
+	if s.InputRegisters[5] != 0 || s.Coils[10] != 0 || s.Coils[11] != 0 {
+		t.Errorf("expected the reset, got %v %v %v", s.InputRegisters[5], s.Coils[10], s.Coils[11])
+	}
+	s.dataMutex.Unlock()
+}
+
+func TestBehaviorValidation(t *testing.T) {
+	tests := map[string]string{
+		"{do: 'hr[0] = 1'}":                         "behaviors[0] (): either on or every is required",
+		"{on: coils 1, every: 1s, do: 'hr[0] = 1'}": "behaviors[0] (): on and every are exclusive",
+		"{on: input_registers 1, do: 'hr[0] = 1'}":  "behaviors[0] (): on: clients cannot write input_registers",
+		"{on: coils 5-4, do: 'hr[0] = 1'}":          `behaviors[0] (): on: invalid address "4"`,
+		"{every: 0s, do: 'hr[0] = 1'}":              `behaviors[0] (): every: invalid duration "0s"`,
+		"{name: b, every: 1s, do: 'hr[0] = value'}": `behaviors[0] (b): do: position 9: unknown name "value"`,
+		"{name: b, on: coils 1, when: 'value +'}":   "behaviors[0] (b): when: position 8: unexpected end",
+		"{name: b, on: coils 1}":                    "behaviors[0] (b): do: empty script",
+	}
+	for behavior, expect := range tests {
+		_, err := ParseProfile([]byte("behaviors:\n  - "+behavior+"\n"), "yaml")
+		if err == nil || err.Error() != expect {
+			t.Errorf("%s: expected %q, got %v", behavior, expect, err)
+		}
+	}
+}
+
+func TestBehaviorWritesPersisted(t *testing.T) {
+	dir := t.TempDir()
+	behaviors := []*Behavior{{Name: "reset", On: "coils 11", When: "value", Do: "coils[11] = 0; ir[1] = 7"}}
+	s, p := persistentServer(t, dir)
+	if err := s.Behave(behaviors...); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	sub := s.Subscribe(10, DropNewest)
+	s.handle(gatewayRequest(1, 5, 11, 0xFF00))
+	sub.Close()
+	p.Close()
+	s.Close()
+
+	var events []ChangeEvent
+	for event := range sub.C {
+		events = append(events, event)
+	}
+	if len(events) != 3 || events[0].Source != "" || events[1].Source != "behavior reset" ||
+		!isEqual([]uint16{1}, events[1].Old) || !isEqual([]uint16{0}, events[1].New) || events[2].Table != InputRegisterTable {
+		t.Errorf("expected the client write and the behavior writes, got %+v", events)
+	}
+
+	// The reset is restored rather than the client's write.
+	s, p = persistentServer(t, dir)
+	defer s.Close()
+	defer p.Close()
+	if s.Coils[11] != 0 {
+		t.Errorf("expected 0, got %v", s.Coils[11])
+	}
+}
@@ -0,0 +1,218 @@
+package mbserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Link types of the capture interfaces.
+const (
+	// LinkTypeRaw is the pcapng link type of captured Modbus TCP and UDP traffic, raw IPv4/IPv6 packets.
+	LinkTypeRaw = 101
+	// LinkTypeUser0 is the pcapng link type of captured Modbus RTU frames. In Wireshark,
+	// map DLT User 0 to the "mbrtu" payload protocol to decode them.
+	LinkTypeUser0 = 147
+)
+
+const (
+	captureTCPInterface = 0
+	captureRTUInterface = 1
+)
+
+// Capture writes request and response frames to a pcapng stream which can be
+// opened with Wireshark. Modbus TCP frames are wrapped in synthetic IP and TCP
+// headers, or UDP headers for datagrams, with the client and listener
+// addresses; RTU frames are written as is and ASCII frames as the equivalent
+// RTU frames.
+// The caller is responsible for closing the underlying writer.
+type Capture struct {
+	mutex sync.Mutex
+	w     io.Writer
+	seq   map[string]uint32
+}
+
+// NewCapture writes the pcapng section and interface headers to w and returns
+// a Capture to set on Server.Capture.
+func NewCapture(w io.Writer) (*Capture, error) {
+	c := &Capture{w: w, seq: make(map[string]uint32)}
+
+	// Section header block.
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:4], 0x0A0D0D0A)
+	binary.LittleEndian.PutUint32(shb[4:8], 28)
+	binary.LittleEndian.PutUint32(shb[8:12], 0x1A2B3C4D)
+	binary.LittleEndian.PutUint16(shb[12:14], 1)
+	binary.LittleEndian.PutUint16(shb[14:16], 0)
+	binary.LittleEndian.PutUint64(shb[16:24], 0xFFFFFFFFFFFFFFFF)
+	binary.LittleEndian.PutUint32(shb[24:28], 28)
+	if _, err := w.Write(shb); err != nil {
+		return nil, err
+	}
+
+	// Interface description blocks, timestamps default to microseconds.
+	for _, linkType := range []uint16{LinkTypeRaw, LinkTypeUser0} {
+		idb := make([]byte, 20)
+		binary.LittleEndian.PutUint32(idb[0:4], 1)
+		binary.LittleEndian.PutUint32(idb[4:8], 20)
+		binary.LittleEndian.PutUint16(idb[8:10], linkType)
+		binary.LittleEndian.PutUint32(idb[12:16], 0)
+		binary.LittleEndian.PutUint32(idb[16:20], 20)
+		if _, err := w.Write(idb); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// captureRequest writes a request and its response.
+func (c *Capture) captureRequest(request *Request, response []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	packet := request.frame.Bytes()
+
+	conn, ok := request.conn.(interface {
+		LocalAddr() net.Addr
+		RemoteAddr() net.Addr
+	})
+	if !ok {
+		if _, ascii := request.frame.(*ASCIIFrame); ascii {
+			packet, response = asciiToRTU(packet), asciiToRTU(response)
+		}
+		if err := c.writePacket(captureRTUInterface, now, packet); err != nil || response == nil {
+			return err
+		}
+		return c.writePacket(captureRTUInterface, now, response)
+	}
+
+	client, clientPort := addrIPPort(conn.RemoteAddr())
+	server, serverPort := addrIPPort(conn.LocalAddr())
+	wrap := c.tcpPacket
+	if request.transport == "udp" {
+		wrap = udpPacket
+	}
+	if err := c.writePacket(captureTCPInterface, now, wrap(client, clientPort, server, serverPort, packet)); err != nil || response == nil {
+		return err
+	}
+	return c.writePacket(captureTCPInterface, now, wrap(server, serverPort, client, clientPort, response))
+}
+
+// asciiToRTU converts an ASCII frame to the RTU frame of the same address
+// and PDU, so that ASCII traffic is captured and replayed as RTU. Packets
+// which are not valid ASCII frames, such as nil, are returned as is.
+func asciiToRTU(packet []byte) []byte {
+	frame, err := NewASCIIFrame(packet)
+	if err != nil {
+		return packet
+	}
+	return (&RTUFrame{Address: frame.Address, Function: frame.Function, Data: frame.Data}).Bytes()
+}
+
+// tcpPacket wraps the payload in IP and TCP headers, keeping track of the
+// sequence numbers of each direction so that Wireshark reassembles the stream.
+func (c *Capture) tcpPacket(src net.IP, srcPort int, dst net.IP, dstPort int, payload []byte) []byte {
+	flow := fmt.Sprintf("%s:%d>%s:%d", src, srcPort, dst, dstPort)
+	reverse := fmt.Sprintf("%s:%d>%s:%d", dst, dstPort, src, srcPort)
+	seq, ok := c.seq[flow]
+	if !ok {
+		seq = 1
+	}
+	ack, ok := c.seq[reverse]
+	if !ok {
+		ack = 1
+	}
+	c.seq[flow] = seq + uint32(len(payload))
+
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(tcp[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], ack)
+	tcp[12] = 5 << 4 // Data offset in 32 bit words.
+	tcp[13] = 0x18   // PSH, ACK
+	binary.BigEndian.PutUint16(tcp[14:16], 65535)
+	tcp = append(tcp, payload...)
+	return ipPacket(src, dst, 6, tcp)
+}
+
+// udpPacket wraps the payload of a datagram in IP and UDP headers.
+func udpPacket(src net.IP, srcPort int, dst net.IP, dstPort int, payload []byte) []byte {
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+	return ipPacket(src, dst, 17, udp)
+}
+
+// ipPacket wraps the segment of the protocol in an IPv4 header, or an IPv6
+// header if either address is IPv6.
+func ipPacket(src net.IP, dst net.IP, protocol byte, segment []byte) []byte {
+	src4, dst4 := src.To4(), dst.To4()
+	if src4 != nil && dst4 != nil {
+		ip := make([]byte, 20, 20+len(segment))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(segment)))
+		ip[8] = 64 // TTL
+		ip[9] = protocol
+		copy(ip[12:16], src4)
+		copy(ip[16:20], dst4)
+		binary.BigEndian.PutUint16(ip[10:12], ipChecksum(ip))
+		return append(ip, segment...)
+	}
+
+	ip := make([]byte, 40, 40+len(segment))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:6], uint16(len(segment)))
+	ip[6] = protocol
+	ip[7] = 64 // Hop limit
+	copy(ip[8:24], src.To16())
+	copy(ip[24:40], dst.To16())
+	return append(ip, segment...)
+}
+
+// writePacket writes an enhanced packet block.
+func (c *Capture) writePacket(iface uint32, timestamp time.Time, packet []byte) error {
+	padded := (len(packet) + 3) &^ 3
+	length := 32 + padded
+	block := make([]byte, length)
+	micros := uint64(timestamp.UnixNano() / 1000)
+	binary.LittleEndian.PutUint32(block[0:4], 6)
+	binary.LittleEndian.PutUint32(block[4:8], uint32(length))
+	binary.LittleEndian.PutUint32(block[8:12], iface)
+	binary.LittleEndian.PutUint32(block[12:16], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(block[16:20], uint32(micros))
+	binary.LittleEndian.PutUint32(block[20:24], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(block[24:28], uint32(len(packet)))
+	copy(block[28:], packet)
+	binary.LittleEndian.PutUint32(block[length-4:], uint32(length))
+	_, err := c.w.Write(block)
+	return err
+}
+
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+	return net.IPv4zero, 0
+}
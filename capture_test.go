@@ -0,0 +1,184 @@
+package mbserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// bufferConn is a serial port stub.
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (c *bufferConn) Close() error { return nil }
+
+// addrConn is a connection stub with fixed addresses.
+type addrConn struct {
+	bufferConn
+	local, remote net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr  { return c.local }
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// pcapngPackets returns the interface IDs and packet data of the enhanced packet blocks.
+func pcapngPackets(t *testing.T, data []byte) (ifaces []uint32, packets [][]byte) {
+	for len(data) > 0 {
+		blockType := binary.LittleEndian.Uint32(data[0:4])
+		length := binary.LittleEndian.Uint32(data[4:8])
+		if int(length) > len(data) || binary.LittleEndian.Uint32(data[length-4:length]) != length {
+			t.Fatalf("bad block length %d", length)
+		}
+		if blockType == 6 {
+			captured := binary.LittleEndian.Uint32(data[20:24])
+			ifaces = append(ifaces, binary.LittleEndian.Uint32(data[8:12]))
+			packets = append(packets, data[28:28+captured])
+		}
+		data = data[length:]
+	}
+	return ifaces, packets
+}
+
+func TestCaptureTCP(t *testing.T) {
+	var out bytes.Buffer
+	c, err := NewCapture(&out)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	frame, _ := NewTCPFrame([]byte{0, 1, 0, 0, 0, 6, 1, 3, 0, 0, 0, 1})
+	conn := &addrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 502},
+		remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000},
+	}
+	response := []byte{0, 1, 0, 0, 0, 5, 1, 3, 2, 0, 7}
+	err = c.captureRequest(&Request{conn: conn, frame: frame}, response)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	ifaces, packets := pcapngPackets(t, out.Bytes())
+	if len(packets) != 2 {
+		t.Fatalf("expected 2 packets, got %d", len(packets))
+	}
+	for _, iface := range ifaces {
+		if iface != captureTCPInterface {
+			t.Errorf("expected interface %d, got %d", captureTCPInterface, iface)
+		}
+	}
+
+	request := packets[0]
+	if ipChecksum(request[0:20]) != 0 {
+		t.Errorf("bad IP header checksum")
+	}
+	if !bytes.Equal(net.ParseIP("10.0.0.2").To4(), request[12:16]) {
+		t.Errorf("expected source 10.0.0.2, got %v", net.IP(request[12:16]))
+	}
+	if port := binary.BigEndian.Uint16(request[22:24]); port != 502 {
+		t.Errorf("expected destination port 502, got %d", port)
+	}
+	if !isEqual(frame.Bytes(), request[40:]) {
+		t.Errorf("expected %v, got %v", frame.Bytes(), request[40:])
+	}
+
+	// The response acknowledges the request and continues the server sequence.
+	reply := packets[1]
+	if ack := binary.BigEndian.Uint32(reply[28:32]); ack != 1+12 {
+		t.Errorf("expected ack 13, got %d", ack)
+	}
+	if !isEqual(response, reply[40:]) {
+		t.Errorf("expected %v, got %v", response, reply[40:])
+	}
+}
+
+func TestCaptureUDP(t *testing.T) {
+	var out bytes.Buffer
+	c, err := NewCapture(&out)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	listen, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer listen.Close()
+
+	frame, _ := NewTCPFrame([]byte{0, 1, 0, 0, 0, 6, 1, 3, 0, 0, 0, 1})
+	conn := &datagramConn{listen, &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 40000}}
+	err = c.captureRequest(&Request{conn: conn, frame: frame, transport: "udp"}, []byte{0, 1, 0, 0, 0, 5, 1, 3, 2, 0, 7})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	ifaces, packets := pcapngPackets(t, out.Bytes())
+	if !isEqual([]uint32{captureTCPInterface, captureTCPInterface}, ifaces) {
+		t.Errorf("expected IP interface, got %v", ifaces)
+	}
+	request := packets[0]
+	if request[9] != 17 {
+		t.Errorf("expected protocol 17, got %d", request[9])
+	}
+	port := listen.LocalAddr().(*net.UDPAddr).Port
+	if got := binary.BigEndian.Uint16(request[22:24]); int(got) != port {
+		t.Errorf("expected destination port %d, got %d", port, got)
+	}
+	if !isEqual(frame.Bytes(), request[28:]) {
+		t.Errorf("expected %v, got %v", frame.Bytes(), request[28:])
+	}
+}
+
+func TestCaptureRTU(t *testing.T) {
+	var out bytes.Buffer
+	c, err := NewCapture(&out)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	frame, _ := NewRTUFrame([]byte{0x01, 0x04, 0x02, 0xFF, 0xFF, 0xB8, 0x80})
+	err = c.captureRequest(&Request{conn: &bufferConn{}, frame: frame}, []byte{0x01, 0x84, 0x02, 0xC2, 0xC1})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	ifaces, packets := pcapngPackets(t, out.Bytes())
+	if !isEqual([]uint32{captureRTUInterface, captureRTUInterface}, ifaces) {
+		t.Errorf("expected RTU interface, got %v", ifaces)
+	}
+	if !isEqual(frame.Bytes(), packets[0]) {
+		t.Errorf("expected %v, got %v", frame.Bytes(), packets[0])
+	}
+}
+
+func TestCaptureASCII(t *testing.T) {
+	var out bytes.Buffer
+	c, err := NewCapture(&out)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s := NewServer()
+	defer s.Close()
+	s.HoldingRegisters[1] = 7
+
+	frame := &ASCIIFrame{Address: 1, Function: 3}
+	SetDataWithRegisterAndNumber(frame, 1, 1)
+	request := &Request{conn: &bufferConn{}, frame: frame, transport: "ascii"}
+	if err := c.captureRequest(request, s.handle(request).Bytes()); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	// The frames are captured as RTU, which Wireshark decodes and Replay handles.
+	exchanges, err := ReadCapture(&out)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []Exchange{{Transport: "rtu", Request: []byte{1, 3, 0, 1, 0, 1, 0xD5, 0xCA}, Response: []byte{1, 3, 2, 0, 7, 0xF9, 0x86}}}
+	if !isEqual(expect, exchanges) {
+		t.Errorf("expected %v, got %v", expect, exchanges)
+	}
+	diffs, err := s.Replay(exchanges)
+	if err != nil || len(diffs) != 0 {
+		t.Errorf("expected no differences, got %v %v", diffs, err)
+	}
+}
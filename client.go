@@ -0,0 +1,305 @@
+package mbserver
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+// ErrTimeout is returned by the Client when no response is received in time.
+var ErrTimeout = errors.New("modbus: response timeout")
+
+// clientTransport sends a request frame and waits for the matching response.
+type clientTransport interface {
+	connect(timeout time.Duration) error
+	close() error
+	newFrame(unitID uint8, function uint8, data []byte) Framer
+	send(request Framer, timeout time.Duration, trace *trace) (Framer, error)
+}
+
+// Client is a Modbus client (master). Requests are sent one at a time; a
+// Client is safe for use by multiple goroutines.
+type Client struct {
+	// UnitID is the unit identifier (slave address) requests are sent to.
+	UnitID uint8
+	// Timeout bounds the time to connect and to receive each response.
+	Timeout time.Duration
+	// Retries is the number of times a request is resent after a timeout or
+	// connection error. Exception responses are not retried.
+	Retries int
+	// Trace, when set, is called after each attempt with the bytes written
+	// to and read from the connection, including those of timed out and
+	// malformed responses.
+	Trace     func(sent []byte, received []byte)
+	mutex     sync.Mutex
+	transport clientTransport
+}
+
+func newClient(transport clientTransport) *Client {
+	return &Client{UnitID: 1, Timeout: 5 * time.Second, transport: transport}
+}
+
+// NewTCPClient creates a Modbus TCP client for "address:port".
+func NewTCPClient(addressPort string) *Client {
+	return newClient(&tcpTransport{address: addressPort})
+}
+
+// NewTLSClient creates a Modbus TCP client using TLS for "address:port".
+func NewTLSClient(addressPort string, config *tls.Config) *Client {
+	return newClient(&tcpTransport{address: addressPort, tlsConfig: config})
+}
+
+// NewRTUClient creates a Modbus RTU client on a serial device.
+// For example:  c := NewRTUClient(&serial.Config{Address: "/dev/ttyUSB0"})
+func NewRTUClient(serialConfig *serial.Config) *Client {
+	return newClient(&serialTransport{config: serialConfig, framing: rtuFraming})
+}
+
+// NewASCIIClient creates a Modbus ASCII client on a serial device.
+func NewASCIIClient(serialConfig *serial.Config) *Client {
+	return newClient(&serialTransport{config: serialConfig, framing: asciiFraming})
+}
+
+// Connect connects to the server. Requests connect automatically, Connect
+// allows connection errors to be detected early.
+func (c *Client) Connect() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.transport.connect(c.Timeout)
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.transport.close()
+}
+
+// NewFrame returns a request frame for the client transport addressed to
+// UnitID.
+func (c *Client) NewFrame(function uint8, data []byte) Framer {
+	return c.transport.newFrame(c.UnitID, function, data)
+}
+
+// Send sends a request frame and returns the response frame. The frame must
+// match the client transport: *TCPFrame for TCP and TLS clients, *RTUFrame
+// and *ASCIIFrame for RTU and ASCII clients. TCP frames are sent with the
+// client's own transaction identifier. If the server responds with an
+// exception, the response and the Exception are returned.
+func (c *Client) Send(request Framer) (Framer, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var response Framer
+	var err error
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		var t *trace
+		if c.Trace != nil {
+			t = &trace{}
+		}
+		response, err = c.transport.send(request, c.Timeout, t)
+		if t != nil {
+			c.Trace(t.sent, t.received)
+		}
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if response.GetFunction() != request.GetFunction() {
+		if response.GetFunction() == request.GetFunction()|0x80 && len(response.GetData()) > 0 {
+			return response, GetException(response)
+		}
+		return nil, fmt.Errorf("modbus: response function %d does not match request function %d",
+			response.GetFunction(), request.GetFunction())
+	}
+	return response, nil
+}
+
+// Request sends the function and data to UnitID and returns the response data.
+func (c *Client) Request(function uint8, data []byte) ([]byte, error) {
+	response, err := c.Send(c.NewFrame(function, data))
+	if err != nil {
+		return nil, err
+	}
+	return response.GetData(), nil
+}
+
+// ReadCoils function 1, returns one byte (0 or 1) per coil.
+func (c *Client) ReadCoils(address uint16, quantity uint16) ([]byte, error) {
+	return c.readBits(1, address, quantity)
+}
+
+// ReadDiscreteInputs function 2, returns one byte (0 or 1) per discrete input.
+func (c *Client) ReadDiscreteInputs(address uint16, quantity uint16) ([]byte, error) {
+	return c.readBits(2, address, quantity)
+}
+
+// ReadHoldingRegisters function 3.
+func (c *Client) ReadHoldingRegisters(address uint16, quantity uint16) ([]uint16, error) {
+	return c.readRegisters(3, address, quantity)
+}
+
+// ReadInputRegisters function 4.
+func (c *Client) ReadInputRegisters(address uint16, quantity uint16) ([]uint16, error) {
+	return c.readRegisters(4, address, quantity)
+}
+
+// WriteSingleCoil function 5.
+func (c *Client) WriteSingleCoil(address uint16, value bool) error {
+	var coil uint16
+	if value {
+		coil = 0xFF00
+	}
+	return c.write(5, address, coil, nil)
+}
+
+// WriteSingleRegister function 6.
+func (c *Client) WriteSingleRegister(address uint16, value uint16) error {
+	return c.write(6, address, value, nil)
+}
+
+// WriteMultipleCoils function 15, values holds one byte (0 or 1) per coil.
+func (c *Client) WriteMultipleCoils(address uint16, values []byte) error {
+	packed := make([]byte, (len(values)+7)/8)
+	for i, value := range values {
+		if value != 0 {
+			packed[i/8] |= 1 << (uint(i) % 8)
+		}
+	}
+	return c.write(15, address, uint16(len(values)), packed)
+}
+
+// WriteMultipleRegisters function 16.
+func (c *Client) WriteMultipleRegisters(address uint16, values []uint16) error {
+	return c.write(16, address, uint16(len(values)), Uint16ToBytes(values))
+}
+
+func (c *Client) readBits(function uint8, address uint16, quantity uint16) ([]byte, error) {
+	data, err := c.Request(function, addressAndNumber(address, quantity))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 1 || int(data[0]) != len(data)-1 || int(data[0]) < (int(quantity)+7)/8 {
+		return nil, fmt.Errorf("modbus: invalid response length %d for %d bits", len(data), quantity)
+	}
+
+	values := make([]byte, quantity)
+	for i := range values {
+		values[i] = bitAtPosition(data[1+i/8], uint(i)%8)
+	}
+	return values, nil
+}
+
+func (c *Client) readRegisters(function uint8, address uint16, quantity uint16) ([]uint16, error) {
+	data, err := c.Request(function, addressAndNumber(address, quantity))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 1 || int(data[0]) != len(data)-1 || int(data[0]) != 2*int(quantity) {
+		return nil, fmt.Errorf("modbus: invalid response length %d for %d registers", len(data), quantity)
+	}
+	return BytesToUint16(data[1:]), nil
+}
+
+// write sends a write request, with values appended after a byte count when
+// not nil, and checks that the response echoes the address and value or quantity.
+func (c *Client) write(function uint8, address uint16, valueOrNumber uint16, values []byte) error {
+	request := addressAndNumber(address, valueOrNumber)
+	if values != nil {
+		request = append(request, byte(len(values)))
+		request = append(request, values...)
+	}
+
+	data, err := c.Request(function, request)
+	if err != nil {
+		return err
+	}
+	if len(data) < 4 || binary.BigEndian.Uint16(data[0:2]) != address || binary.BigEndian.Uint16(data[2:4]) != valueOrNumber {
+		return fmt.Errorf("modbus: unexpected response % x", data)
+	}
+	return nil
+}
+
+func addressAndNumber(address uint16, number uint16) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint16(data[0:2], address)
+	binary.BigEndian.PutUint16(data[2:4], number)
+	return data
+}
+
+// readFull reads exactly len(buffer) bytes before the deadline. Connections
+// supporting read deadlines have it set, serial ports rely on their own read
+// timeout and are polled until the deadline passes.
+func readFull(r io.Reader, buffer []byte, deadline time.Time) error {
+	if conn, ok := r.(interface{ SetReadDeadline(time.Time) error }); ok {
+		conn.SetReadDeadline(deadline)
+	}
+
+	for read := 0; read < len(buffer); {
+		n, err := r.Read(buffer[read:])
+		read += n
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return ErrTimeout
+			}
+			if err != serial.ErrTimeout {
+				return err
+			}
+		}
+		if read < len(buffer) && time.Now().After(deadline) {
+			return ErrTimeout
+		}
+	}
+	return nil
+}
+
+// trace records the bytes written to and read from a connection.
+type trace struct {
+	sent     []byte
+	received []byte
+}
+
+// wrap returns the connection recording into the trace, or the connection
+// itself without a trace.
+func (t *trace) wrap(conn io.ReadWriter) io.ReadWriter {
+	if t == nil {
+		return conn
+	}
+	return &traceConn{conn, t}
+}
+
+type traceConn struct {
+	conn  io.ReadWriter
+	trace *trace
+}
+
+func (c *traceConn) Read(p []byte) (int, error) {
+	n, err := c.conn.Read(p)
+	c.trace.received = append(c.trace.received, p[:n]...)
+	return n, err
+}
+
+func (c *traceConn) Write(p []byte) (int, error) {
+	n, err := c.conn.Write(p)
+	c.trace.sent = append(c.trace.sent, p[:n]...)
+	return n, err
+}
+
+// SetReadDeadline sets the deadline of the connection if it has one.
+func (c *traceConn) SetReadDeadline(deadline time.Time) error {
+	if conn, ok := c.conn.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return conn.SetReadDeadline(deadline)
+	}
+	return nil
+}
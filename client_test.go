@@ -0,0 +1,245 @@
+package mbserver
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+func TestClientTCP(t *testing.T) {
+	s := NewServer()
+	addr := getFreePort()
+	err := s.ListenTCP(addr)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	client := NewTCPClient(addr)
+	err = client.Connect()
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer client.Close()
+
+	// Coils
+	err = client.WriteMultipleCoils(100, []byte{1, 0, 1, 1, 0, 0, 0, 0, 1})
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	err = client.WriteSingleCoil(101, true)
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	coils, err := client.ReadCoils(100, 10)
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	expect := []byte{1, 1, 1, 1, 0, 0, 0, 0, 1, 0}
+	if !isEqual(expect, coils) {
+		t.Errorf("expected %v, got %v", expect, coils)
+	}
+
+	// Holding registers
+	err = client.WriteMultipleRegisters(1, []uint16{3, 4})
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	err = client.WriteSingleRegister(3, 65535)
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	registers, err := client.ReadHoldingRegisters(1, 3)
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if !isEqual([]uint16{3, 4, 65535}, registers) {
+		t.Errorf("expected %v, got %v", []uint16{3, 4, 65535}, registers)
+	}
+
+	// Exceptions are returned as typed errors.
+	_, err = client.ReadInputRegisters(65535, 2)
+	var exception Exception
+	if !errors.As(err, &exception) || exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", err)
+	}
+}
+
+func TestClientTCPTransactionID(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer listen.Close()
+
+	// The server answers each request with a stale response before the real one.
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s := NewServer()
+		s.HoldingRegisters[0] = 42
+		for {
+			frame, err := readTCPFrame(conn, time.Now().Add(time.Second))
+			if err != nil {
+				return
+			}
+			response := s.handle(&Request{frame: frame}).(*TCPFrame)
+			stale := *response
+			stale.TransactionIdentifier--
+			conn.Write(append(stale.Bytes(), response.Bytes()...))
+		}
+	}()
+
+	client := NewTCPClient(listen.Addr().String())
+	defer client.Close()
+	for i := 0; i < 2; i++ {
+		registers, err := client.ReadHoldingRegisters(0, 1)
+		if err != nil {
+			t.Fatalf("expected nil, got %v\n", err)
+		}
+		if !isEqual([]uint16{42}, registers) {
+			t.Errorf("expected %v, got %v", []uint16{42}, registers)
+		}
+	}
+}
+
+func TestClientTCPTimeoutRetries(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer listen.Close()
+
+	// The server never responds.
+	accepted := make(chan net.Conn, 3)
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	client := NewTCPClient(listen.Addr().String())
+	client.Timeout = 20 * time.Millisecond
+	client.Retries = 2
+	defer client.Close()
+
+	_, err = client.ReadHoldingRegisters(0, 1)
+	if err != ErrTimeout {
+		t.Errorf("expected %v, got %v", ErrTimeout, err)
+	}
+	// Each attempt reconnects.
+	if len(accepted) != 3 {
+		t.Errorf("expected 3 connections, got %d", len(accepted))
+	}
+	for len(accepted) > 0 {
+		(<-accepted).Close()
+	}
+}
+
+// serveSerial answers frames read from the port with the server until the port is closed.
+func serveSerial(s *Server, port net.Conn, framing serialFraming) {
+	for {
+		var frame Framer
+		var err error
+		if framing == asciiFraming {
+			frame, err = readASCIIFrame(port, time.Now().Add(time.Second))
+		} else {
+			// Requests handled here are all 8 bytes long.
+			packet := make([]byte, 8)
+			if err = readFull(port, packet, time.Now().Add(time.Second)); err == nil {
+				frame, err = NewRTUFrame(packet)
+			}
+		}
+		if err != nil {
+			return
+		}
+		port.Write(s.handle(&Request{frame: frame}).Bytes())
+	}
+}
+
+func TestClientSerial(t *testing.T) {
+	for _, framing := range []serialFraming{rtuFraming, asciiFraming} {
+		clientPort, serverPort := net.Pipe()
+		s := NewServer()
+		s.InputRegisters[7] = 0x1234
+		go serveSerial(s, serverPort, framing)
+
+		client := newClient(&serialTransport{framing: framing, port: clientPort})
+		registers, err := client.ReadInputRegisters(7, 1)
+		if err != nil {
+			t.Fatalf("expected nil, got %v\n", err)
+		}
+		if !isEqual([]uint16{0x1234}, registers) {
+			t.Errorf("expected %v, got %v", []uint16{0x1234}, registers)
+		}
+
+		_, err = client.ReadHoldingRegisters(65535, 2)
+		if err != IllegalDataAddress {
+			t.Errorf("expected IllegalDataAddress, got %v", err)
+		}
+		client.Close()
+	}
+}
+
+func TestClientRTUDeviceIdentification(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Identification = &DeviceIdentification{VendorName: "ACME", ProductCode: "P1", MajorMinorRevision: "1.0"}
+	clientPort, serverPort := net.Pipe()
+	go s.acceptSerialRequests(serverPort, &serial.Config{Address: "pipe"})
+
+	client := newClient(&serialTransport{framing: rtuFraming, port: clientPort})
+	defer client.Close()
+	client.Timeout = time.Second
+	data, err := client.Request(43, []byte{0x0E, 1, 0})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []byte{0x0E, 1, 0x82, 0, 0, 3, 0, 4, 'A', 'C', 'M', 'E', 1, 2, 'P', '1', 2, 3, '1', '.', '0'}
+	if !isEqual(expect, data) {
+		t.Errorf("expected %v, got %v", expect, data)
+	}
+}
+
+func TestClientRTUDrainsAfterBadFrame(t *testing.T) {
+	clientPort, slavePort := net.Pipe()
+	go func() {
+		response := (&RTUFrame{Address: 1, Function: 3, Data: []byte{2, 0, 7}}).Bytes()
+		for i := 0; ; i++ {
+			if _, err := io.ReadFull(slavePort, make([]byte, 8)); err != nil {
+				return
+			}
+			if i == 0 {
+				// A response with a bad CRC, followed by noise.
+				bad := append([]byte(nil), response...)
+				bad[len(bad)-1] ^= 0xFF
+				go slavePort.Write(append(bad, 0x55, 0xAA, 0x55))
+				continue
+			}
+			slavePort.Write(response)
+		}
+	}()
+
+	client := newClient(&serialTransport{framing: rtuFraming, port: clientPort})
+	defer client.Close()
+	client.Timeout = time.Second
+	client.Retries = 1
+	registers, err := client.ReadHoldingRegisters(0, 1)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if !isEqual([]uint16{7}, registers) {
+		t.Errorf("expected %v, got %v", []uint16{7}, registers)
+	}
+}
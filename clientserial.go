@@ -0,0 +1,221 @@
+package mbserver
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+type serialFraming int
+
+const (
+	rtuFraming serialFraming = iota
+	asciiFraming
+)
+
+// serialTransport sends Modbus RTU or ASCII frames over a serial port.
+type serialTransport struct {
+	config  *serial.Config
+	framing serialFraming
+	port    io.ReadWriteCloser
+}
+
+func (t *serialTransport) connect(timeout time.Duration) (err error) {
+	if t.port != nil {
+		return nil
+	}
+	t.port, err = serial.Open(t.config)
+	if err != nil {
+		t.port = nil
+	}
+	return err
+}
+
+func (t *serialTransport) close() error {
+	if t.port == nil {
+		return nil
+	}
+	err := t.port.Close()
+	t.port = nil
+	return err
+}
+
+func (t *serialTransport) newFrame(unitID uint8, function uint8, data []byte) Framer {
+	if t.framing == asciiFraming {
+		return &ASCIIFrame{Address: unitID, Function: function, Data: data}
+	}
+	return &RTUFrame{Address: unitID, Function: function, Data: data}
+}
+
+// send writes the request and reads the response from the addressed slave.
+// Frames from other slaves are discarded.
+func (t *serialTransport) send(request Framer, timeout time.Duration, trace *trace) (Framer, error) {
+	switch request.(type) {
+	case *RTUFrame:
+		if t.framing != rtuFraming {
+			return nil, fmt.Errorf("modbus: ASCII client cannot send %T", request)
+		}
+	case *ASCIIFrame:
+		if t.framing != asciiFraming {
+			return nil, fmt.Errorf("modbus: RTU client cannot send %T", request)
+		}
+	default:
+		return nil, fmt.Errorf("modbus: serial client cannot send %T", request)
+	}
+	if err := t.connect(timeout); err != nil {
+		return nil, err
+	}
+
+	port := trace.wrap(t.port)
+	if _, err := port.Write(request.Bytes()); err != nil {
+		t.close()
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var response Framer
+		var err error
+		if t.framing == asciiFraming {
+			response, err = readASCIIFrame(port, deadline)
+		} else {
+			response, err = readRTUFrame(port, deadline)
+		}
+		if err != nil {
+			drain(port, deadline.Add(timeout))
+			return nil, err
+		}
+		if getDevice(response) == getDevice(request) {
+			return response, nil
+		}
+	}
+}
+
+// readRTUFrame reads one RTU response frame, using the function code and
+// byte count to find its end.
+func readRTUFrame(r io.Reader, deadline time.Time) (*RTUFrame, error) {
+	// Exception responses, the shortest, are 5 bytes.
+	packet := make([]byte, 5, 256)
+	if err := readFull(r, packet, deadline); err != nil {
+		return nil, err
+	}
+
+	if packet[1] == 43 {
+		return readRTUDeviceIdentification(r, packet, deadline)
+	}
+	length, err := rtuResponseLength(packet)
+	if err != nil {
+		return nil, err
+	}
+	if length > 256 {
+		return nil, fmt.Errorf("RTU Frame error: length %d exceeds 256 bytes", length)
+	}
+	if length > len(packet) {
+		packet = packet[:length]
+		if err := readFull(r, packet[5:], deadline); err != nil {
+			return nil, err
+		}
+	}
+	return NewRTUFrame(packet)
+}
+
+// readRTUDeviceIdentification reads the rest of a function 43 MEI type 14
+// response starting with the 5 bytes of header, object by object until the
+// list announced by the response is complete.
+func readRTUDeviceIdentification(r io.Reader, header []byte, deadline time.Time) (*RTUFrame, error) {
+	if header[2] != meiReadDeviceIdentification {
+		return nil, fmt.Errorf("RTU Frame error: unsupported MEI type %d", header[2])
+	}
+	packet := header
+	read := func(n int) ([]byte, error) {
+		if len(packet)+n > 256 {
+			return nil, fmt.Errorf("RTU Frame error: length %d exceeds 256 bytes", len(packet)+n)
+		}
+		packet = append(packet, make([]byte, n)...)
+		return packet[len(packet)-n:], readFull(r, packet[len(packet)-n:], deadline)
+	}
+
+	// More follows, next object ID and number of objects.
+	fields, err := read(3)
+	if err != nil {
+		return nil, err
+	}
+	count := int(fields[2])
+	for i := 0; i < count; i++ {
+		object, err := read(2)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := read(int(object[1])); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := read(2); err != nil {
+		return nil, err
+	}
+	return NewRTUFrame(packet)
+}
+
+// drainSilence is the quiet time after which a port is considered drained.
+const drainSilence = 20 * time.Millisecond
+
+// drain discards the bytes left on the port by a timed out or malformed
+// response until it falls silent or the deadline passes, so that they do not
+// corrupt the response to the next request.
+func drain(r io.Reader, deadline time.Time) {
+	conn, hasDeadline := r.(interface{ SetReadDeadline(time.Time) error })
+	buffer := make([]byte, 256)
+	for time.Now().Before(deadline) {
+		if hasDeadline {
+			conn.SetReadDeadline(time.Now().Add(drainSilence))
+		}
+		// Serial ports return no bytes once their own read timeout passes.
+		if n, err := r.Read(buffer); n == 0 || (err != nil && err != serial.ErrTimeout) {
+			return
+		}
+	}
+}
+
+// rtuResponseLength returns the length of the RTU response frame starting
+// with header.
+func rtuResponseLength(header []byte) (int, error) {
+	function := header[1]
+	if function&0x80 != 0 {
+		return 5, nil
+	}
+	switch function {
+	case 1, 2, 3, 4, 12, 17, 20, 21, 23:
+		return 3 + int(header[2]) + 2, nil
+	case 5, 6, 8, 11, 15, 16:
+		return 8, nil
+	case 7:
+		return 5, nil
+	case 22:
+		return 10, nil
+	}
+	return 0, fmt.Errorf("RTU Frame error: unsupported function %d", function)
+}
+
+// readASCIIFrame reads one ASCII frame terminated by a line feed.
+func readASCIIFrame(r io.Reader, deadline time.Time) (*ASCIIFrame, error) {
+	packet := make([]byte, 0, 513)
+	b := make([]byte, 1)
+	for {
+		if err := readFull(r, b, deadline); err != nil {
+			return nil, err
+		}
+		if b[0] == ':' {
+			// Start of frame, discard anything before it.
+			packet = packet[:0]
+		}
+		packet = append(packet, b[0])
+		if b[0] == '\n' {
+			return NewASCIIFrame(packet)
+		}
+		if len(packet) == cap(packet) {
+			return nil, fmt.Errorf("ASCII Frame error: frame exceeds %d characters", cap(packet))
+		}
+	}
+}
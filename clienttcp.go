@@ -0,0 +1,104 @@
+package mbserver
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// tcpTransport sends Modbus TCP frames, optionally over TLS.
+type tcpTransport struct {
+	address       string
+	tlsConfig     *tls.Config
+	conn          net.Conn
+	transactionID uint16
+}
+
+func (t *tcpTransport) connect(timeout time.Duration) (err error) {
+	if t.conn != nil {
+		return nil
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	if t.tlsConfig != nil {
+		t.conn, err = tls.DialWithDialer(dialer, "tcp", t.address, t.tlsConfig)
+	} else {
+		t.conn, err = dialer.Dial("tcp", t.address)
+	}
+	if err != nil {
+		t.conn = nil
+	}
+	return err
+}
+
+func (t *tcpTransport) close() error {
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+func (t *tcpTransport) newFrame(unitID uint8, function uint8, data []byte) Framer {
+	frame := &TCPFrame{Device: unitID, Function: function}
+	frame.SetData(data)
+	return frame
+}
+
+// send writes the request with the next transaction identifier and returns
+// the response with the same identifier, discarding stale responses. The
+// connection is closed on errors so that the next request reconnects.
+func (t *tcpTransport) send(request Framer, timeout time.Duration, trace *trace) (Framer, error) {
+	frame, ok := request.(*TCPFrame)
+	if !ok {
+		return nil, fmt.Errorf("modbus: TCP client cannot send %T", request)
+	}
+	if err := t.connect(timeout); err != nil {
+		return nil, err
+	}
+
+	t.transactionID++
+	frame = frame.Copy().(*TCPFrame)
+	frame.TransactionIdentifier = t.transactionID
+
+	deadline := time.Now().Add(timeout)
+	t.conn.SetWriteDeadline(deadline)
+	conn := trace.wrap(t.conn)
+	if _, err := conn.Write(frame.Bytes()); err != nil {
+		t.close()
+		return nil, err
+	}
+
+	for {
+		response, err := readTCPFrame(conn, deadline)
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+		if response.TransactionIdentifier == frame.TransactionIdentifier {
+			return response, nil
+		}
+	}
+}
+
+// readTCPFrame reads one Modbus TCP frame, using the MBAP length field to
+// find its end.
+func readTCPFrame(conn io.Reader, deadline time.Time) (*TCPFrame, error) {
+	header := make([]byte, 6)
+	if err := readFull(conn, header, deadline); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[4:6]))
+	if length < 2 || length > 254 {
+		return nil, fmt.Errorf("modbus: invalid MBAP length %d", length)
+	}
+	packet := make([]byte, 6+length)
+	copy(packet, header)
+	if err := readFull(conn, packet[6:], deadline); err != nil {
+		return nil, err
+	}
+	return NewTCPFrame(packet)
+}
@@ -0,0 +1,690 @@
+// Command mbcli is a Modbus client (master) for reading and writing the
+// tables of a server over TCP, RTU or ASCII.
+//
+// A command given as arguments is run once; otherwise commands are read from
+// a -script file or interactively from the standard input:
+//
+//	mbcli -tcp 192.168.1.10:502 read hr 100 2 float32
+//	mbcli -rtu /dev/ttyUSB0 -baud 9600 -unit 17 -hex write hr 40 uint32 123456
+//	mbcli -tcp localhost:1502 -script commissioning.txt
+//
+// Type "help" for the commands.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goburrow/serial"
+	"github.com/tbrandon/mbserver"
+)
+
+const usage = `commands:
+  read <table> <address> [count] [type]      read count values (default 1)
+  write <table> <address> [type] <values...> write values
+  raw <function> [hex data]                  send any function code
+  poll <interval> <count> <command...>       repeat a command, count 0 until interrupted
+  sleep <duration>                           wait, for scripts
+  unit <id>                                  set the unit ID
+  order <ABCD|CDAB|BADC|DCBA>                set the word order of typed values
+  hex <on|off>                               dump raw frames
+  help, quit
+tables: coils (c), discrete_inputs (di), holding_registers (hr), input_registers (ir)
+types: uint16, int16, uint32, int32, uint64, int64, float32, float64, bcd16,
+  bcd32, hex, string (count is the number of registers)`
+
+// registerTypes are the number of registers of each value type.
+var registerTypes = map[string]int{
+	"uint16": 1, "int16": 1, "hex": 1, "bcd16": 1,
+	"uint32": 2, "int32": 2, "float32": 2, "bcd32": 2,
+	"uint64": 4, "int64": 4, "float64": 4,
+	"string": 1,
+}
+
+// readFunctions are the read function codes of the tables.
+var readFunctions = map[mbserver.Table]uint8{
+	mbserver.CoilTable:            1,
+	mbserver.DiscreteInputTable:   2,
+	mbserver.HoldingRegisterTable: 3,
+	mbserver.InputRegisterTable:   4,
+}
+
+var errQuit = errors.New("quit")
+
+// session runs commands with a client and prints their results.
+type session struct {
+	client     *mbserver.Client
+	order      mbserver.WordOrder
+	hex        bool
+	output     io.Writer
+	interrupts chan os.Signal
+}
+
+// send sends a request and returns the response data.
+func (s *session) send(function uint8, data []byte) ([]byte, error) {
+	response, err := s.client.Send(s.client.NewFrame(function, data))
+	if exception, ok := err.(mbserver.Exception); ok {
+		return nil, fmt.Errorf("exception %d (%v)", uint8(exception), exception.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return response.GetData(), nil
+}
+
+// trace dumps the bytes written and read by the client when hex is on,
+// including partial and malformed responses.
+func (s *session) trace(sent []byte, received []byte) {
+	if !s.hex {
+		return
+	}
+	fmt.Fprintf(s.output, "> % X\n", sent)
+	if len(received) > 0 {
+		fmt.Fprintf(s.output, "< % X\n", received)
+	}
+}
+
+// run runs the commands read from r until the end or quit. Errors of
+// interactive commands are printed, errors of scripts end them.
+func (s *session) run(r io.Reader, interactive bool) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; ; line++ {
+		if interactive {
+			fmt.Fprint(s.output, "mbcli> ")
+		}
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+		err := s.execute(scanner.Text())
+		if err == errQuit {
+			return nil
+		}
+		if err != nil {
+			if !interactive {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+			fmt.Fprintln(s.output, "error:", err)
+		}
+	}
+}
+
+// execute runs one command line. Empty lines and comments are ignored.
+func (s *session) execute(line string) error {
+	args, err := splitLine(line)
+	if err != nil {
+		return err
+	}
+	return s.command(args)
+}
+
+// command runs the command of the arguments.
+func (s *session) command(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	switch args[0] {
+	case "read":
+		return s.read(args[1:])
+	case "write":
+		return s.write(args[1:])
+	case "raw":
+		return s.raw(args[1:])
+	case "poll":
+		return s.poll(args[1:])
+	case "sleep":
+		if len(args) != 2 {
+			return errors.New("usage: sleep <duration>")
+		}
+		d, err := time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		time.Sleep(d)
+		return nil
+	case "unit":
+		if len(args) != 2 {
+			return errors.New("usage: unit <id>")
+		}
+		id, err := strconv.ParseUint(args[1], 0, 8)
+		if err != nil {
+			return fmt.Errorf("invalid unit ID %q", args[1])
+		}
+		s.client.UnitID = uint8(id)
+		return nil
+	case "order":
+		if len(args) != 2 {
+			return errors.New("usage: order <ABCD|CDAB|BADC|DCBA>")
+		}
+		order, err := mbserver.ParseWordOrder(args[1])
+		if err != nil {
+			return err
+		}
+		s.order = order
+		return nil
+	case "hex":
+		if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+			return errors.New("usage: hex <on|off>")
+		}
+		s.hex = args[1] == "on"
+		return nil
+	case "help":
+		fmt.Fprintln(s.output, usage)
+		return nil
+	case "quit", "exit":
+		return errQuit
+	}
+	return fmt.Errorf("unknown command %q, type help for the commands", args[0])
+}
+
+// splitLine splits a command line into arguments. Double quotes group
+// words, including spaces and #, into one argument. A # starting an argument
+// outside quotes starts a comment, which runs to the end of the line.
+func splitLine(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg, quoted := false, false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted, inArg = !quoted, true
+		case quoted:
+			arg.WriteRune(r)
+		case r == '#' && !inArg:
+			return args, nil
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+func isBitTable(table mbserver.Table) bool {
+	return table == mbserver.CoilTable || table == mbserver.DiscreteInputTable
+}
+
+func parseAddress(value string) (uint16, error) {
+	address, err := strconv.ParseUint(value, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address %q", value)
+	}
+	return uint16(address), nil
+}
+
+// readTable reads quantity bits or registers in requests of the maximum size.
+func (s *session) readTable(table mbserver.Table, address uint16, quantity int) ([]uint16, error) {
+	max := 125
+	if isBitTable(table) {
+		max = 2000
+	}
+	values := make([]uint16, 0, quantity)
+	for len(values) < quantity {
+		n := quantity - len(values)
+		if n > max {
+			n = max
+		}
+		request := make([]byte, 4)
+		binary.BigEndian.PutUint16(request, address+uint16(len(values)))
+		binary.BigEndian.PutUint16(request[2:], uint16(n))
+		data, err := s.send(readFunctions[table], request)
+		if err != nil {
+			return nil, err
+		}
+		if isBitTable(table) {
+			if len(data) < 1+(n+7)/8 {
+				return nil, fmt.Errorf("short response % X", data)
+			}
+			for i := 0; i < n; i++ {
+				values = append(values, uint16(data[1+i/8]>>(uint(i)%8)&1))
+			}
+		} else {
+			if len(data) < 1+2*n {
+				return nil, fmt.Errorf("short response % X", data)
+			}
+			values = append(values, mbserver.BytesToUint16(data[1:1+2*n])...)
+		}
+	}
+	return values, nil
+}
+
+func (s *session) read(args []string) error {
+	if len(args) < 2 || len(args) > 4 {
+		return errors.New("usage: read <table> <address> [count] [type]")
+	}
+	table, err := mbserver.ParseTable(args[0])
+	if err != nil {
+		return err
+	}
+	address, err := parseAddress(args[1])
+	if err != nil {
+		return err
+	}
+	count := 1
+	if len(args) > 2 {
+		n, err := strconv.ParseUint(args[2], 0, 16)
+		if err != nil || n == 0 {
+			return fmt.Errorf("invalid count %q", args[2])
+		}
+		count = int(n)
+	}
+	kind := "uint16"
+	if len(args) > 3 {
+		kind = args[3]
+	}
+	size, ok := registerTypes[kind]
+	if !ok || isBitTable(table) && len(args) > 3 {
+		return fmt.Errorf("invalid type %q for %v", kind, table)
+	}
+
+	if isBitTable(table) {
+		values, err := s.readTable(table, address, count)
+		if err != nil {
+			return err
+		}
+		for i, value := range values {
+			fmt.Fprintf(s.output, "%d: %d\n", int(address)+i, value)
+		}
+		return nil
+	}
+
+	if kind == "string" {
+		registers, err := s.readTable(table, address, count)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(s.output, "%d: %q\n", address, mbserver.NewRegisterView(registers, s.order).String(0, count))
+		return nil
+	}
+	registers, err := s.readTable(table, address, count*size)
+	if err != nil {
+		return err
+	}
+	view := mbserver.NewRegisterView(registers, s.order)
+	for i := 0; i < count; i++ {
+		value, err := decode(registers, view, uint16(i*size), kind)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(s.output, "%d: %s\n", int(address)+i*size, value)
+	}
+	return nil
+}
+
+// decode formats the value of the type at the address of the registers.
+func decode(registers []uint16, v *mbserver.RegisterView, address uint16, kind string) (string, error) {
+	switch kind {
+	case "uint16":
+		return strconv.FormatUint(uint64(registers[address]), 10), nil
+	case "int16":
+		return strconv.FormatInt(int64(int16(registers[address])), 10), nil
+	case "hex":
+		return fmt.Sprintf("0x%04X", registers[address]), nil
+	case "uint32":
+		return strconv.FormatUint(uint64(v.Uint32(address)), 10), nil
+	case "int32":
+		return strconv.FormatInt(int64(v.Int32(address)), 10), nil
+	case "uint64":
+		return strconv.FormatUint(v.Uint64(address), 10), nil
+	case "int64":
+		return strconv.FormatInt(v.Int64(address), 10), nil
+	case "float32":
+		return strconv.FormatFloat(float64(v.Float32(address)), 'g', -1, 32), nil
+	case "float64":
+		return strconv.FormatFloat(v.Float64(address), 'g', -1, 64), nil
+	case "bcd16":
+		value, err := v.BCD16(address)
+		return strconv.FormatUint(uint64(value), 10), err
+	case "bcd32":
+		value, err := v.BCD32(address)
+		return strconv.FormatUint(uint64(value), 10), err
+	}
+	return "", fmt.Errorf("unknown type %q", kind)
+}
+
+// encode stores the text value of the type at the address of the registers.
+func encode(registers []uint16, v *mbserver.RegisterView, address uint16, kind string, text string) error {
+	bits := 16 * registerTypes[kind]
+	switch kind {
+	case "int16", "int32", "int64":
+		n, err := strconv.ParseInt(text, 0, bits)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", kind, text)
+		}
+		switch kind {
+		case "int16":
+			registers[address] = uint16(n)
+		case "int32":
+			v.SetInt32(address, int32(n))
+		default:
+			v.SetInt64(address, n)
+		}
+		return nil
+	case "float32", "float64":
+		f, err := strconv.ParseFloat(text, bits)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", kind, text)
+		}
+		if kind == "float32" {
+			v.SetFloat32(address, float32(f))
+		} else {
+			v.SetFloat64(address, f)
+		}
+		return nil
+	}
+
+	n, err := strconv.ParseUint(text, 0, bits)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", kind, text)
+	}
+	switch kind {
+	case "uint16", "hex":
+		registers[address] = uint16(n)
+	case "uint32":
+		v.SetUint32(address, uint32(n))
+	case "uint64":
+		v.SetUint64(address, n)
+	case "bcd16":
+		return v.SetBCD16(address, uint16(n))
+	case "bcd32":
+		return v.SetBCD32(address, uint32(n))
+	default:
+		return fmt.Errorf("unknown type %q", kind)
+	}
+	return nil
+}
+
+func parseBit(text string) (uint16, error) {
+	on, err := strconv.ParseBool(text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bit %q", text)
+	}
+	if on {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (s *session) write(args []string) error {
+	if len(args) < 3 {
+		return errors.New("usage: write <table> <address> [type] <values...>")
+	}
+	table, err := mbserver.ParseTable(args[0])
+	if err != nil {
+		return err
+	}
+	address, err := parseAddress(args[1])
+	if err != nil {
+		return err
+	}
+	values := args[2:]
+
+	if table == mbserver.CoilTable {
+		bits := make([]uint16, len(values))
+		for i, value := range values {
+			if bits[i], err = parseBit(value); err != nil {
+				return err
+			}
+		}
+		if len(bits) == 1 {
+			return s.writeSingle(5, address, 0xFF00*bits[0])
+		}
+		return s.writeMultiple(15, address, bits)
+	}
+	if table != mbserver.HoldingRegisterTable {
+		return fmt.Errorf("%v cannot be written", table)
+	}
+
+	kind := "uint16"
+	if _, ok := registerTypes[values[0]]; ok {
+		kind, values = values[0], values[1:]
+	}
+	if len(values) == 0 {
+		return errors.New("usage: write <table> <address> [type] <values...>")
+	}
+	var registers []uint16
+	if kind == "string" {
+		text := strings.Join(values, " ")
+		registers = make([]uint16, (len(text)+1)/2)
+		mbserver.NewRegisterView(registers, s.order).SetString(0, len(registers), text)
+	} else {
+		size := registerTypes[kind]
+		registers = make([]uint16, len(values)*size)
+		view := mbserver.NewRegisterView(registers, s.order)
+		for i, value := range values {
+			if err := encode(registers, view, uint16(i*size), kind, value); err != nil {
+				return err
+			}
+		}
+	}
+	if len(registers) == 1 {
+		return s.writeSingle(6, address, registers[0])
+	}
+	return s.writeMultiple(16, address, registers)
+}
+
+// writeSingle writes one coil or register and checks the echoed response.
+func (s *session) writeSingle(function uint8, address uint16, value uint16) error {
+	request := make([]byte, 4)
+	binary.BigEndian.PutUint16(request, address)
+	binary.BigEndian.PutUint16(request[2:], value)
+	response, err := s.send(function, request)
+	if err != nil {
+		return err
+	}
+	if string(response) != string(request) {
+		return fmt.Errorf("unexpected response % X", response)
+	}
+	fmt.Fprintln(s.output, "ok")
+	return nil
+}
+
+// writeMultiple writes coils or registers in requests of the maximum size.
+func (s *session) writeMultiple(function uint8, address uint16, values []uint16) error {
+	max := 123
+	if function == 15 {
+		max = 1968
+	}
+	for written := 0; written < len(values); {
+		chunk := values[written:]
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		request := make([]byte, 5)
+		binary.BigEndian.PutUint16(request, address+uint16(written))
+		binary.BigEndian.PutUint16(request[2:], uint16(len(chunk)))
+		if function == 15 {
+			packed := make([]byte, (len(chunk)+7)/8)
+			for i, value := range chunk {
+				packed[i/8] |= byte(value) << (uint(i) % 8)
+			}
+			request = append(request, packed...)
+		} else {
+			request = append(request, mbserver.Uint16ToBytes(chunk)...)
+		}
+		request[4] = byte(len(request) - 5)
+		response, err := s.send(function, request)
+		if err != nil {
+			return err
+		}
+		if len(response) < 4 || string(response[:4]) != string(request[:4]) {
+			return fmt.Errorf("unexpected response % X", response)
+		}
+		written += len(chunk)
+	}
+	fmt.Fprintln(s.output, "ok")
+	return nil
+}
+
+func (s *session) raw(args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: raw <function> [hex data]")
+	}
+	function, err := strconv.ParseUint(args[0], 0, 8)
+	if err != nil {
+		return fmt.Errorf("invalid function %q", args[0])
+	}
+	data, err := hex.DecodeString(strings.Join(args[1:], ""))
+	if err != nil {
+		return fmt.Errorf("invalid data: %v", err)
+	}
+	response, err := s.send(uint8(function), data)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.output, "% X\n", response)
+	return nil
+}
+
+func (s *session) poll(args []string) error {
+	if len(args) < 3 {
+		return errors.New("usage: poll <interval> <count> <command...>")
+	}
+	interval, err := time.ParseDuration(args[0])
+	if err != nil || interval <= 0 {
+		return fmt.Errorf("invalid interval %q", args[0])
+	}
+	count, err := strconv.Atoi(args[1])
+	if err != nil || count < 0 {
+		return fmt.Errorf("invalid count %q", args[1])
+	}
+	command := args[2:]
+	if command[0] == "poll" {
+		return errors.New("poll cannot poll")
+	}
+
+	// An interrupt ends the poll rather than the program.
+	signal.Notify(s.interrupts, os.Interrupt)
+	defer signal.Stop(s.interrupts)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := 0; count == 0 || i < count; i++ {
+		if i > 0 {
+			select {
+			case <-ticker.C:
+			case <-s.interrupts:
+				return nil
+			}
+		}
+		fmt.Fprintf(s.output, "-- %s\n", time.Now().Format("15:04:05.000"))
+		if err := s.command(command); err != nil {
+			// Keep polling through timeouts and exceptions.
+			fmt.Fprintln(s.output, "error:", err)
+		}
+	}
+	return nil
+}
+
+// newClient creates a client for the one transport given.
+func newClient(tcp, rtu, ascii string, config *serial.Config) (*mbserver.Client, error) {
+	switch {
+	case tcp != "" && rtu == "" && ascii == "":
+		return mbserver.NewTCPClient(tcp), nil
+	case rtu != "" && tcp == "" && ascii == "":
+		config.Address = rtu
+		return mbserver.NewRTUClient(config), nil
+	case ascii != "" && tcp == "" && rtu == "":
+		config.Address = ascii
+		return mbserver.NewASCIIClient(config), nil
+	}
+	return nil, errors.New("expected one of -tcp, -rtu and -ascii")
+}
+
+func run(args []string, stdin io.Reader, output io.Writer) error {
+	flags := flag.NewFlagSet("mbcli", flag.ContinueOnError)
+	flags.SetOutput(output)
+	tcp := flags.String("tcp", "", "connect to the Modbus TCP server at `address:port`")
+	rtu := flags.String("rtu", "", "use Modbus RTU on the serial `device`")
+	ascii := flags.String("ascii", "", "use Modbus ASCII on the serial `device`")
+	baud := flags.Int("baud", 19200, "serial baud rate")
+	dataBits := flags.Int("databits", 8, "serial data bits")
+	parity := flags.String("parity", "E", "serial parity: N, E or O")
+	stopBits := flags.Int("stopbits", 1, "serial stop bits")
+	unit := flags.Uint("unit", 1, "unit `ID`")
+	timeout := flags.Duration("timeout", time.Second, "response timeout")
+	retries := flags.Int("retries", 0, "resends after timeouts")
+	order := flags.String("order", "ABCD", "word `order` of typed values: ABCD, CDAB, BADC or DCBA")
+	dump := flags.Bool("hex", false, "dump raw frames")
+	script := flags.String("script", "", "run the commands of the `file`")
+	flags.Usage = func() {
+		fmt.Fprintln(output, "usage: mbcli [flags] [command]")
+		flags.PrintDefaults()
+		fmt.Fprintln(output, usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *unit > 255 {
+		return fmt.Errorf("invalid unit ID %d", *unit)
+	}
+	wordOrder, err := mbserver.ParseWordOrder(*order)
+	if err != nil {
+		return err
+	}
+	client, err := newClient(*tcp, *rtu, *ascii, &serial.Config{
+		BaudRate: *baud,
+		DataBits: *dataBits,
+		StopBits: *stopBits,
+		Parity:   strings.ToUpper(*parity),
+		Timeout:  *timeout,
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	client.UnitID = uint8(*unit)
+	client.Timeout = *timeout
+	client.Retries = *retries
+
+	s := &session{client: client, order: wordOrder, hex: *dump, output: output, interrupts: make(chan os.Signal, 1)}
+	client.Trace = s.trace
+
+	switch {
+	case flags.NArg() > 0:
+		err := s.command(flags.Args())
+		if err == errQuit {
+			return nil
+		}
+		return err
+	case *script != "":
+		f, err := os.Open(*script)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return s.run(f, false)
+	}
+	return s.run(stdin, true)
+}
+
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mbcli:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tbrandon/mbserver"
+)
+
+func testServer(t *testing.T) (*mbserver.Server, string) {
+	listen, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := listen.Addr().String()
+	listen.Close()
+	s := mbserver.NewServer()
+	if err := s.ListenTCP(address); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	return s, address
+}
+
+func TestCommands(t *testing.T) {
+	s, address := testServer(t)
+	defer s.Close()
+
+	input := strings.NewReader(`
+write hr 100 float32 1.5 -2
+write hr 200 7
+write hr 300 string hello
+write hr 400 string "a # b" # the value keeps its #
+#write hr 200 8
+write c 10 1 0 1
+read hr 100 2 float32 # a comment
+order CDAB
+read hr 100 1 float32
+read hr 200
+read hr 300 3 string
+read hr 400 3 string
+read c 10 3
+raw 3 0064 0002
+bogus
+read hr 65535 2
+quit
+read hr 200
+`)
+	var output bytes.Buffer
+	if err := run([]string{"-tcp", address}, input, &output); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []string{
+		"mbcli> ok", "ok", "ok", "ok",
+		"100: 1.5", "102: -2",
+		"100: 2.2869e-41", // the halves of 1.5 swapped
+		"200: 7",
+		`300: "hello"`,
+		`400: "a # b"`,
+		"10: 1", "11: 0", "12: 1",
+		"04 3F C0 00 00",
+		`error: unknown command "bogus", type help for the commands`,
+		"error: exception 2 (IllegalDataAddress)",
+	}
+	got := output.String()
+	for _, line := range expect {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("expected %q in the output, got\n%s", line, got)
+		}
+	}
+	if strings.Count(got, "200: 7") != 1 {
+		t.Errorf("expected the commands after quit to be ignored")
+	}
+	if s.HoldingRegisters[100] != 0x3FC0 || s.Coils[12] != 1 {
+		t.Errorf("expected the values to be written")
+	}
+}
+
+func TestScript(t *testing.T) {
+	s, address := testServer(t)
+	defer s.Close()
+	s.InputRegisters[5] = 0xFFFF
+
+	script := filepath.Join(t.TempDir(), "script.txt")
+	os.WriteFile(script, []byte("unit 2\nhex on\nread ir 5 1 int16\npoll 1ms 2 read ir 5\nread ir 65535 2\nread ir 0\n"), 0644)
+	var output bytes.Buffer
+	err := run([]string{"-tcp", address, "-script", script}, nil, &output)
+	if err == nil || err.Error() != "line 5: exception 2 (IllegalDataAddress)" {
+		t.Errorf("expected the error of line 5, got %v", err)
+	}
+	got := output.String()
+	for _, line := range []string{"> 00 01 00 00 00 06 02 04 00 05 00 01", "< 00 01 00 00 00 05 02 04 02 FF FF", "5: -1"} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("expected %q in the output, got\n%s", line, got)
+		}
+	}
+	if strings.Count(got, "5: 65535") != 2 || strings.Count(got, "-- ") != 2 {
+		t.Errorf("expected two polls, got\n%s", got)
+	}
+}
+
+func TestSingleCommand(t *testing.T) {
+	s, address := testServer(t)
+	defer s.Close()
+
+	var output bytes.Buffer
+	if err := run([]string{"-tcp", address, "write", "hr", "40", "uint32", "123456"}, nil, &output); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if s.HoldingRegisters[40] != 1 || s.HoldingRegisters[41] != 57920 {
+		t.Errorf("expected %v, got %v", []uint16{1, 57920}, s.HoldingRegisters[40:42])
+	}
+	if err := run([]string{"write", "hr", "40", "1"}, nil, &output); err == nil {
+		t.Errorf("expected an error without a transport, got nil")
+	}
+}
+
+func TestSplitLine(t *testing.T) {
+	tests := map[string][]string{
+		"":                               nil,
+		"# comment":                      nil,
+		"read hr 1 # comment":            {"read", "hr", "1"},
+		`write hr 1 string "a # b"  # c`: {"write", "hr", "1", "string", "a # b"},
+		"write hr 1 string a#b":          {"write", "hr", "1", "string", "a#b"},
+		`write hr 1 string ""`:           {"write", "hr", "1", "string", ""},
+	}
+	for line, expect := range tests {
+		args, err := splitLine(line)
+		if err != nil {
+			t.Errorf("%q: expected nil, got %v", line, err)
+		}
+		if !reflect.DeepEqual(expect, args) {
+			t.Errorf("%q: expected %q, got %q", line, expect, args)
+		}
+	}
+	if _, err := splitLine(`write hr 1 string "a`); err == nil || err.Error() != "unterminated quote" {
+		t.Errorf("expected unterminated quote, got %v", err)
+	}
+}
+
+func TestHexDumpTimeout(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer listen.Close()
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Read(make([]byte, 512))
+		// A header without the rest of the response.
+		conn.Write([]byte{0, 1, 0, 0, 0, 5, 1})
+		time.Sleep(time.Second)
+	}()
+
+	var output bytes.Buffer
+	err = run([]string{"-tcp", listen.Addr().String(), "-hex", "-timeout", "100ms", "read", "hr", "0"}, nil, &output)
+	if err != mbserver.ErrTimeout {
+		t.Errorf("expected %v, got %v", mbserver.ErrTimeout, err)
+	}
+	expect := "> 00 01 00 00 00 06 01 03 00 00 00 01\n< 00 01 00 00 00 05 01\n"
+	if output.String() != expect {
+		t.Errorf("expected %q, got %q", expect, output.String())
+	}
+}
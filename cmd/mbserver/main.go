@@ -0,0 +1,385 @@
+// Command mbserver runs a Modbus server (slave) simulator until it receives
+// SIGINT or SIGTERM.
+//
+// Listeners, unit IDs and initial values are set with flags or a device
+// profile:
+//
+//	mbserver -tcp :1502 -unit-ids 1,2 -set holding_registers:100=1,2,3
+//	mbserver -profile boiler.yaml -tcp :502 -rtu /dev/ttyUSB0 -baud 9600 -parity N
+//	mbserver -rtu /dev/pts/3 -baud 9600 -line-timing -processing-time 20ms
+//	mbserver -tcp :1502 -fault "exception:6 unit=1 every=5" -fault "delay:2s probability=0.1"
+//	mbserver -tls :802 -cert server.pem -key server.key -client-ca ca.pem -metrics :9100
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/goburrow/serial"
+	"github.com/tbrandon/mbserver"
+)
+
+// serialTimeout bounds serial port reads so that the server can be closed.
+const serialTimeout = 500 * time.Millisecond
+
+// listFlag is a flag which may be repeated.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+type config struct {
+	tcp, tls, udp, rtu, ascii listFlag
+	cert, key, clientCA       string
+	baud, dataBits, stopBits  int
+	parity                    string
+	lineTiming                bool
+	processingTime            time.Duration
+	profile                   string
+	unitIDs                   string
+	set                       listFlag
+	faults                    listFlag
+	logLevel, logFormat       string
+	debug                     bool
+	metrics, api              string
+}
+
+func parseFlags(args []string, output io.Writer) (*config, error) {
+	c := &config{}
+	flags := flag.NewFlagSet("mbserver", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.Var(&c.tcp, "tcp", "listen for Modbus TCP on `address:port`, repeatable")
+	flags.Var(&c.tls, "tls", "listen for Modbus TCP over TLS on `address:port`, repeatable")
+	flags.Var(&c.udp, "udp", "listen for Modbus TCP frames over UDP on `address:port`, repeatable")
+	flags.Var(&c.rtu, "rtu", "listen for Modbus RTU on the serial `device`, repeatable")
+	flags.Var(&c.ascii, "ascii", "listen for Modbus ASCII on the serial `device`, repeatable")
+	flags.StringVar(&c.cert, "cert", "", "TLS certificate `file`")
+	flags.StringVar(&c.key, "key", "", "TLS private key `file`")
+	flags.StringVar(&c.clientCA, "client-ca", "", "require TLS client certificates signed by the CA `file`")
+	flags.IntVar(&c.baud, "baud", 19200, "serial baud rate")
+	flags.IntVar(&c.dataBits, "databits", 8, "serial data bits")
+	flags.StringVar(&c.parity, "parity", "E", "serial parity: N, E or O")
+	flags.IntVar(&c.stopBits, "stopbits", 1, "serial stop bits")
+	flags.BoolVar(&c.lineTiming, "line-timing", false, "delay RTU responses like a serial line at the baud rate")
+	flags.DurationVar(&c.processingTime, "processing-time", 0, "device processing `time` added by -line-timing")
+	flags.StringVar(&c.profile, "profile", "", "device profile `file` (YAML or JSON), running its simulations and behaviors")
+	flags.StringVar(&c.unitIDs, "unit-ids", "", "answered unit `IDs`, such as 1,2,10-20, default all")
+	flags.Var(&c.set, "set", "initial `value`s, table:address=v1,v2,... or point=value, repeatable")
+	flags.Var(&c.faults, "fault", "inject a fault `rule`, such as \"delay:2s function=3 probability=0.5\", repeatable")
+	flags.StringVar(&c.logLevel, "log-level", "info", "log `level`: debug, info, warn or error")
+	flags.StringVar(&c.logFormat, "log-format", "text", "log `format`: text or json")
+	flags.BoolVar(&c.debug, "debug", false, "log hex dumps of frames")
+	flags.StringVar(&c.metrics, "metrics", "", "serve Prometheus metrics on `address:port`")
+	flags.StringVar(&c.api, "api", "", "serve the REST API on `address:port`")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	if len(c.tcp)+len(c.tls)+len(c.udp)+len(c.rtu)+len(c.ascii) == 0 {
+		c.tcp = listFlag{":1502"}
+	}
+	return c, nil
+}
+
+func newLogger(c *config, output io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.logLevel)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", c.logLevel)
+	}
+	if c.debug {
+		level = slog.LevelDebug
+	}
+	options := &slog.HandlerOptions{Level: level}
+	switch c.logFormat {
+	case "text":
+		return slog.New(slog.NewTextHandler(output, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(output, options)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q", c.logFormat)
+}
+
+// parseUnitIDs parses a list of unit IDs and ranges of unit IDs.
+func parseUnitIDs(list string) ([]uint8, error) {
+	var ids []uint8
+	for _, field := range strings.Split(list, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(field), "-")
+		if !isRange {
+			last = first
+		}
+		from, err1 := strconv.ParseUint(first, 10, 8)
+		to, err2 := strconv.ParseUint(last, 10, 8)
+		if err1 != nil || err2 != nil || from > to {
+			return nil, fmt.Errorf("invalid unit IDs %q", field)
+		}
+		for id := from; id <= to; id++ {
+			ids = append(ids, uint8(id))
+		}
+	}
+	return ids, nil
+}
+
+// seed stores the values of a -set flag.
+func seed(s *mbserver.Server, set string) error {
+	target, values, ok := strings.Cut(set, "=")
+	if !ok {
+		return fmt.Errorf("-set %q: expected table:address=values or point=value", set)
+	}
+
+	name, address, ok := strings.Cut(target, ":")
+	if !ok {
+		if s.Profile == nil || s.Profile.Point(target) == nil {
+			return fmt.Errorf("-set %q: unknown point %q", set, target)
+		}
+		point := s.Profile.Point(target)
+		var value interface{} = values
+		if point.Type != "string" {
+			value = json.Number(values)
+			if on, err := strconv.ParseBool(values); err == nil && point.Type == "bool" {
+				value = on
+			}
+		}
+		if err := point.Set(s, value); err != nil {
+			return fmt.Errorf("-set %q: %v", set, err)
+		}
+		return nil
+	}
+
+	table, err := mbserver.ParseTable(name)
+	if err != nil {
+		return fmt.Errorf("-set %q: %v", set, err)
+	}
+	first, err := strconv.ParseUint(address, 10, 16)
+	if err != nil {
+		return fmt.Errorf("-set %q: invalid address %q", set, address)
+	}
+	for i, field := range strings.Split(values, ",") {
+		value, err := strconv.ParseUint(strings.TrimSpace(field), 0, 16)
+		if err != nil || (table == mbserver.CoilTable || table == mbserver.DiscreteInputTable) && value > 1 {
+			return fmt.Errorf("-set %q: invalid value %q", set, field)
+		}
+		a := int(first) + i
+		if a > 65535 {
+			return fmt.Errorf("-set %q: values exceed the table", set)
+		}
+		switch table {
+		case mbserver.CoilTable:
+			s.Coils[a] = byte(value)
+		case mbserver.DiscreteInputTable:
+			s.DiscreteInputs[a] = byte(value)
+		case mbserver.HoldingRegisterTable:
+			s.HoldingRegisters[a] = uint16(value)
+		case mbserver.InputRegisterTable:
+			s.InputRegisters[a] = uint16(value)
+		}
+	}
+	return nil
+}
+
+// newServer creates the server from the profile, unit IDs and values of the
+// configuration, without listening.
+func newServer(c *config) (*mbserver.Server, error) {
+	var profile *mbserver.Profile
+	if c.profile != "" {
+		var err error
+		if profile, err = mbserver.LoadProfile(c.profile); err != nil {
+			return nil, err
+		}
+	}
+	if c.unitIDs != "" {
+		ids, err := parseUnitIDs(c.unitIDs)
+		if err != nil {
+			return nil, err
+		}
+		if profile == nil {
+			profile = &mbserver.Profile{}
+		}
+		profile.UnitIDs = ids
+	}
+
+	s := mbserver.NewServer()
+	if profile != nil {
+		if err := profile.Apply(s); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	for _, set := range c.set {
+		if err := seed(s, set); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	for _, text := range c.faults {
+		rule, err := mbserver.ParseFaultRule(text)
+		if err == nil {
+			if s.Faults == nil {
+				s.Faults = mbserver.NewFaults(0)
+			}
+			err = s.Faults.AddRule(rule)
+		}
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("-fault %q: %v", text, err)
+		}
+	}
+	if c.lineTiming {
+		s.LineTiming = &mbserver.LineTiming{ProcessingTime: c.processingTime}
+	}
+	if c.metrics != "" {
+		// Before the listeners start, which count into them.
+		s.Metrics = mbserver.NewMetrics()
+	}
+	return s, nil
+}
+
+func tlsConfig(c *config) (*tls.Config, error) {
+	if c.cert == "" || c.key == "" {
+		return nil, errors.New("-tls requires -cert and -key")
+	}
+	certificate, err := tls.LoadX509KeyPair(c.cert, c.key)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}}
+	if c.clientCA != "" {
+		pem, err := os.ReadFile(c.clientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", c.clientCA)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func serialConfig(c *config, device string) *serial.Config {
+	return &serial.Config{
+		Address:  device,
+		BaudRate: c.baud,
+		DataBits: c.dataBits,
+		StopBits: c.stopBits,
+		Parity:   strings.ToUpper(c.parity),
+		Timeout:  serialTimeout,
+	}
+}
+
+// listen starts all listeners of the configuration.
+func listen(s *mbserver.Server, c *config) error {
+	for _, address := range c.tcp {
+		if err := s.ListenTCP(address); err != nil {
+			return err
+		}
+	}
+	if len(c.tls) > 0 {
+		config, err := tlsConfig(c)
+		if err != nil {
+			return err
+		}
+		for _, address := range c.tls {
+			if err := s.ListenTLS(address, config); err != nil {
+				return err
+			}
+		}
+	}
+	for _, address := range c.udp {
+		if err := s.ListenUDP(address); err != nil {
+			return err
+		}
+	}
+	for _, device := range c.rtu {
+		if err := s.ListenRTU(serialConfig(c, device)); err != nil {
+			return err
+		}
+	}
+	for _, device := range c.ascii {
+		if err := s.ListenASCII(serialConfig(c, device)); err != nil {
+			return err
+		}
+	}
+	if c.metrics != "" {
+		if err := s.ListenMetrics(c.metrics); err != nil {
+			return err
+		}
+	}
+	if c.api != "" {
+		if err := s.ListenAPI(c.api); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func run(ctx context.Context, args []string, output io.Writer) error {
+	c, err := parseFlags(args, output)
+	if err != nil {
+		return err
+	}
+	logger, err := newLogger(c, output)
+	if err != nil {
+		return err
+	}
+	s, err := newServer(c)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.Logger = logger
+	s.Debug = c.debug
+	if err := listen(s, c); err != nil {
+		return err
+	}
+	if s.Profile != nil && len(s.Profile.Simulations) > 0 {
+		if err := s.Simulate(s.Profile.Simulations...); err != nil {
+			return err
+		}
+	}
+	if s.Profile != nil && len(s.Profile.Behaviors) > 0 {
+		if err := s.Behave(s.Profile.Behaviors...); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("server started")
+	<-ctx.Done()
+	logger.Info("shutting down")
+	return nil
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := run(ctx, os.Args[1:], os.Stderr)
+	stop()
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mbserver:", err)
+		os.Exit(1)
+	}
+}
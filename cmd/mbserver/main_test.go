@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tbrandon/mbserver"
+)
+
+func TestParseUnitIDs(t *testing.T) {
+	ids, err := parseUnitIDs("1, 5-7,255")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []uint8{1, 5, 6, 7, 255}
+	if !bytes.Equal(expect, ids) {
+		t.Errorf("expected %v, got %v", expect, ids)
+	}
+	for _, list := range []string{"", "7-5", "256", "a"} {
+		if _, err := parseUnitIDs(list); err == nil {
+			t.Errorf("expected error for %q, got nil", list)
+		}
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	profile := filepath.Join(t.TempDir(), "device.yaml")
+	os.WriteFile(profile, []byte("points:\n  - {name: flow, table: input_registers, address: 10, type: float32}\n"), 0644)
+	c, err := parseFlags([]string{"-profile", profile, "-unit-ids", "3",
+		"-set", "holding_registers:100=1,0x10", "-set", "c:7=1", "-set", "flow=2.5"}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s, err := newServer(c)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer s.Close()
+	if s.HoldingRegisters[100] != 1 || s.HoldingRegisters[101] != 16 || s.Coils[7] != 1 {
+		t.Errorf("expected the values to be set")
+	}
+	if s.InputRegisters[10] != 0x4020 {
+		t.Errorf("expected 0x4020, got %#x", s.InputRegisters[10])
+	}
+	if s.Profile.UnitIDs[0] != 3 {
+		t.Errorf("expected unit ID 3, got %v", s.Profile.UnitIDs)
+	}
+
+	for _, set := range []string{"coils:1=2", "registers:1=1", "level=1", "flow"} {
+		c.set = listFlag{set}
+		if _, err := newServer(c); err == nil {
+			t.Errorf("expected error for %q, got nil", set)
+		}
+	}
+
+	c.set = nil
+	c.faults = listFlag{"drop unit=1"}
+	c.lineTiming, c.processingTime = true, 20*time.Millisecond
+	c.metrics = "127.0.0.1:0"
+	s, err = newServer(c)
+	if err != nil || s.Faults == nil {
+		t.Fatalf("expected faults, got %v", err)
+	}
+	if s.Metrics == nil {
+		t.Errorf("expected metrics before the listeners start")
+	}
+	if s.LineTiming == nil || s.LineTiming.ProcessingTime != 20*time.Millisecond {
+		t.Errorf("expected a processing time of 20ms, got %+v", s.LineTiming)
+	}
+	s.Close()
+	c.faults = listFlag{"drop unit=x"}
+	if _, err := newServer(c); err == nil || err.Error() != `-fault "drop unit=x": invalid unit "x"` {
+		t.Errorf("expected an invalid fault, got %v", err)
+	}
+}
+
+// syncBuffer is a buffer safe for concurrent use.
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func TestRun(t *testing.T) {
+	listen, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := listen.Addr().String()
+	listen.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	var output syncBuffer
+	go func() {
+		done <- run(ctx, []string{"-tcp", address, "-set", "holding_registers:0=42", "-log-format", "json"}, &output)
+	}()
+
+	var registers []uint16
+	var err error
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		client := mbserver.NewTCPClient(address)
+		registers, err = client.ReadHoldingRegisters(0, 1)
+		client.Close()
+		if err == nil {
+			break
+		}
+	}
+	if err != nil || registers[0] != 42 {
+		t.Errorf("expected 42, got %v %v", registers, err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	if !strings.Contains(output.String(), `"msg":"shutting down"`) {
+		t.Errorf("expected the shutdown to be logged, got %s", output.String())
+	}
+}
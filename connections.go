@@ -0,0 +1,128 @@
+package mbserver
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// tcpConn is a TCP connection tracked by the server for connection limits.
+type tcpConn struct {
+	net.Conn
+	ip       string
+	opened   time.Time
+	lastSeen time.Time
+}
+
+// ConnectionInfo describes an open TCP connection.
+type ConnectionInfo struct {
+	Remote   string    `json:"remote"`
+	Local    string    `json:"local"`
+	Opened   time.Time `json:"opened"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// addConn tracks a new connection, applying the MaxConnections and
+// MaxConnectionsPerIP limits. When a limit is reached and EvictOldestIdle is
+// set, the longest idle connection is closed to make room; otherwise the new
+// connection is rejected and ok is false.
+func (s *Server) addConn(conn net.Conn) (c *tcpConn, ok bool) {
+	now := time.Now()
+	c = &tcpConn{Conn: conn, ip: remoteIP(conn), opened: now, lastSeen: now}
+
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+
+	if s.MaxConnectionsPerIP > 0 && s.countConns(c.ip) >= s.MaxConnectionsPerIP {
+		if !s.EvictOldestIdle || !s.evictOldest(c.ip) {
+			return nil, false
+		}
+	}
+	if s.MaxConnections > 0 && len(s.conns) >= s.MaxConnections {
+		if !s.EvictOldestIdle || !s.evictOldest("") {
+			return nil, false
+		}
+	}
+
+	s.conns[c] = struct{}{}
+	s.Metrics.setActiveConnections(len(s.conns))
+	return c, true
+}
+
+// removeConn stops tracking the connection.
+func (s *Server) removeConn(c *tcpConn) {
+	s.connsMutex.Lock()
+	delete(s.conns, c)
+	s.Metrics.setActiveConnections(len(s.conns))
+	s.connsMutex.Unlock()
+}
+
+// touchConn records activity on the connection.
+func (s *Server) touchConn(c *tcpConn) {
+	s.connsMutex.Lock()
+	c.lastSeen = time.Now()
+	s.connsMutex.Unlock()
+}
+
+// closeConns closes all tracked connections.
+func (s *Server) closeConns() {
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+	for c := range s.conns {
+		c.Close()
+		delete(s.conns, c)
+	}
+	s.Metrics.setActiveConnections(0)
+}
+
+// Connections returns the open TCP connections, oldest first.
+func (s *Server) Connections() []ConnectionInfo {
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+	connections := make([]ConnectionInfo, 0, len(s.conns))
+	for c := range s.conns {
+		connections = append(connections, ConnectionInfo{c.RemoteAddr().String(), c.LocalAddr().String(), c.opened, c.lastSeen})
+	}
+	sort.Slice(connections, func(i, j int) bool { return connections[i].Opened.Before(connections[j].Opened) })
+	return connections
+}
+
+// countConns returns the number of connections from ip. Must be called with
+// connsMutex held.
+func (s *Server) countConns(ip string) (count int) {
+	for c := range s.conns {
+		if c.ip == ip {
+			count++
+		}
+	}
+	return count
+}
+
+// evictOldest closes the longest idle connection, restricted to ip when it is
+// not empty. Must be called with connsMutex held.
+func (s *Server) evictOldest(ip string) bool {
+	var oldest *tcpConn
+	for c := range s.conns {
+		if ip != "" && c.ip != ip {
+			continue
+		}
+		if oldest == nil || c.lastSeen.Before(oldest.lastSeen) {
+			oldest = c
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	oldest.Close()
+	delete(s.conns, oldest)
+	return true
+}
+
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,103 @@
+package mbserver
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// isClosed reports whether the server side closed the connection.
+func isClosed(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+func TestMaxConnections(t *testing.T) {
+	s := NewServer()
+	s.MaxConnections = 1
+	addr := getFreePort()
+	err := s.ListenTCP(addr)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer first.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer second.Close()
+
+	if !isClosed(second) {
+		t.Errorf("expected second connection to be rejected")
+	}
+	if isClosed(first) {
+		t.Errorf("expected first connection to remain open")
+	}
+}
+
+func TestMaxConnectionsPerIPEvictOldestIdle(t *testing.T) {
+	s := NewServer()
+	s.MaxConnectionsPerIP = 1
+	s.EvictOldestIdle = true
+	addr := getFreePort()
+	err := s.ListenTCP(addr)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer first.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer second.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	if !isClosed(first) {
+		t.Errorf("expected first connection to be evicted")
+	}
+	if isClosed(second) {
+		t.Errorf("expected second connection to remain open")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := NewServer()
+	s.IdleTimeout = 20 * time.Millisecond
+	addr := getFreePort()
+	err := s.ListenTCP(addr)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+
+	time.Sleep(60 * time.Millisecond)
+	if !isClosed(conn) {
+		t.Errorf("expected idle connection to be closed")
+	}
+}
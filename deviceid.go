@@ -0,0 +1,76 @@
+package mbserver
+
+// DeviceIdentification holds the objects returned by Read Device
+// Identification, function 43 with MEI type 14. The basic objects are
+// mandatory, empty regular objects are not reported.
+type DeviceIdentification struct {
+	// Basic objects 0 to 2.
+	VendorName         string `json:"vendor_name" yaml:"vendor_name"`
+	ProductCode        string `json:"product_code" yaml:"product_code"`
+	MajorMinorRevision string `json:"revision" yaml:"revision"`
+	// Regular objects 3 to 6.
+	VendorURL           string `json:"vendor_url" yaml:"vendor_url"`
+	ProductName         string `json:"product_name" yaml:"product_name"`
+	ModelName           string `json:"model_name" yaml:"model_name"`
+	UserApplicationName string `json:"user_application_name" yaml:"user_application_name"`
+}
+
+// meiReadDeviceIdentification is the MEI type of Read Device Identification.
+const meiReadDeviceIdentification = 0x0E
+
+func (id *DeviceIdentification) objects() []string {
+	return []string{id.VendorName, id.ProductCode, id.MajorMinorRevision,
+		id.VendorURL, id.ProductName, id.ModelName, id.UserApplicationName}
+}
+
+// ReadDeviceIdentification function 43 MEI type 14, reads the server's
+// Identification objects by stream (basic or regular) or individually.
+func ReadDeviceIdentification(s *Server, frame Framer) ([]byte, *Exception) {
+	data := frame.GetData()
+	if s.Identification == nil || len(data) < 3 || data[0] != meiReadDeviceIdentification {
+		return []byte{}, &IllegalFunction
+	}
+	code, objectID := data[1], data[2]
+	objects := s.Identification.objects()
+
+	var last uint8
+	switch code {
+	case 1:
+		last = 2
+	case 2:
+		last = 6
+	case 4:
+		if int(objectID) >= len(objects) || objects[objectID] == "" && objectID > 2 {
+			return []byte{}, &IllegalDataAddress
+		}
+		last = objectID
+	default:
+		return []byte{}, &IllegalDataValue
+	}
+	if objectID > last {
+		objectID = 0
+	}
+
+	// MEI type, code, conformity level (regular, stream and individual
+	// access), more follows, next object ID and number of objects.
+	response := []byte{meiReadDeviceIdentification, code, 0x82, 0, 0, 0}
+	for id := objectID; id <= last; id++ {
+		value := objects[id]
+		if value == "" && id > 2 {
+			continue
+		}
+		if len(value) > 245 {
+			value = value[:245]
+		}
+		// The response data is limited to 252 bytes.
+		if len(response)+2+len(value) > 252 {
+			response[3] = 0xFF
+			response[4] = id
+			break
+		}
+		response = append(response, id, byte(len(value)))
+		response = append(response, value...)
+		response[5]++
+	}
+	return response, &Success
+}
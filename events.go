@@ -0,0 +1,250 @@
+package mbserver
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ChangeEvent describes a write to a range of a table, with the values
+// before and after the write: by a client to coils or holding registers, or
+// by the server's behaviors and simulations and the REST API to any table.
+// Bits are reported as 0 or 1. Writes which leave the values unchanged are
+// reported too.
+type ChangeEvent struct {
+	Time    time.Time
+	Table   Table
+	Address uint16
+	Old     []uint16
+	New     []uint16
+	// UnitID, Client (the IP address) and Identity (the TLS client
+	// certificate common name) identify the writer.
+	UnitID   uint8
+	Client   string
+	Identity string
+	// Source is "behavior <name>", "simulation <point>", "http" or "mqtt"
+	// for writes by behaviors, simulations, the REST API and MQTT bridges
+	// which are not Modbus requests, and empty for writes by Modbus clients.
+	Source string
+}
+
+// RequestEvent describes a request handled by the server. Address and
+// Quantity are set for functions accessing a range of a table.
+type RequestEvent struct {
+	Time      time.Time
+	Transport string
+	Listener  string
+	Client    string
+	Identity  string
+	UnitID    uint8
+	Function  uint8
+	Address   int
+	Quantity  int
+	Exception Exception
+	Duration  time.Duration
+	// Faults are the faults injected into the response, if any.
+	Faults []Fault
+}
+
+// Backpressure selects what happens to events when a subscriber's buffer is
+// full.
+type Backpressure int
+
+const (
+	// Block waits for the subscriber, holding up all requests meanwhile.
+	Block Backpressure = iota
+	// DropNewest discards the new event.
+	DropNewest
+	// DropOldest discards the oldest buffered event to make room for the new one.
+	DropOldest
+)
+
+// subscriber delivers events to a buffered channel according to its
+// backpressure.
+type subscriber[T any] struct {
+	c            chan T
+	backpressure Backpressure
+	done         chan struct{}
+	closeOnce    sync.Once
+	dropped      uint64
+}
+
+func newSubscriber[T any](buffer int, backpressure Backpressure) *subscriber[T] {
+	if backpressure != Block && buffer < 1 {
+		buffer = 1
+	}
+	return &subscriber[T]{c: make(chan T, buffer), backpressure: backpressure, done: make(chan struct{})}
+}
+
+// Dropped returns the number of events discarded because the buffer was full.
+func (sub *subscriber[T]) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+func (sub *subscriber[T]) send(event T) {
+	switch sub.backpressure {
+	case Block:
+		select {
+		case sub.c <- event:
+		case <-sub.done:
+		}
+	case DropNewest:
+		select {
+		case sub.c <- event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	case DropOldest:
+		for {
+			select {
+			case sub.c <- event:
+				return
+			default:
+			}
+			select {
+			case <-sub.c:
+				atomic.AddUint64(&sub.dropped, 1)
+			default:
+			}
+		}
+	}
+}
+
+// subscribers are the subscriptions to the events of a server.
+type subscribers struct {
+	mutex    sync.Mutex
+	changes  []*Subscription
+	requests []*RequestSubscription
+}
+
+// without returns the list without the element.
+func without[T comparable](list []T, element T) []T {
+	for i, other := range list {
+		if other == element {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+// Subscription receives the change events of a server on C.
+type Subscription struct {
+	C <-chan ChangeEvent
+	*subscriber[ChangeEvent]
+	server *Server
+}
+
+// Subscribe returns a subscription to the changes written by clients with
+// WriteSingleCoil, WriteHoldingRegister, WriteMultipleCoils and
+// WriteHoldingRegisters, and by behaviors, simulations and the REST API.
+// Direct writes of the application to the tables are not reported. Events
+// are buffered up to buffer events and then handled according to
+// backpressure; the drop modes buffer at least one event.
+func (s *Server) Subscribe(buffer int, backpressure Backpressure) *Subscription {
+	sub := newSubscriber[ChangeEvent](buffer, backpressure)
+	subscription := &Subscription{C: sub.c, subscriber: sub, server: s}
+	s.subscribers.mutex.Lock()
+	s.subscribers.changes = append(s.subscribers.changes, subscription)
+	s.subscribers.mutex.Unlock()
+	return subscription
+}
+
+// Close ends the subscription and closes C.
+func (sub *Subscription) Close() {
+	sub.closeOnce.Do(func() {
+		close(sub.done)
+		subscribers := &sub.server.subscribers
+		subscribers.mutex.Lock()
+		defer subscribers.mutex.Unlock()
+		subscribers.changes = without(subscribers.changes, sub)
+		close(sub.c)
+	})
+}
+
+// RequestSubscription receives the request events of a server on C.
+type RequestSubscription struct {
+	C <-chan RequestEvent
+	*subscriber[RequestEvent]
+	server *Server
+}
+
+// SubscribeRequests returns a subscription to all requests handled by the
+// server, including failed ones, buffered like the events of Subscribe.
+func (s *Server) SubscribeRequests(buffer int, backpressure Backpressure) *RequestSubscription {
+	sub := newSubscriber[RequestEvent](buffer, backpressure)
+	subscription := &RequestSubscription{C: sub.c, subscriber: sub, server: s}
+	s.subscribers.mutex.Lock()
+	s.subscribers.requests = append(s.subscribers.requests, subscription)
+	s.subscribers.mutex.Unlock()
+	return subscription
+}
+
+// Close ends the subscription and closes C.
+func (sub *RequestSubscription) Close() {
+	sub.closeOnce.Do(func() {
+		close(sub.done)
+		subscribers := &sub.server.subscribers
+		subscribers.mutex.Lock()
+		defer subscribers.mutex.Unlock()
+		subscribers.requests = without(subscribers.requests, sub)
+		close(sub.c)
+	})
+}
+
+// subscribed reports whether there are subscribers to change events.
+func (s *Server) subscribed() bool {
+	s.subscribers.mutex.Lock()
+	defer s.subscribers.mutex.Unlock()
+	return len(s.subscribers.changes) > 0
+}
+
+// publish sends the event to all subscribers.
+func (s *Server) publish(event ChangeEvent) {
+	s.subscribers.mutex.Lock()
+	defer s.subscribers.mutex.Unlock()
+	for _, sub := range s.subscribers.changes {
+		sub.send(event)
+	}
+}
+
+// publishRequest sends a request event for the request, handled from start
+// with the faults injected, to all subscribers.
+func (s *Server) publishRequest(request *Request, exception Exception, start time.Time, faults []Fault) {
+	s.subscribers.mutex.Lock()
+	defer s.subscribers.mutex.Unlock()
+	if len(s.subscribers.requests) == 0 {
+		return
+	}
+	event := RequestEvent{
+		Time:      start,
+		Transport: request.transport,
+		Listener:  request.listener,
+		Client:    request.client,
+		Identity:  request.identity,
+		UnitID:    getDevice(request.frame),
+		Function:  request.frame.GetFunction(),
+		Exception: exception,
+		Duration:  time.Since(start),
+		Faults:    faults,
+	}
+	event.Address, event.Quantity, _ = requestAddressRange(request.frame)
+	for _, sub := range s.subscribers.requests {
+		sub.send(event)
+	}
+}
+
+// writeRange returns the table and addresses written by the frame, ok is
+// false for other functions and out of range requests.
+func writeRange(frame Framer) (table Table, address int, number int, ok bool) {
+	switch frame.GetFunction() {
+	case 5, 6, 15, 16:
+	default:
+		return 0, 0, 0, false
+	}
+	table, _ = functionTable(frame.GetFunction())
+	address, number, ok = requestAddressRange(frame)
+	if !ok || address+number > 65536 {
+		return 0, 0, 0, false
+	}
+	return table, address, number, true
+}
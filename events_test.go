@@ -0,0 +1,94 @@
+package mbserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	sub := s.Subscribe(10, Block)
+
+	s.HoldingRegisters[101] = 5
+	var frame TCPFrame
+	frame.Device = 3
+	frame.Function = 16
+	SetDataWithRegisterAndNumberAndValues(&frame, 100, 2, []uint16{7, 8})
+	start := time.Now()
+	s.handle(&Request{frame: &frame, client: "10.0.0.1", identity: "hmi"})
+	s.handle(gatewayRequest(1, 5, 7, 0xFF00))
+	// Reads are not reported.
+	s.handle(gatewayRequest(1, 3, 100, 2))
+	s.handle(gatewayRequest(1, 6, 0, 1))
+
+	event := <-sub.C
+	if event.Table != HoldingRegisterTable || event.Address != 100 || event.UnitID != 3 ||
+		event.Client != "10.0.0.1" || event.Identity != "hmi" || event.Time.Before(start) {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if !isEqual([]uint16{0, 5}, event.Old) || !isEqual([]uint16{7, 8}, event.New) {
+		t.Errorf("expected %v -> %v, got %v -> %v", []uint16{0, 5}, []uint16{7, 8}, event.Old, event.New)
+	}
+	event = <-sub.C
+	if event.Table != CoilTable || event.Address != 7 || !isEqual([]uint16{0}, event.Old) || !isEqual([]uint16{1}, event.New) {
+		t.Errorf("unexpected event %+v", event)
+	}
+	event = <-sub.C
+	if event.Table != HoldingRegisterTable || event.Address != 0 {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	sub.Close()
+	if _, ok := <-sub.C; ok {
+		t.Errorf("expected a closed channel")
+	}
+	// Writes do not block after the subscription is closed.
+	s.handle(gatewayRequest(1, 6, 0, 2))
+}
+
+func TestSubscribeBackpressure(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	newest := s.Subscribe(1, DropNewest)
+	oldest := s.Subscribe(0, DropOldest)
+
+	for i := uint16(1); i <= 3; i++ {
+		s.handle(gatewayRequest(1, 6, 0, i))
+	}
+
+	if event := <-newest.C; event.New[0] != 1 {
+		t.Errorf("expected the first write, got %v", event.New)
+	}
+	if newest.Dropped() != 2 {
+		t.Errorf("expected 2, got %v", newest.Dropped())
+	}
+	if event := <-oldest.C; event.New[0] != 3 {
+		t.Errorf("expected the last write, got %v", event.New)
+	}
+	if oldest.Dropped() != 2 {
+		t.Errorf("expected 2, got %v", oldest.Dropped())
+	}
+}
+
+func TestSubscribeRequests(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	sub := s.SubscribeRequests(10, DropNewest)
+	defer sub.Close()
+
+	start := time.Now()
+	conn := &replayConn{response: make(chan []byte, 2)}
+	s.respond(&Request{conn: conn, frame: gatewayRequest(2, 3, 100, 4).frame, transport: "tcp", client: "10.0.0.1"})
+	s.respond(&Request{conn: conn, frame: gatewayRequest(2, 3, 65535, 4).frame, transport: "tcp", client: "10.0.0.1"})
+
+	event := <-sub.C
+	if event.UnitID != 2 || event.Function != 3 || event.Address != 100 || event.Quantity != 4 ||
+		event.Transport != "tcp" || event.Client != "10.0.0.1" || event.Exception != Success || event.Time.Before(start) {
+		t.Errorf("unexpected event %+v", event)
+	}
+	event = <-sub.C
+	if event.Exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", event.Exception)
+	}
+}
@@ -0,0 +1,294 @@
+package mbserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault is a misbehavior injected into the handling of a request.
+type Fault int
+
+const (
+	// FaultDelay delays the response by the rule's Delay, holding up the
+	// later responses of the same connection or serial port but not those of
+	// others.
+	FaultDelay Fault = iota + 1
+	// FaultDrop ignores the request without handling it.
+	FaultDrop
+	// FaultException responds with the rule's Exception without handling the request.
+	FaultException
+	// FaultCorruptCRC inverts the CRC of RTU responses.
+	FaultCorruptCRC
+	// FaultWrongTransactionID increments the transaction ID of TCP responses.
+	FaultWrongTransactionID
+	// FaultTruncate sends TCP responses without their last byte, so that the
+	// MBAP length exceeds the bytes sent.
+	FaultTruncate
+	// FaultClose closes the TCP connection without handling the request,
+	// dropping requests of other transports.
+	FaultClose
+)
+
+var faultNames = map[Fault]string{
+	FaultDelay:              "delay",
+	FaultDrop:               "drop",
+	FaultException:          "exception",
+	FaultCorruptCRC:         "corrupt_crc",
+	FaultWrongTransactionID: "wrong_transaction_id",
+	FaultTruncate:           "truncate",
+	FaultClose:              "close",
+}
+
+func (f Fault) String() string {
+	if name, ok := faultNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("Fault(%d)", int(f))
+}
+
+// FaultRule injects a fault into matching requests. Empty fields match any
+// request. A rule triggers on every matching request unless Every or
+// Probability is set.
+type FaultRule struct {
+	Fault Fault
+	// UnitIDs are the unit identifiers (slave addresses) the rule applies to.
+	UnitIDs []uint8
+	// Functions are the Modbus function codes the rule applies to.
+	Functions []uint8
+	// Addresses restricts the rule to requests touching any address in the range.
+	Addresses *AddressRange
+	// Every triggers the fault on every Nth matching request.
+	Every int
+	// Probability triggers the fault on a random fraction of matching
+	// requests, between 0 and 1.
+	Probability float64
+	// Delay is the delay of FaultDelay.
+	Delay time.Duration
+	// Exception is the exception of FaultException.
+	Exception Exception
+}
+
+type faultRule struct {
+	FaultRule
+	matched int
+}
+
+// Faults is a list of rules injecting faults into the requests of Modbus
+// clients, to test how masters handle misbehaving devices. Requests may
+// trigger several rules, such as a delay followed by a corrupt CRC; faults
+// which prevent the response, drops, exceptions and closes, end the
+// evaluation.
+type Faults struct {
+	mutex  sync.Mutex
+	rules  []*faultRule
+	random *rand.Rand
+}
+
+// NewFaults creates fault injection without rules. The seed of the
+// probabilistic triggers is taken from the time when zero.
+func NewFaults(seed int64) *Faults {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Faults{random: rand.New(rand.NewSource(seed))}
+}
+
+// AddRule appends a rule to the faults.
+func (f *Faults) AddRule(rule FaultRule) error {
+	if _, ok := faultNames[rule.Fault]; !ok {
+		return fmt.Errorf("unknown fault %v", rule.Fault)
+	}
+	if rule.Addresses != nil && rule.Addresses.First > rule.Addresses.Last {
+		return fmt.Errorf("fault address range %d-%d is empty", rule.Addresses.First, rule.Addresses.Last)
+	}
+	if rule.Every < 0 || rule.Probability < 0 || rule.Probability > 1 {
+		return errors.New("fault triggers must be positive and probabilities at most 1")
+	}
+	if rule.Every > 0 && rule.Probability > 0 {
+		return errors.New("fault triggers every and probability are exclusive")
+	}
+	if rule.Fault == FaultDelay && rule.Delay <= 0 {
+		return errors.New("fault delay requires a positive delay")
+	}
+	if rule.Fault == FaultException && rule.Exception == Success {
+		return errors.New("fault exception requires an exception")
+	}
+	f.mutex.Lock()
+	f.rules = append(f.rules, &faultRule{FaultRule: rule})
+	f.mutex.Unlock()
+	return nil
+}
+
+// ParseFaultRule parses a rule written as the fault, with its delay or
+// exception code after a colon, followed by conditions:
+//
+//	delay:2s function=3 probability=0.5
+//	exception:6 unit=2,3 address=100-199 every=3
+//	close every=10
+func ParseFaultRule(text string) (FaultRule, error) {
+	var rule FaultRule
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return rule, errors.New("empty fault rule")
+	}
+	name, arg, _ := strings.Cut(fields[0], ":")
+	for fault, faultName := range faultNames {
+		if faultName == name {
+			rule.Fault = fault
+		}
+	}
+	switch rule.Fault {
+	case 0:
+		return rule, fmt.Errorf("unknown fault %q", name)
+	case FaultDelay:
+		delay, err := time.ParseDuration(arg)
+		if err != nil {
+			return rule, fmt.Errorf("invalid delay %q", arg)
+		}
+		rule.Delay = delay
+	case FaultException:
+		code, err := strconv.ParseUint(arg, 10, 8)
+		if err != nil {
+			return rule, fmt.Errorf("invalid exception %q", arg)
+		}
+		rule.Exception = Exception(code)
+	default:
+		if arg != "" {
+			return rule, fmt.Errorf("fault %s takes no argument", name)
+		}
+	}
+
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		var err error
+		switch key {
+		case "unit":
+			rule.UnitIDs, err = parseUint8List(value)
+		case "function":
+			rule.Functions, err = parseUint8List(value)
+		case "address":
+			first, last, isRange := strings.Cut(value, "-")
+			if !isRange {
+				last = first
+			}
+			from, err1 := strconv.ParseUint(first, 10, 16)
+			to, err2 := strconv.ParseUint(last, 10, 16)
+			if err1 != nil || err2 != nil {
+				err = errors.New("invalid")
+			}
+			rule.Addresses = &AddressRange{uint16(from), uint16(to)}
+		case "every":
+			rule.Every, err = strconv.Atoi(value)
+		case "probability":
+			rule.Probability, err = strconv.ParseFloat(value, 64)
+		default:
+			return rule, fmt.Errorf("unknown fault condition %q", key)
+		}
+		if err != nil {
+			return rule, fmt.Errorf("invalid %s %q", key, value)
+		}
+	}
+	return rule, nil
+}
+
+func parseUint8List(list string) ([]uint8, error) {
+	var values []uint8
+	for _, field := range strings.Split(list, ",") {
+		value, err := strconv.ParseUint(field, 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, uint8(value))
+	}
+	return values, nil
+}
+
+// injection is the faults triggered by a request.
+type injection struct {
+	faults    []Fault
+	delay     time.Duration
+	exception *Exception
+}
+
+func (in *injection) has(fault Fault) bool {
+	for _, f := range in.faults {
+		if f == fault {
+			return true
+		}
+	}
+	return false
+}
+
+// inject returns the faults triggered by the request. Requests replayed or
+// made through the REST API are not faulted.
+func (f *Faults) inject(request *Request) *injection {
+	in := &injection{}
+	if f == nil {
+		return in
+	}
+	if _, ok := request.conn.(*replayConn); ok {
+		return in
+	}
+	unitID := getDevice(request.frame)
+	function := request.frame.GetFunction()
+	address, number, hasAddress := requestAddressRange(request.frame)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, rule := range f.rules {
+		if len(rule.UnitIDs) > 0 && !containsUint8(rule.UnitIDs, unitID) {
+			continue
+		}
+		if len(rule.Functions) > 0 && !containsUint8(rule.Functions, function) {
+			continue
+		}
+		if rule.Addresses != nil && (!hasAddress || !rule.Addresses.overlaps(address, number)) {
+			continue
+		}
+		rule.matched++
+		if rule.Every > 0 && rule.matched%rule.Every != 0 {
+			continue
+		}
+		if rule.Probability > 0 && f.random.Float64() >= rule.Probability {
+			continue
+		}
+
+		in.faults = append(in.faults, rule.Fault)
+		switch rule.Fault {
+		case FaultDelay:
+			in.delay += rule.Delay
+		case FaultException:
+			exception := rule.Exception
+			in.exception = &exception
+			return in
+		case FaultDrop, FaultClose:
+			return in
+		}
+	}
+	return in
+}
+
+// corrupt applies the faults altering the response packet.
+func (in *injection) corrupt(frame Framer, packet []byte) []byte {
+	switch frame.(type) {
+	case *RTUFrame:
+		if in.has(FaultCorruptCRC) && len(packet) >= 2 {
+			packet[len(packet)-2] ^= 0xFF
+			packet[len(packet)-1] ^= 0xFF
+		}
+	case *TCPFrame:
+		if in.has(FaultWrongTransactionID) && len(packet) >= 2 {
+			binary.BigEndian.PutUint16(packet, binary.BigEndian.Uint16(packet)+1)
+		}
+		if in.has(FaultTruncate) && len(packet) > 0 {
+			packet = packet[:len(packet)-1]
+		}
+	}
+	return packet
+}
@@ -0,0 +1,221 @@
+package mbserver
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// recordConn records the responses written to it.
+type recordConn struct {
+	bytes.Buffer
+}
+
+func (c *recordConn) Close() error {
+	return nil
+}
+
+func faultRequest(conn *recordConn, frame Framer) *Request {
+	return &Request{conn: conn, frame: frame, transport: "tcp"}
+}
+
+func TestFaults(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Faults = NewFaults(1)
+	rules := []string{
+		"exception:6 unit=2 every=2",
+		"drop function=6 address=100-199",
+		"wrong_transaction_id unit=3",
+		"truncate unit=3 function=4",
+		"delay:50ms unit=4",
+	}
+	for _, text := range rules {
+		rule, err := ParseFaultRule(text)
+		if err != nil {
+			t.Fatalf("%s: expected nil, got %v", text, err)
+		}
+		if err := s.Faults.AddRule(rule); err != nil {
+			t.Fatalf("%s: expected nil, got %v", text, err)
+		}
+	}
+
+	// Every second request of unit 2 fails.
+	for i, expect := range []Exception{Success, SlaveDeviceBusy, Success, SlaveDeviceBusy} {
+		conn := &recordConn{}
+		request := gatewayRequest(2, 3, 0, 1)
+		request.conn = conn
+		s.respond(request)
+		response, err := NewTCPFrame(conn.Bytes())
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		if exception := GetException(response); exception != expect {
+			t.Errorf("request %d: expected %v, got %v", i, expect.String(), exception.String())
+		}
+	}
+
+	// Dropped writes are not handled.
+	conn := &recordConn{}
+	request := gatewayRequest(1, 6, 150, 7)
+	request.conn = conn
+	s.respond(request)
+	if conn.Len() != 0 || s.HoldingRegisters[150] != 0 {
+		t.Errorf("expected the write to be dropped, got %v %v", conn.Bytes(), s.HoldingRegisters[150])
+	}
+	request = gatewayRequest(1, 6, 200, 7)
+	request.conn = conn
+	s.respond(request)
+	if conn.Len() != 12 || s.HoldingRegisters[200] != 7 {
+		t.Errorf("expected the write, got %v %v", conn.Bytes(), s.HoldingRegisters[200])
+	}
+
+	conn.Reset()
+	request = gatewayRequest(3, 3, 0, 1)
+	request.conn = conn
+	s.respond(request)
+	if response, _ := NewTCPFrame(conn.Bytes()); response == nil || response.TransactionIdentifier != 10 {
+		t.Errorf("expected transaction ID 10, got %v", conn.Bytes())
+	}
+	conn.Reset()
+	request = gatewayRequest(3, 4, 0, 1)
+	request.conn = conn
+	s.respond(request)
+	if conn.Len() != 10 {
+		t.Errorf("expected 10 bytes, got %v", conn.Bytes())
+	}
+
+	conn.Reset()
+	request = gatewayRequest(4, 3, 0, 1)
+	request.conn = conn
+	start := time.Now()
+	s.respond(request)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || conn.Len() != 11 {
+		t.Errorf("expected a delayed response, got %v after %v", conn.Bytes(), elapsed)
+	}
+}
+
+func TestFaultCorruptCRC(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Faults = NewFaults(0)
+	s.Faults.AddRule(FaultRule{Fault: FaultCorruptCRC})
+
+	frame := &RTUFrame{Address: 1, Function: 3}
+	SetDataWithRegisterAndNumber(frame, 0, 1)
+	conn := &recordConn{}
+	s.respond(&Request{conn: conn, frame: frame, transport: "rtu"})
+	if _, err := NewRTUFrame(conn.Bytes()); err == nil {
+		t.Errorf("expected a CRC error, got %v", conn.Bytes())
+	}
+}
+
+func TestFaultDelayPerConnection(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Faults = NewFaults(0)
+	s.Faults.AddRule(FaultRule{Fault: FaultDelay, Delay: 500 * time.Millisecond, UnitIDs: []uint8{4}})
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s.listeners = append(s.listeners, listen)
+	go s.accept(listen, "tcp", nil)
+
+	delayed := NewTCPClient(listen.Addr().String())
+	defer delayed.Close()
+	delayed.UnitID = 4
+	done := make(chan error, 1)
+	go func() {
+		_, err := delayed.ReadHoldingRegisters(0, 1)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	client := NewTCPClient(listen.Addr().String())
+	defer client.Close()
+	start := time.Now()
+	if _, err := client.ReadHoldingRegisters(0, 1); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("expected less than 250ms, got %v", elapsed)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
+
+func TestFaultDropRecorded(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Metrics = NewMetrics()
+	s.Faults = NewFaults(0)
+	s.Faults.AddRule(FaultRule{Fault: FaultDrop})
+	requests := s.SubscribeRequests(1, DropNewest)
+	defer requests.Close()
+
+	conn := &recordConn{}
+	s.respond(faultRequest(conn, gatewayRequest(1, 3, 0, 1).frame))
+	if conn.Len() != 0 {
+		t.Errorf("expected no response, got %v", conn.Bytes())
+	}
+	stats := s.Metrics.Stats()
+	if stats.Requests != 1 || stats.Faults["drop"] != 1 {
+		t.Errorf("expected 1 request and 1 drop, got %+v", stats)
+	}
+	select {
+	case event := <-requests.C:
+		if !isEqual([]Fault{FaultDrop}, event.Faults) {
+			t.Errorf("expected %v, got %v", []Fault{FaultDrop}, event.Faults)
+		}
+	default:
+		t.Errorf("expected a request event")
+	}
+}
+
+func TestFaultClose(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Faults = NewFaults(0)
+	s.Faults.AddRule(FaultRule{Fault: FaultClose, Probability: 1})
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s.listeners = append(s.listeners, listen)
+	go s.accept(listen, "tcp", nil)
+
+	client := NewTCPClient(listen.Addr().String())
+	defer client.Close()
+	if _, err := client.ReadHoldingRegisters(0, 1); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
+
+func TestFaultRuleErrors(t *testing.T) {
+	tests := map[string]string{
+		"":                             "empty fault rule",
+		"explode":                      `unknown fault "explode"`,
+		"delay:soon":                   `invalid delay "soon"`,
+		"exception:x":                  `invalid exception "x"`,
+		"drop:1":                       "fault drop takes no argument",
+		"drop unit=300":                `invalid unit "300"`,
+		"drop address=5-x":             `invalid address "5-x"`,
+		"drop when=now":                `unknown fault condition "when"`,
+		"drop every=2 probability=0.5": "fault triggers every and probability are exclusive",
+		"drop probability=2":           "fault triggers must be positive and probabilities at most 1",
+		"drop address=5-4":             "fault address range 5-4 is empty",
+		"exception:0":                  "fault exception requires an exception",
+	}
+	for text, expect := range tests {
+		rule, err := ParseFaultRule(text)
+		if err == nil {
+			err = NewFaults(0).AddRule(rule)
+		}
+		if err == nil || err.Error() != expect {
+			t.Errorf("%q: expected %q, got %v", text, expect, err)
+		}
+	}
+}
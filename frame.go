@@ -21,6 +21,34 @@ func GetException(frame Framer) (exception Exception) {
 	return exception
 }
 
+// getDevice returns the unit identifier (slave address) of the frame, or 0 if
+// the frame does not carry one.
+func getDevice(frame Framer) uint8 {
+	if f, ok := frame.(interface{ GetDevice() uint8 }); ok {
+		return f.GetDevice()
+	}
+	return 0
+}
+
+// requestAddressRange returns the first address and number of addresses
+// accessed by a standard read or write request. ok is false for functions
+// that do not address the data tables.
+func requestAddressRange(frame Framer) (address int, number int, ok bool) {
+	data := frame.GetData()
+	if len(data) < 4 {
+		return 0, 0, false
+	}
+	switch frame.GetFunction() {
+	case 1, 2, 3, 4, 15, 16:
+		address, number, _ = registerAddressAndNumber(frame)
+		return address, number, true
+	case 5, 6:
+		address, _ = registerAddressAndValue(frame)
+		return address, 1, true
+	}
+	return 0, 0, false
+}
+
 func registerAddressAndNumber(frame Framer) (register int, numRegs int, endRegister int) {
 	data := frame.GetData()
 	register = int(binary.BigEndian.Uint16(data[0:2]))
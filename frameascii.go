@@ -0,0 +1,105 @@
+package mbserver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// ASCIIFrame is the Modbus ASCII frame.
+type ASCIIFrame struct {
+	Address  uint8
+	Function uint8
+	Data     []byte
+	LRC      uint8
+}
+
+// NewASCIIFrame converts a packet to a Modbus ASCII frame.
+func NewASCIIFrame(packet []byte) (*ASCIIFrame, error) {
+	packet = bytes.TrimRight(packet, "\r\n")
+	if len(packet) < 1 || packet[0] != ':' {
+		return nil, fmt.Errorf("ASCII Frame error: missing start of frame: %q", packet)
+	}
+
+	raw := make([]byte, hex.DecodedLen(len(packet)-1))
+	_, err := hex.Decode(raw, packet[1:])
+	if err != nil {
+		return nil, fmt.Errorf("ASCII Frame error: %v", err)
+	}
+
+	// Check the packet length.
+	if len(raw) < 3 {
+		return nil, fmt.Errorf("ASCII Frame error: packet less than 3 bytes: %q", packet)
+	}
+
+	// Check the LRC.
+	pLen := len(raw)
+	lrcExpect := raw[pLen-1]
+	lrcCalc := lrcModbus(raw[0 : pLen-1])
+	if lrcCalc != lrcExpect {
+		return nil, fmt.Errorf("ASCII Frame error: LRC (expected 0x%x, got 0x%x)", lrcExpect, lrcCalc)
+	}
+
+	frame := &ASCIIFrame{
+		Address:  raw[0],
+		Function: raw[1],
+		Data:     raw[2 : pLen-1],
+		LRC:      lrcExpect,
+	}
+
+	return frame, nil
+}
+
+// Copy the ASCIIFrame.
+func (frame *ASCIIFrame) Copy() Framer {
+	copy := *frame
+	return &copy
+}
+
+// Bytes returns the Modbus byte stream based on the ASCIIFrame fields
+func (frame *ASCIIFrame) Bytes() []byte {
+	raw := make([]byte, 2, 3+len(frame.Data))
+	raw[0] = frame.Address
+	raw[1] = frame.Function
+	raw = append(raw, frame.Data...)
+	raw = append(raw, lrcModbus(raw))
+
+	return []byte(":" + strings.ToUpper(hex.EncodeToString(raw)) + "\r\n")
+}
+
+// GetFunction returns the Modbus function code.
+func (frame *ASCIIFrame) GetFunction() uint8 {
+	return frame.Function
+}
+
+// GetDevice returns the Modbus slave address.
+func (frame *ASCIIFrame) GetDevice() uint8 {
+	return frame.Address
+}
+
+// GetData returns the ASCIIFrame Data byte field.
+func (frame *ASCIIFrame) GetData() []byte {
+	return frame.Data
+}
+
+// SetData sets the ASCIIFrame Data byte field.
+func (frame *ASCIIFrame) SetData(data []byte) {
+	frame.Data = data
+}
+
+// SetException sets the Modbus exception code in the frame.
+func (frame *ASCIIFrame) SetException(exception *Exception) {
+	frame.Function = frame.Function | 0x80
+	frame.Data = []byte{byte(*exception)}
+}
+
+// lrcModbus returns the longitudinal redundancy check of the data, the two's
+// complement of the sum of the bytes.
+func lrcModbus(data []byte) uint8 {
+	var sum uint8
+	for _, b := range data {
+		sum += b
+	}
+	return -sum
+}
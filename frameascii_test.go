@@ -0,0 +1,41 @@
+package mbserver
+
+import "testing"
+
+func TestNewASCIIFrame(t *testing.T) {
+	// Read 2 holding registers at 0x006B from slave 0x11.
+	frame, err := NewASCIIFrame([]byte(":1103006B00027F\r\n"))
+	if !isEqual(nil, err) {
+		t.Fatalf("expected %v, got %v", nil, err)
+	}
+
+	got := frame.Address
+	expect := 0x11
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	got = frame.Function
+	expect = 3
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	if string(frame.Bytes()) != ":1103006B00027F\r\n" {
+		t.Errorf("expected %q, got %q", ":1103006B00027F\r\n", frame.Bytes())
+	}
+}
+
+func TestNewASCIIFrameBadLRC(t *testing.T) {
+	_, err := NewASCIIFrame([]byte(":1103006B00027E\r\n"))
+	if err == nil {
+		t.Fatalf("expected error not nil, got %v", err)
+	}
+}
+
+func TestNewASCIIFrameBadStart(t *testing.T) {
+	_, err := NewASCIIFrame([]byte("1103006B00027F\r\n"))
+	if err == nil {
+		t.Fatalf("expected error not nil, got %v", err)
+	}
+}
@@ -25,7 +25,7 @@ func NewRTUFrame(packet []byte) (*RTUFrame, error) {
 	crcExpect := binary.LittleEndian.Uint16(packet[pLen-2 : pLen])
 	crcCalc := crcModbus(packet[0 : pLen-2])
 	if crcCalc != crcExpect {
-		return nil, fmt.Errorf("RTU Frame error: CRC (expected 0x%x, got 0x%x)", crcExpect, crcCalc)
+		return nil, &crcError{crcExpect, crcCalc}
 	}
 
 	frame := &RTUFrame{
@@ -37,6 +37,16 @@ func NewRTUFrame(packet []byte) (*RTUFrame, error) {
 	return frame, nil
 }
 
+// crcError is returned by NewRTUFrame when the frame CRC does not match.
+type crcError struct {
+	expect uint16
+	got    uint16
+}
+
+func (e *crcError) Error() string {
+	return fmt.Sprintf("RTU Frame error: CRC (expected 0x%x, got 0x%x)", e.expect, e.got)
+}
+
 // Copy the RTUFrame.
 func (frame *RTUFrame) Copy() Framer {
 	copy := *frame
@@ -67,6 +77,11 @@ func (frame *RTUFrame) GetFunction() uint8 {
 	return frame.Function
 }
 
+// GetDevice returns the Modbus slave address.
+func (frame *RTUFrame) GetDevice() uint8 {
+	return frame.Address
+}
+
 // GetData returns the RTUFrame Data byte field.
 func (frame *RTUFrame) GetData() []byte {
 	return frame.Data
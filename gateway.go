@@ -0,0 +1,260 @@
+package mbserver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+// Upstream is a device requests can be forwarded to, a *Client or a *TCPPool.
+type Upstream interface {
+	// forward sends the function and data to the unit and returns the response.
+	forward(unitID uint8, function uint8, data []byte) (Framer, error)
+	Close() error
+}
+
+// Gateway forwards requests to other devices by unit ID or address range,
+// for example from Modbus TCP listeners to RTU slaves on a serial bus, or as a
+// proxy to several Modbus TCP servers. Frames are converted to the upstream
+// transport and back; TCP requests are sent with the upstream connection's
+// own transaction identifiers and answered with the original ones. Requests
+// to the same client are serialized. Unreachable devices are answered with
+// GatewayPathUnavailable and devices which do not respond with
+// GatewayTargetDeviceFailedtoRespond.
+type Gateway struct {
+	// HandleUnrouted passes requests for unit IDs without a route to the
+	// server's function handlers, otherwise they are answered with
+	// GatewayPathUnavailable.
+	HandleUnrouted bool
+	// CacheTTL keeps successful read responses for the duration, zero
+	// disables caching. Writes to a unit invalidate its cached reads.
+	CacheTTL    time.Duration
+	mutex       sync.Mutex
+	routes      map[uint8]Upstream
+	rangeRoutes []rangeRoute
+	upstreams   []Upstream
+	cache       map[string]cachedResponse
+}
+
+type rangeRoute struct {
+	upstream  Upstream
+	unitID    uint8
+	table     Table
+	addresses AddressRange
+}
+
+type cachedResponse struct {
+	data    []byte
+	expires time.Time
+}
+
+// NewGateway creates a gateway without routes.
+func NewGateway() *Gateway {
+	return &Gateway{
+		routes: make(map[uint8]Upstream),
+		cache:  make(map[string]cachedResponse),
+	}
+}
+
+// Route forwards requests for the unit IDs to the upstream. The unit ID of
+// each request is kept, a client's UnitID is not used.
+func (g *Gateway) Route(upstream Upstream, unitIDs ...uint8) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, unitID := range unitIDs {
+		g.routes[unitID] = upstream
+	}
+	g.upstreams = append(g.upstreams, upstream)
+}
+
+// RouteRange forwards requests for the unit ID which access only addresses
+// within the range of the table to the upstream. Address routes take
+// precedence over unit ID routes.
+func (g *Gateway) RouteRange(upstream Upstream, unitID uint8, table Table, addresses AddressRange) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.rangeRoutes = append(g.rangeRoutes, rangeRoute{upstream, unitID, table, addresses})
+	g.upstreams = append(g.upstreams, upstream)
+}
+
+// RouteRTU forwards requests for the unit IDs to slaves on a serial bus,
+// waiting up to timeout for each response. It returns the bus client so that
+// further unit IDs can be routed to the same bus.
+func (g *Gateway) RouteRTU(serialConfig *serial.Config, timeout time.Duration, unitIDs ...uint8) *Client {
+	client := NewRTUClient(serialConfig)
+	client.Timeout = timeout
+	g.Route(client, unitIDs...)
+	return client
+}
+
+// route returns the upstream for the request, or nil if there is none.
+func (g *Gateway) route(frame Framer) Upstream {
+	unitID := getDevice(frame)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if table, ok := functionTable(frame.GetFunction()); ok {
+		if address, number, ok := requestAddressRange(frame); ok {
+			for _, route := range g.rangeRoutes {
+				if route.unitID == unitID && route.table == table && route.addresses.contains(address, number) {
+					return route.upstream
+				}
+			}
+		}
+	}
+	return g.routes[unitID]
+}
+
+// handlesLocally reports whether the request is left to the server's function handlers.
+func (g *Gateway) handlesLocally(frame Framer) bool {
+	return g.HandleUnrouted && g.route(frame) == nil
+}
+
+// forward sends the request to the upstream device for it. ok is false when
+// there is no route and the request is to be handled locally.
+func (g *Gateway) forward(frame Framer) (data []byte, exception *Exception, ok bool) {
+	upstream := g.route(frame)
+	if upstream == nil {
+		if g.HandleUnrouted {
+			return nil, nil, false
+		}
+		return nil, &GatewayPathUnavailable, true
+	}
+
+	unitID := getDevice(frame)
+	function := frame.GetFunction()
+	key := fmt.Sprintf("%d/%d/%x", unitID, function, frame.GetData())
+	if data, ok := g.cached(key); ok {
+		return data, &Success, true
+	}
+	if isWriteFunction(function) {
+		g.invalidate(unitID)
+	}
+
+	response, err := upstream.forward(unitID, function, frame.GetData())
+	if err != nil {
+		return nil, gatewayException(response, err), true
+	}
+	if function >= 1 && function <= 4 {
+		g.store(key, response.GetData())
+	}
+	return response.GetData(), &Success, true
+}
+
+func (g *Gateway) cached(key string) ([]byte, bool) {
+	if g.CacheTTL <= 0 {
+		return nil, false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	entry, ok := g.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(g.cache, key)
+		return nil, false
+	}
+	return entry.data, true
+}
+
+func (g *Gateway) store(key string, data []byte) {
+	if g.CacheTTL <= 0 {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := time.Now()
+	for k, entry := range g.cache {
+		if now.After(entry.expires) {
+			delete(g.cache, k)
+		}
+	}
+	g.cache[key] = cachedResponse{data, now.Add(g.CacheTTL)}
+}
+
+func (g *Gateway) invalidate(unitID uint8) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	prefix := fmt.Sprintf("%d/", unitID)
+	for key := range g.cache {
+		if len(key) > len(prefix) && key[:len(prefix)] == prefix {
+			delete(g.cache, key)
+		}
+	}
+}
+
+// gatewayException returns the exception for a failed upstream request:
+// the upstream device's own exception, GatewayPathUnavailable when the
+// device could not be reached and GatewayTargetDeviceFailedtoRespond when it
+// did not respond properly.
+func gatewayException(response Framer, err error) *Exception {
+	if exception, ok := err.(Exception); ok && response != nil {
+		return &exception
+	}
+	switch err.(type) {
+	case *net.OpError, *os.PathError:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return &GatewayPathUnavailable
+		}
+	}
+	return &GatewayTargetDeviceFailedtoRespond
+}
+
+// close closes the upstream connections.
+func (g *Gateway) close() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, upstream := range g.upstreams {
+		upstream.Close()
+	}
+}
+
+// forward implements Upstream.
+func (c *Client) forward(unitID uint8, function uint8, data []byte) (Framer, error) {
+	return c.Send(c.transport.newFrame(unitID, function, data))
+}
+
+// TCPPool is a pool of connections to an upstream Modbus TCP server, allowing
+// requests from several gateway connections to be forwarded concurrently.
+type TCPPool struct {
+	clients chan *Client
+	all     []*Client
+}
+
+// NewTCPPool creates a pool of up to size connections to "address:port", at
+// least one. Connections are opened on first use and kept open.
+func NewTCPPool(addressPort string, size int, timeout time.Duration) *TCPPool {
+	size = max(size, 1)
+	p := &TCPPool{clients: make(chan *Client, size)}
+	for i := 0; i < size; i++ {
+		client := NewTCPClient(addressPort)
+		client.Timeout = timeout
+		p.all = append(p.all, client)
+		p.clients <- client
+	}
+	return p
+}
+
+// forward implements Upstream using the first idle connection.
+func (p *TCPPool) forward(unitID uint8, function uint8, data []byte) (Framer, error) {
+	client := <-p.clients
+	defer func() { p.clients <- client }()
+	return client.forward(unitID, function, data)
+}
+
+// Close closes the pooled connections.
+func (p *TCPPool) Close() error {
+	var err error
+	for _, client := range p.all {
+		if closeErr := client.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+package mbserver
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func gatewayRequest(device uint8, function uint8, register uint16, number uint16) *Request {
+	var frame TCPFrame
+	frame.TransactionIdentifier = 9
+	frame.Device = device
+	frame.Function = function
+	SetDataWithRegisterAndNumber(&frame, register, number)
+	return &Request{frame: &frame}
+}
+
+func TestGateway(t *testing.T) {
+	// Slave 3 on the serial bus.
+	clientPort, serverPort := net.Pipe()
+	slave := NewServer()
+	slave.HoldingRegisters[10] = 1234
+	go serveSerial(slave, serverPort, rtuFraming)
+
+	s := NewServer()
+	s.Gateway = NewGateway()
+	bus := newClient(&serialTransport{framing: rtuFraming, port: clientPort})
+	bus.Timeout = 100 * time.Millisecond
+	s.Gateway.Route(bus, 3)
+	defer s.Gateway.close()
+
+	response := s.handle(gatewayRequest(3, 3, 10, 1)).(*TCPFrame)
+	if exception := GetException(response); exception != Success {
+		t.Fatalf("expected Success, got %v", exception.String())
+	}
+	expect := []byte{2, 0x04, 0xD2}
+	if !isEqual(expect, response.Data) {
+		t.Errorf("expected %v, got %v", expect, response.Data)
+	}
+	if response.TransactionIdentifier != 9 || response.Device != 3 {
+		t.Errorf("expected transaction 9 unit 3, got %v", response)
+	}
+
+	// Downstream exceptions are passed through.
+	response = s.handle(gatewayRequest(3, 3, 65535, 2)).(*TCPFrame)
+	if exception := GetException(response); exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+
+	// Unit IDs without a route.
+	response = s.handle(gatewayRequest(4, 3, 10, 1)).(*TCPFrame)
+	if exception := GetException(response); exception != GatewayPathUnavailable {
+		t.Errorf("expected GatewayPathUnavailable, got %v", exception.String())
+	}
+
+	s.Gateway.HandleUnrouted = true
+	s.HoldingRegisters[10] = 5678
+	response = s.handle(gatewayRequest(4, 3, 10, 1)).(*TCPFrame)
+	expect = []byte{2, 0x16, 0x2E}
+	if !isEqual(expect, response.Data) {
+		t.Errorf("expected %v, got %v", expect, response.Data)
+	}
+}
+
+func TestGatewayTargetFailedToRespond(t *testing.T) {
+	// The slave reads requests but never responds.
+	clientPort, serverPort := net.Pipe()
+	go io.Copy(io.Discard, serverPort)
+	defer serverPort.Close()
+
+	s := NewServer()
+	s.Gateway = NewGateway()
+	bus := newClient(&serialTransport{framing: rtuFraming, port: clientPort})
+	bus.Timeout = 20 * time.Millisecond
+	s.Gateway.Route(bus, 1)
+	defer s.Gateway.close()
+
+	response := s.handle(gatewayRequest(1, 3, 0, 1))
+	if exception := GetException(response); exception != GatewayTargetDeviceFailedtoRespond {
+		t.Errorf("expected GatewayTargetDeviceFailedtoRespond, got %v", exception.String())
+	}
+}
+
+func TestGatewayPathUnavailable(t *testing.T) {
+	s := NewServer()
+	s.Gateway = NewGateway()
+	// Nothing listens on the downstream address.
+	listen, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := listen.Addr().String()
+	listen.Close()
+	s.Gateway.Route(NewTCPClient(addr), 1)
+	defer s.Gateway.close()
+
+	response := s.handle(gatewayRequest(1, 3, 0, 1))
+	if exception := GetException(response); exception != GatewayPathUnavailable {
+		t.Errorf("expected GatewayPathUnavailable, got %v", exception.String())
+	}
+}
+
+func TestGatewayProxy(t *testing.T) {
+	upstreamA := NewServer()
+	addrA := getFreePort()
+	if err := upstreamA.ListenTCP(addrA); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer upstreamA.Close()
+	upstreamA.HoldingRegisters[1000] = 1
+
+	upstreamB := NewServer()
+	addrB := getFreePort()
+	if err := upstreamB.ListenTCP(addrB); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer upstreamB.Close()
+	upstreamB.HoldingRegisters[1000] = 2
+
+	proxy := NewServer()
+	proxy.Gateway = NewGateway()
+	proxy.Gateway.CacheTTL = time.Hour
+	proxy.Gateway.Route(NewTCPPool(addrA, 2, time.Second), 1)
+	proxy.Gateway.RouteRange(NewTCPPool(addrB, 2, time.Second), 1, HoldingRegisterTable, AddressRange{1000, 1099})
+	addr := getFreePort()
+	if err := proxy.ListenTCP(addr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer proxy.Close()
+
+	client := NewTCPClient(addr)
+	defer client.Close()
+
+	// Reads within the range go to upstream B, others to upstream A.
+	registers, err := client.ReadHoldingRegisters(1000, 1)
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if !isEqual([]uint16{2}, registers) {
+		t.Errorf("expected %v, got %v", []uint16{2}, registers)
+	}
+	registers, err = client.ReadHoldingRegisters(999, 2)
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if !isEqual([]uint16{0, 1}, registers) {
+		t.Errorf("expected %v, got %v", []uint16{0, 1}, registers)
+	}
+
+	// Cached reads do not reach the upstream until a write invalidates them.
+	upstreamB.HoldingRegisters[1000] = 3
+	registers, _ = client.ReadHoldingRegisters(1000, 1)
+	if !isEqual([]uint16{2}, registers) {
+		t.Errorf("expected cached %v, got %v", []uint16{2}, registers)
+	}
+	err = client.WriteSingleRegister(1001, 4)
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	registers, _ = client.ReadHoldingRegisters(1000, 2)
+	if !isEqual([]uint16{3, 4}, registers) {
+		t.Errorf("expected %v, got %v", []uint16{3, 4}, registers)
+	}
+}
+
+func TestTCPPoolSize(t *testing.T) {
+	for _, size := range []int{-1, 0, 1} {
+		p := NewTCPPool("127.0.0.1:502", size, time.Second)
+		if len(p.all) != 1 || len(p.clients) != 1 {
+			t.Errorf("size %d: expected 1 connection, got %d", size, len(p.all))
+		}
+	}
+}
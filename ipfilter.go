@@ -0,0 +1,102 @@
+package mbserver
+
+import (
+	"fmt"
+	"net"
+)
+
+// IPFilter restricts access to a TCP listener by client IP address.
+// Deny rules are checked first. When allow rules exist, a client must match
+// one of them; the most specific matching rule decides whether the client may
+// use write functions. Without allow rules every client that is not denied
+// may read and write.
+type IPFilter struct {
+	allow []ipRule
+	deny  []*net.IPNet
+}
+
+type ipRule struct {
+	network *net.IPNet
+	write   bool
+}
+
+// NewIPFilter creates an empty filter which accepts all clients.
+func NewIPFilter() *IPFilter {
+	return &IPFilter{}
+}
+
+// Allow permits clients in the CIDR block, e.g. "10.0.0.0/8". Clients are
+// read-only unless write is true.
+func (f *IPFilter) Allow(cidr string, write bool) error {
+	network, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	f.allow = append(f.allow, ipRule{network, write})
+	return nil
+}
+
+// Deny rejects clients in the CIDR block, e.g. "192.168.1.7/32".
+func (f *IPFilter) Deny(cidr string) error {
+	network, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	f.deny = append(f.deny, network)
+	return nil
+}
+
+// Check reports whether the client IP is accepted and whether it may write.
+func (f *IPFilter) Check(ip net.IP) (accept bool, write bool) {
+	if f == nil {
+		return true, true
+	}
+	for _, network := range f.deny {
+		if network.Contains(ip) {
+			return false, false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true, true
+	}
+
+	bestPrefix := -1
+	for _, rule := range f.allow {
+		if !rule.network.Contains(ip) {
+			continue
+		}
+		prefix, _ := rule.network.Mask.Size()
+		if prefix > bestPrefix {
+			bestPrefix = prefix
+			write = rule.write
+		}
+	}
+	return bestPrefix >= 0, write
+}
+
+// parseCIDR parses a CIDR block, treating a bare IP address as a single host.
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(cidr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid CIDR %q", cidr)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// isWriteFunction reports whether the Modbus function modifies coils or registers.
+func isWriteFunction(function uint8) bool {
+	switch function {
+	case 5, 6, 15, 16, 22, 23:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package mbserver
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPFilterCheck(t *testing.T) {
+	filter := NewIPFilter()
+	if err := filter.Allow("10.0.0.0/8", false); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := filter.Allow("10.1.2.0/24", true); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := filter.Deny("10.1.2.66"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	tests := []struct {
+		ip     string
+		accept bool
+		write  bool
+	}{
+		{"10.9.9.9", true, false},
+		{"10.1.2.3", true, true},
+		{"10.1.2.66", false, false},
+		{"192.168.0.1", false, false},
+	}
+	for _, test := range tests {
+		accept, write := filter.Check(net.ParseIP(test.ip))
+		if accept != test.accept || write != test.write {
+			t.Errorf("%s: expected %v/%v, got %v/%v", test.ip, test.accept, test.write, accept, write)
+		}
+	}
+}
+
+func TestIPFilterEmptyAllowsAll(t *testing.T) {
+	var filter *IPFilter
+	accept, write := filter.Check(net.ParseIP("192.168.0.1"))
+	if !accept || !write {
+		t.Errorf("expected true/true, got %v/%v", accept, write)
+	}
+}
+
+func TestIPFilterBadCIDR(t *testing.T) {
+	err := NewIPFilter().Allow("10.0.0.0/99", true)
+	if err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
+
+func TestReadOnlyRequest(t *testing.T) {
+	s := NewServer()
+	var frame TCPFrame
+	frame.Function = 6
+	SetDataWithRegisterAndNumber(&frame, 1, 5)
+
+	req := Request{frame: &frame, readOnly: true}
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != IllegalFunction {
+		t.Errorf("expected IllegalFunction (%d), got (%v)", IllegalFunction, exception)
+	}
+	if s.HoldingRegisters[1] != 0 {
+		t.Errorf("expected 0, got %v", s.HoldingRegisters[1])
+	}
+}
@@ -0,0 +1,70 @@
+package mbserver
+
+import (
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+// LineTiming emulates the timing of a serial line on RTU ports, which
+// otherwise answer as soon as the request is read, such as over a virtual
+// serial port. Responses are delayed by the transmission of the request and
+// the response at the port's baud rate, the silence of 3.5 characters ending
+// the request and the device's processing time, so that the throughput
+// resembles a real bus. The responses of a port are written in order, on their
+// own goroutine, so that the timing holds up neither the handling of other
+// requests nor other ports and listeners.
+type LineTiming struct {
+	// ProcessingTime is the time the device takes to handle a request.
+	ProcessingTime time.Duration
+}
+
+// CharacterTime returns the time a character takes on a serial line with the
+// configuration: a start bit, the data bits, a parity bit unless the parity
+// is "N" and the stop bits, with the defaults of serial.Open.
+func CharacterTime(config *serial.Config) time.Duration {
+	baudRate, dataBits, stopBits := config.BaudRate, config.DataBits, config.StopBits
+	if baudRate == 0 {
+		baudRate = 19200
+	}
+	if dataBits == 0 {
+		dataBits = 8
+	}
+	if stopBits == 0 {
+		stopBits = 1
+	}
+	bits := 1 + dataBits + stopBits
+	if config.Parity != "N" {
+		bits++
+	}
+	return time.Duration(bits) * time.Second / time.Duration(baudRate)
+}
+
+// frameGap returns the silence ending RTU frames, 3.5 characters or 1.75ms
+// above 19200 baud as recommended by the Modbus serial line specification.
+func frameGap(config *serial.Config) time.Duration {
+	if config.BaudRate > 19200 {
+		return 1750 * time.Microsecond
+	}
+	return CharacterTime(config) * 7 / 2
+}
+
+// lineSchedule is the timing of the response to a request read from a
+// serial line.
+type lineSchedule struct {
+	ready     time.Time
+	character time.Duration
+}
+
+// schedule returns the timing of the response to a request of size bytes
+// read at the time.
+func (timing *LineTiming) schedule(config *serial.Config, read time.Time, size int) *lineSchedule {
+	character := CharacterTime(config)
+	ready := read.Add(time.Duration(size)*character + frameGap(config) + timing.ProcessingTime)
+	return &lineSchedule{ready, character}
+}
+
+// at returns the time a response of size bytes has been received on the line.
+func (line *lineSchedule) at(size int) time.Time {
+	return line.ready.Add(time.Duration(size) * line.character)
+}
@@ -0,0 +1,91 @@
+package mbserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+func TestCharacterTime(t *testing.T) {
+	tests := []struct {
+		config serial.Config
+		expect time.Duration
+	}{
+		{serial.Config{BaudRate: 9600, Parity: "N"}, 10 * time.Second / 9600},
+		{serial.Config{BaudRate: 9600, Parity: "E"}, 11 * time.Second / 9600},
+		{serial.Config{BaudRate: 9600, DataBits: 7, StopBits: 2, Parity: "O"}, 11 * time.Second / 9600},
+		{serial.Config{}, 11 * time.Second / 19200},
+	}
+	for _, test := range tests {
+		if got := CharacterTime(&test.config); got != test.expect {
+			t.Errorf("%+v: expected %v, got %v", test.config, test.expect, got)
+		}
+	}
+	if gap := frameGap(&serial.Config{BaudRate: 115200}); gap != 1750*time.Microsecond {
+		t.Errorf("expected 1.75ms, got %v", gap)
+	}
+}
+
+func TestLineTiming(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.LineTiming = &LineTiming{ProcessingTime: 10 * time.Millisecond}
+	s.HoldingRegisters[3] = 42
+	clientPort, serverPort := net.Pipe()
+	config := &serial.Config{Address: "pipe", BaudRate: 9600}
+	go s.acceptSerialRequests(serverPort, config)
+
+	client := newClient(&serialTransport{framing: rtuFraming, port: clientPort})
+	defer client.Close()
+	start := time.Now()
+	registers, err := client.ReadHoldingRegisters(3, 1)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if !isEqual([]uint16{42}, registers) {
+		t.Errorf("expected %v, got %v", []uint16{42}, registers)
+	}
+	// An 8 byte request and a 7 byte response at 9600 baud.
+	expect := 15*CharacterTime(config) + frameGap(config) + 10*time.Millisecond
+	if elapsed := time.Since(start); elapsed < expect {
+		t.Errorf("expected at least %v, got %v", expect, elapsed)
+	}
+}
+
+func TestLineTimingDoesNotHoldHandler(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.LineTiming = &LineTiming{ProcessingTime: 500 * time.Millisecond}
+	clientPort, serverPort := net.Pipe()
+	go s.acceptSerialRequests(serverPort, &serial.Config{Address: "pipe", BaudRate: 9600})
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s.listeners = append(s.listeners, listen)
+	go s.accept(listen, "tcp", nil)
+
+	serialClient := newClient(&serialTransport{framing: rtuFraming, port: clientPort})
+	defer serialClient.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := serialClient.ReadHoldingRegisters(0, 1)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	client := NewTCPClient(listen.Addr().String())
+	defer client.Close()
+	start := time.Now()
+	if _, err := client.ReadHoldingRegisters(0, 1); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("expected less than 250ms, got %v", elapsed)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
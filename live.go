@@ -0,0 +1,280 @@
+package mbserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// liveInterval is how often the live view compares the watched ranges, to
+// find the direct writes of the application which have no change events.
+const liveInterval = 100 * time.Millisecond
+
+// liveWriteTimeout bounds the time a live view client may take to receive a
+// message.
+const liveWriteTimeout = 10 * time.Second
+
+// LiveWatch is a range of a table watched by a live view client.
+type LiveWatch struct {
+	Table   string `json:"table"`
+	Address uint16 `json:"address"`
+	Count   uint16 `json:"count"`
+}
+
+// LiveMessage is a message of the live view to its client. Type is
+//
+//	"values"  the current Values of a watched range, sent when it is watched
+//	"update"  the Old and new Values of the addresses of a watched range
+//	          written, with the writer's UnitID, Client, Identity and Source
+//	          from the ChangeEvent, or of a run of addresses changed by a
+//	          direct write of the application, found by comparing the values
+//	"request" a request handled by the server, with the Table, Address and
+//	          Count it accessed, if any
+//	"error"   an invalid message from the client
+type LiveMessage struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Table     string    `json:"table,omitempty"`
+	Address   int       `json:"address"`
+	Count     int       `json:"count,omitempty"`
+	Old       []uint16  `json:"old,omitempty"`
+	Values    []uint16  `json:"values,omitempty"`
+	UnitID    uint8     `json:"unit_id,omitempty"`
+	Function  uint8     `json:"function,omitempty"`
+	Transport string    `json:"transport,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	Identity  string    `json:"identity,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	Exception string    `json:"exception,omitempty"`
+	Duration  float64   `json:"duration_ms,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// liveCommand is a message of a live view client, replacing the watched
+// ranges.
+type liveCommand struct {
+	Watch []LiveWatch `json:"watch"`
+	err   error
+}
+
+// liveWatch is a validated LiveWatch with the last values sent.
+type liveWatch struct {
+	table   Table
+	address int
+	values  []uint16
+}
+
+var liveUpgrader = websocket.Upgrader{}
+
+// serveLive streams the watched ranges and the request activity of the
+// server to a WebSocket client until it disconnects or the server is closed.
+func (s *Server) serveLive(w http.ResponseWriter, r *http.Request) {
+	conn, err := liveUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	changes := s.Subscribe(256, DropOldest)
+	defer changes.Close()
+	requests := s.SubscribeRequests(256, DropOldest)
+	defer requests.Close()
+
+	commands := make(chan liveCommand)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(commands)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var command liveCommand
+			if err := json.Unmarshal(data, &command); err != nil {
+				command.err = fmt.Errorf("invalid message: %v", err)
+			}
+			select {
+			case commands <- command:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	send := func(message LiveMessage) bool {
+		conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+		return conn.WriteJSON(message) == nil
+	}
+
+	ticker := time.NewTicker(liveInterval)
+	defer ticker.Stop()
+	var watches []*liveWatch
+	for {
+		select {
+		case <-s.portsCloseChan:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+			return
+		case command, ok := <-commands:
+			if !ok {
+				return
+			}
+			err := command.err
+			if err == nil {
+				watches, err = s.liveWatches(command.Watch)
+			}
+			if err != nil {
+				if !send(LiveMessage{Type: "error", Time: time.Now(), Error: err.Error()}) {
+					return
+				}
+				continue
+			}
+			now := time.Now()
+			for _, watch := range watches {
+				if !send(LiveMessage{Type: "values", Time: now, Table: watch.table.String(), Address: watch.address, Values: watch.values}) {
+					return
+				}
+			}
+		case event := <-changes.C:
+			for _, message := range liveChanges(watches, event) {
+				if !send(message) {
+					return
+				}
+			}
+		case <-ticker.C:
+			for _, message := range s.liveUpdates(watches, changes) {
+				if !send(message) {
+					return
+				}
+			}
+		case event := <-requests.C:
+			message := LiveMessage{
+				Type:      "request",
+				Time:      event.Time,
+				Address:   event.Address,
+				Count:     event.Quantity,
+				UnitID:    event.UnitID,
+				Function:  event.Function,
+				Transport: event.Transport,
+				Client:    event.Client,
+				Duration:  float64(event.Duration) / float64(time.Millisecond),
+			}
+			if table, ok := functionTable(event.Function); ok {
+				message.Table = table.String()
+			}
+			if event.Exception != Success {
+				message.Exception = event.Exception.String()
+			}
+			if !send(message) {
+				return
+			}
+		}
+	}
+}
+
+// liveWatches validates the watched ranges and reads their values.
+func (s *Server) liveWatches(ranges []LiveWatch) ([]*liveWatch, error) {
+	watches := make([]*liveWatch, len(ranges))
+	for i, r := range ranges {
+		table, err := ParseTable(r.Table)
+		if err != nil {
+			return nil, fmt.Errorf("watch[%d]: %v", i, err)
+		}
+		if r.Count == 0 || int(r.Address)+int(r.Count) > 65536 {
+			return nil, fmt.Errorf("watch[%d]: addresses %d+%d are out of range", i, r.Address, r.Count)
+		}
+		watches[i] = &liveWatch{table: table, address: int(r.Address), values: make([]uint16, r.Count)}
+	}
+
+	s.dataMutex.Lock()
+	defer s.dataMutex.Unlock()
+	for _, watch := range watches {
+		watch.values = s.readTable(watch.table, watch.address, len(watch.values))
+	}
+	return watches, nil
+}
+
+// liveChanges returns an update for each watched range written by the change
+// event, and records the new values as sent.
+func liveChanges(watches []*liveWatch, event ChangeEvent) []LiveMessage {
+	var updates []LiveMessage
+	for _, watch := range watches {
+		first := max(watch.address, int(event.Address))
+		last := min(watch.address+len(watch.values), int(event.Address)+len(event.New))
+		if watch.table != event.Table || first >= last {
+			continue
+		}
+		written := event.New[first-int(event.Address) : last-int(event.Address)]
+		copy(watch.values[first-watch.address:], written)
+		updates = append(updates, LiveMessage{
+			Type:     "update",
+			Time:     event.Time,
+			Table:    event.Table.String(),
+			Address:  first,
+			Old:      event.Old[first-int(event.Address) : last-int(event.Address)],
+			Values:   written,
+			UnitID:   event.UnitID,
+			Client:   event.Client,
+			Identity: event.Identity,
+			Source:   event.Source,
+		})
+	}
+	return updates
+}
+
+// liveUpdates returns an update for each run of addresses of the watched
+// ranges whose values changed since they were last sent. Changes still queued
+// on the subscription are sent first with their writers, so that only direct
+// writes are left to be found by comparing.
+func (s *Server) liveUpdates(watches []*liveWatch, changes *Subscription) []LiveMessage {
+	if len(watches) == 0 {
+		return nil
+	}
+	current := make([][]uint16, len(watches))
+	var pending []ChangeEvent
+	s.dataMutex.Lock()
+	// Events are published under the lock, so all those of the values read
+	// are queued by now.
+	for queued := true; queued; {
+		select {
+		case event := <-changes.C:
+			pending = append(pending, event)
+		default:
+			queued = false
+		}
+	}
+	for i, watch := range watches {
+		current[i] = s.readTable(watch.table, watch.address, len(watch.values))
+	}
+	s.dataMutex.Unlock()
+
+	var updates []LiveMessage
+	for _, event := range pending {
+		updates = append(updates, liveChanges(watches, event)...)
+	}
+	now := time.Now()
+	for i, watch := range watches {
+		for first := 0; first < len(watch.values); first++ {
+			if current[i][first] == watch.values[first] {
+				continue
+			}
+			last := first
+			for last+1 < len(watch.values) && current[i][last+1] != watch.values[last+1] {
+				last++
+			}
+			updates = append(updates, LiveMessage{
+				Type:    "update",
+				Time:    now,
+				Table:   watch.table.String(),
+				Address: watch.address + first,
+				Values:  current[i][first : last+1],
+			})
+			first = last
+		}
+		watch.values = current[i]
+	}
+	return updates
+}
@@ -0,0 +1,124 @@
+package mbserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func liveMessage(t *testing.T, conn *websocket.Conn, kind string) LiveMessage {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var message LiveMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		if message.Type == kind {
+			return message
+		}
+	}
+}
+
+func TestLive(t *testing.T) {
+	s := NewServer()
+	api := httptest.NewServer(s.APIHandler())
+	defer api.Close()
+	url := "ws" + strings.TrimPrefix(api.URL, "http") + "/api/live"
+
+	s.HoldingRegisters[11] = 5
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer conn.Close()
+
+	conn.WriteJSON(liveCommand{Watch: []LiveWatch{{Table: "registers", Count: 1}}})
+	message := liveMessage(t, conn, "error")
+	if !strings.HasPrefix(message.Error, "watch[0]: unknown table \"registers\"") {
+		t.Errorf("unexpected error %q", message.Error)
+	}
+
+	conn.WriteJSON(liveCommand{Watch: []LiveWatch{
+		{Table: "holding_registers", Address: 10, Count: 5},
+		{Table: "input_registers", Address: 0, Count: 2},
+	}})
+	message = liveMessage(t, conn, "values")
+	if message.Table != "holding_registers" || message.Address != 10 || !isEqual([]uint16{0, 5, 0, 0, 0}, message.Values) {
+		t.Errorf("unexpected values %+v", message)
+	}
+	message = liveMessage(t, conn, "values")
+	if message.Table != "input_registers" || len(message.Values) != 2 {
+		t.Errorf("unexpected values %+v", message)
+	}
+
+	// A write by a client shows as an update, with the writer, and a request.
+	status := apiCall(t, "PUT", api.URL+"/api/units/1/holding_registers?address=12", TableValues{Values: []uint16{7, 8}}, nil)
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %v", status)
+	}
+	message = liveMessage(t, conn, "update")
+	if message.Table != "holding_registers" || message.Address != 12 || !isEqual([]uint16{7, 8}, message.Values) ||
+		!isEqual([]uint16{0, 0}, message.Old) || message.Client != "127.0.0.1" || message.UnitID != 1 {
+		t.Errorf("unexpected update %+v", message)
+	}
+	message = liveMessage(t, conn, "request")
+	if message.Function != 16 || message.Table != "holding_registers" || message.Address != 12 || message.Count != 2 ||
+		message.Transport != "http" || message.Exception != "" {
+		t.Errorf("unexpected request %+v", message)
+	}
+
+	// Quick writes are all shown.
+	for _, value := range []uint16{1, 2} {
+		apiCall(t, "PUT", api.URL+"/api/units/1/holding_registers?address=14", TableValues{Values: []uint16{value}}, nil)
+	}
+	for _, value := range []uint16{1, 2} {
+		message = liveMessage(t, conn, "update")
+		if message.Address != 14 || !isEqual([]uint16{value}, message.Values) {
+			t.Errorf("expected %v, got %+v", value, message)
+		}
+	}
+
+	// So does a direct change by the application.
+	s.dataMutex.Lock()
+	s.InputRegisters[1] = 99
+	s.dataMutex.Unlock()
+	message = liveMessage(t, conn, "update")
+	if message.Table != "input_registers" || message.Address != 1 || !isEqual([]uint16{99}, message.Values) {
+		t.Errorf("unexpected update %+v", message)
+	}
+
+	s.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected going away, got %v", err)
+	}
+}
+
+func TestLiveUpdatesQueuedChanges(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	changes := s.Subscribe(8, DropOldest)
+	defer changes.Close()
+	watches, err := s.liveWatches([]LiveWatch{{Table: "holding_registers", Address: 0, Count: 4}})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	// A write still queued when the ticker fires is sent once, with its writer.
+	s.dataMutex.Lock()
+	s.writeTable(HoldingRegisterTable, 1, []uint16{5}, ChangeEvent{Source: "behavior test"})
+	s.dataMutex.Unlock()
+	updates := s.liveUpdates(watches, changes)
+	if len(updates) != 1 || updates[0].Source != "behavior test" || !isEqual([]uint16{5}, updates[0].Values) {
+		t.Errorf("expected one update by the behavior, got %+v", updates)
+	}
+}
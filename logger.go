@@ -0,0 +1,63 @@
+package mbserver
+
+import (
+	"encoding/hex"
+	"log"
+	"log/slog"
+	"sync"
+)
+
+// Logger is the structured logging interface used by the server. Arguments
+// are alternating keys and values. A *slog.Logger satisfies the interface.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+var (
+	debugLogger     *slog.Logger
+	debugLoggerOnce sync.Once
+)
+
+// logger returns the Logger set on the server. Without one, messages go to
+// the slog default logger, or to a debug level logger writing to the standard
+// log output when Debug is set.
+func (s *Server) logger() Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	if s.Debug {
+		debugLoggerOnce.Do(func() {
+			handler := slog.NewTextHandler(log.Writer(), &slog.HandlerOptions{Level: slog.LevelDebug})
+			debugLogger = slog.New(handler)
+		})
+		return debugLogger
+	}
+	return slog.Default()
+}
+
+// requestFields returns the log fields describing a request.
+func requestFields(request *Request) []interface{} {
+	fields := []interface{}{
+		"listener", request.listener,
+		"unit_id", getDevice(request.frame),
+		"function", request.frame.GetFunction(),
+	}
+	if request.client != "" {
+		fields = append(fields, "remote", request.client)
+	}
+	if request.identity != "" {
+		fields = append(fields, "identity", request.identity)
+	}
+	return fields
+}
+
+// logFrame dumps the frame bytes when Debug is set.
+func (s *Server) logFrame(msg string, request *Request, frame []byte) {
+	if !s.Debug {
+		return
+	}
+	s.logger().Debug(msg, append(requestFields(request), "frame", hex.EncodeToString(frame))...)
+}
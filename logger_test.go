@@ -0,0 +1,84 @@
+package mbserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLogger records log events as "level msg key=value ..." lines.
+type testLogger struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (l *testLogger) log(level string, msg string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	event := level + " " + msg
+	for i := 0; i+1 < len(args); i += 2 {
+		event += fmt.Sprintf(" %v=%v", args[i], args[i+1])
+	}
+	l.events = append(l.events, event)
+}
+
+func (l *testLogger) Debug(msg string, args ...interface{}) { l.log("DEBUG", msg, args...) }
+func (l *testLogger) Info(msg string, args ...interface{})  { l.log("INFO", msg, args...) }
+func (l *testLogger) Warn(msg string, args ...interface{})  { l.log("WARN", msg, args...) }
+func (l *testLogger) Error(msg string, args ...interface{}) { l.log("ERROR", msg, args...) }
+
+func (l *testLogger) find(prefix string) string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, event := range l.events {
+		if strings.HasPrefix(event, prefix) {
+			return event
+		}
+	}
+	return ""
+}
+
+func TestLogger(t *testing.T) {
+	logger := &testLogger{}
+	s := NewServer()
+	s.Logger = logger
+	s.Debug = true
+	addr := getFreePort()
+	err := s.ListenTCP(addr)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+
+	// Unsupported function 0x42 on unit 7.
+	_, err = conn.Write([]byte{0, 1, 0, 0, 0, 3, 7, 0x42, 0})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 512))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	expect := []string{
+		"DEBUG connection accepted listener=" + addr,
+		"DEBUG frame received listener=" + addr + " unit_id=7 function=66 remote=127.0.0.1 frame=000100000003074200",
+		"DEBUG exception response listener=" + addr + " unit_id=7 function=66 remote=127.0.0.1 exception=IllegalFunction",
+		"DEBUG frame sent listener=" + addr + " unit_id=7 function=66 remote=127.0.0.1 frame=00010000000307c201",
+	}
+	for _, prefix := range expect {
+		if logger.find(prefix) == "" {
+			t.Errorf("expected event %q, got %v", prefix, logger.events)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package mbserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// MapRule exposes an address range of one table at other addresses, possibly
+// of another table of the same kind: coils and discrete inputs, or holding
+// and input registers.
+type MapRule struct {
+	// Table and Addresses as seen by clients.
+	Table     Table
+	Addresses AddressRange
+	// Target is the table holding the data, starting at TargetAddress.
+	Target        Table
+	TargetAddress uint16
+	// Scale and Offset convert register values read as value*Scale + Offset
+	// and written values back. A zero Scale is treated as 1.
+	Scale  float64
+	Offset float64
+	// ReadOnly rejects writes with IllegalDataAddress. Rules targeting
+	// discrete inputs or input registers are always read-only.
+	ReadOnly bool
+}
+
+// Mapping translates the addresses of requests before they are handled
+// locally or forwarded by the Gateway. Requests which do not touch a mapped
+// range are passed through unchanged; requests which only partly fall
+// within a rule are answered with IllegalDataAddress.
+type Mapping struct {
+	rules []MapRule
+}
+
+// NewMapping creates a mapping without rules.
+func NewMapping() *Mapping {
+	return &Mapping{}
+}
+
+// Add adds a rule to the mapping.
+func (m *Mapping) Add(rule MapRule) error {
+	if rule.Addresses.First > rule.Addresses.Last {
+		return fmt.Errorf("mapping address range %d-%d is empty", rule.Addresses.First, rule.Addresses.Last)
+	}
+	if isBitTable(rule.Table) != isBitTable(rule.Target) {
+		return fmt.Errorf("mapping cannot expose %v as %v", rule.Target, rule.Table)
+	}
+	if int(rule.TargetAddress)+int(rule.Addresses.Last-rule.Addresses.First) > 65535 {
+		return fmt.Errorf("mapping target range starting at %d exceeds the %v table", rule.TargetAddress, rule.Target)
+	}
+	for _, other := range m.rules {
+		if other.Table == rule.Table && other.Addresses.overlaps(int(rule.Addresses.First), int(rule.Addresses.Last-rule.Addresses.First)+1) {
+			return fmt.Errorf("mapping range %d-%d of %v overlaps %d-%d", rule.Addresses.First, rule.Addresses.Last,
+				rule.Table, other.Addresses.First, other.Addresses.Last)
+		}
+	}
+	if rule.Scale == 0 {
+		rule.Scale = 1
+	}
+	m.rules = append(m.rules, rule)
+	return nil
+}
+
+// translate returns the frame addressing the target table of the matching
+// rule, and the rule to convert the response with. Frames outside all rules
+// are returned unchanged with a nil rule.
+func (m *Mapping) translate(frame Framer) (Framer, *MapRule, *Exception) {
+	function := frame.GetFunction()
+	table, ok := functionTable(function)
+	if !ok {
+		return frame, nil, nil
+	}
+	address, number, ok := requestAddressRange(frame)
+	if !ok {
+		return frame, nil, nil
+	}
+
+	for i := range m.rules {
+		rule := &m.rules[i]
+		if rule.Table != table || !rule.Addresses.overlaps(address, number) {
+			continue
+		}
+		if !rule.Addresses.contains(address, number) {
+			return nil, nil, &IllegalDataAddress
+		}
+		write := isWriteFunction(function)
+		if write && (rule.ReadOnly || rule.Target == DiscreteInputTable || rule.Target == InputRegisterTable) {
+			return nil, nil, &IllegalDataAddress
+		}
+
+		translated := frame.Copy()
+		data := append([]byte(nil), frame.GetData()...)
+		binary.BigEndian.PutUint16(data[0:2], uint16(address-int(rule.Addresses.First)+int(rule.TargetAddress)))
+		switch function {
+		case 6:
+			binary.BigEndian.PutUint16(data[2:4], rule.unscale(binary.BigEndian.Uint16(data[2:4])))
+		case 16:
+			for i := 5; i+1 < len(data); i += 2 {
+				binary.BigEndian.PutUint16(data[i:i+2], rule.unscale(binary.BigEndian.Uint16(data[i:i+2])))
+			}
+		}
+		translated.SetData(data)
+		if !write {
+			setFunction(translated, targetReadFunction(rule.Target))
+		}
+		return translated, rule, nil
+	}
+	return frame, nil, nil
+}
+
+// response converts the response data for the original request.
+func (rule *MapRule) response(request Framer, data []byte) []byte {
+	function := request.GetFunction()
+	if isWriteFunction(function) {
+		// Echo the client's address and value or quantity.
+		return append([]byte(nil), request.GetData()[0:4]...)
+	}
+	if isBitTable(rule.Table) || len(data) < 1 {
+		return data
+	}
+	converted := append([]byte(nil), data...)
+	for i := 1; i+1 < len(converted); i += 2 {
+		binary.BigEndian.PutUint16(converted[i:i+2], rule.scale(binary.BigEndian.Uint16(converted[i:i+2])))
+	}
+	return converted
+}
+
+func (rule *MapRule) scale(value uint16) uint16 {
+	return clampUint16(float64(value)*rule.Scale + rule.Offset)
+}
+
+func (rule *MapRule) unscale(value uint16) uint16 {
+	return clampUint16((float64(value) - rule.Offset) / rule.Scale)
+}
+
+func clampUint16(value float64) uint16 {
+	value = math.Round(value)
+	if value < 0 {
+		return 0
+	}
+	if value > 65535 {
+		return 65535
+	}
+	return uint16(value)
+}
+
+func isBitTable(table Table) bool {
+	return table == CoilTable || table == DiscreteInputTable
+}
+
+// targetReadFunction returns the read function of the table.
+func targetReadFunction(table Table) uint8 {
+	return uint8(table) + 1
+}
+
+// setFunction sets the function code of the frame types of this package.
+func setFunction(frame Framer, function uint8) {
+	switch f := frame.(type) {
+	case *TCPFrame:
+		f.Function = function
+	case *RTUFrame:
+		f.Function = function
+	case *ASCIIFrame:
+		f.Function = function
+	}
+}
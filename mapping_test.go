@@ -0,0 +1,90 @@
+package mbserver
+
+import "testing"
+
+func mappingRequest(function uint8, register uint16, number uint16, values ...uint16) *Request {
+	var frame TCPFrame
+	frame.Function = function
+	if values != nil {
+		SetDataWithRegisterAndNumberAndValues(&frame, register, number, values)
+	} else {
+		SetDataWithRegisterAndNumber(&frame, register, number)
+	}
+	return &Request{frame: &frame}
+}
+
+func TestMapping(t *testing.T) {
+	s := NewServer()
+	s.Mapping = NewMapping()
+	// Input registers 0-99 appear as holding registers 1000-1099, scaled by 10.
+	err := s.Mapping.Add(MapRule{Table: HoldingRegisterTable, Addresses: AddressRange{1000, 1099},
+		Target: InputRegisterTable, TargetAddress: 0, Scale: 10})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// Holding registers 0-9 appear at 2000-2009 with an offset of 100.
+	err = s.Mapping.Add(MapRule{Table: HoldingRegisterTable, Addresses: AddressRange{2000, 2009},
+		Target: HoldingRegisterTable, TargetAddress: 0, Offset: 100})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s.InputRegisters[1] = 5
+	s.InputRegisters[2] = 7
+
+	response := s.handle(mappingRequest(3, 1001, 2))
+	if exception := GetException(response); exception != Success {
+		t.Fatalf("expected Success, got %v", exception.String())
+	}
+	expect := []byte{4, 0, 50, 0, 70}
+	if !isEqual(expect, response.GetData()) {
+		t.Errorf("expected %v, got %v", expect, response.GetData())
+	}
+
+	// Writes are translated back.
+	response = s.handle(mappingRequest(16, 2003, 2, 150, 99))
+	if exception := GetException(response); exception != Success {
+		t.Fatalf("expected Success, got %v", exception.String())
+	}
+	expect = []byte{0x07, 0xD3, 0, 2}
+	if !isEqual(expect, response.GetData()) {
+		t.Errorf("expected %v, got %v", expect, response.GetData())
+	}
+	if !isEqual([]uint16{50, 0}, s.HoldingRegisters[3:5]) {
+		t.Errorf("expected %v, got %v", []uint16{50, 0}, s.HoldingRegisters[3:5])
+	}
+
+	// Input registers are read-only.
+	response = s.handle(mappingRequest(6, 1001, 3))
+	if exception := GetException(response); exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+	// Requests partly within a rule.
+	response = s.handle(mappingRequest(3, 1098, 4))
+	if exception := GetException(response); exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+	// Unmapped addresses are passed through.
+	s.HoldingRegisters[500] = 9
+	response = s.handle(mappingRequest(3, 500, 1))
+	expect = []byte{2, 0, 9}
+	if !isEqual(expect, response.GetData()) {
+		t.Errorf("expected %v, got %v", expect, response.GetData())
+	}
+}
+
+func TestMappingInvalidRules(t *testing.T) {
+	m := NewMapping()
+	err := m.Add(MapRule{Table: HoldingRegisterTable, Addresses: AddressRange{0, 9}, Target: CoilTable})
+	if err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	err = m.Add(MapRule{Table: CoilTable, Addresses: AddressRange{0, 9}, Target: CoilTable, TargetAddress: 65530})
+	if err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	m.Add(MapRule{Table: CoilTable, Addresses: AddressRange{0, 9}, Target: DiscreteInputTable})
+	err = m.Add(MapRule{Table: CoilTable, Addresses: AddressRange{9, 10}, Target: CoilTable, TargetAddress: 100})
+	if err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
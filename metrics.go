@@ -0,0 +1,290 @@
+package mbserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the handler latency histogram.
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Metrics counts server activity and exposes it in the Prometheus text
+// exposition format. All methods are safe to call on a nil *Metrics.
+type Metrics struct {
+	mutex             sync.Mutex
+	requests          map[requestKey]uint64
+	exceptions        map[Exception]uint64
+	malformedFrames   map[string]uint64
+	crcErrors         uint64
+	faults            map[Fault]uint64
+	activeConnections int
+	latency           map[uint8]*histogram
+}
+
+type requestKey struct {
+	transport string
+	unitID    uint8
+	function  uint8
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// NewMetrics creates an empty set of metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:        make(map[requestKey]uint64),
+		exceptions:      make(map[Exception]uint64),
+		malformedFrames: make(map[string]uint64),
+		faults:          make(map[Fault]uint64),
+		latency:         make(map[uint8]*histogram),
+	}
+}
+
+// observeRequest records a handled request, its exception and handler latency.
+func (m *Metrics) observeRequest(request *Request, exception Exception, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	function := request.frame.GetFunction()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.requests[requestKey{request.transport, getDevice(request.frame), function}]++
+	if exception != Success {
+		m.exceptions[exception]++
+	}
+
+	h := m.latency[function]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		m.latency[function] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// injectedFaults records the faults injected into a response.
+func (m *Metrics) injectedFaults(faults []Fault) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, fault := range faults {
+		m.faults[fault]++
+	}
+}
+
+// malformedFrame records a frame that could not be decoded.
+func (m *Metrics) malformedFrame(transport string, err error) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.malformedFrames[transport]++
+	if _, ok := err.(*crcError); ok {
+		m.crcErrors++
+	}
+}
+
+// setActiveConnections records the number of open TCP connections.
+func (m *Metrics) setActiveConnections(count int) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	m.activeConnections = count
+	m.mutex.Unlock()
+}
+
+// Stats is a summary of the metrics.
+type Stats struct {
+	Requests           uint64            `json:"requests"`
+	RequestsByUnit     map[uint8]uint64  `json:"requests_by_unit"`
+	RequestsByFunction map[uint8]uint64  `json:"requests_by_function"`
+	Exceptions         map[string]uint64 `json:"exceptions"`
+	MalformedFrames    map[string]uint64 `json:"malformed_frames"`
+	CRCErrors          uint64            `json:"crc_errors"`
+	Faults             map[string]uint64 `json:"faults"`
+	ActiveConnections  int               `json:"active_connections"`
+}
+
+// Stats returns a summary of the metrics.
+func (m *Metrics) Stats() Stats {
+	stats := Stats{
+		RequestsByUnit:     make(map[uint8]uint64),
+		RequestsByFunction: make(map[uint8]uint64),
+		Exceptions:         make(map[string]uint64),
+		MalformedFrames:    make(map[string]uint64),
+		Faults:             make(map[string]uint64),
+	}
+	if m == nil {
+		return stats
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for key, count := range m.requests {
+		stats.Requests += count
+		stats.RequestsByUnit[key.unitID] += count
+		stats.RequestsByFunction[key.function] += count
+	}
+	for exception, count := range m.exceptions {
+		stats.Exceptions[exception.String()] = count
+	}
+	for transport, count := range m.malformedFrames {
+		stats.MalformedFrames[transport] = count
+	}
+	stats.CRCErrors = m.crcErrors
+	for fault, count := range m.faults {
+		stats.Faults[fault.String()] = count
+	}
+	stats.ActiveConnections = m.activeConnections
+	return stats
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if m == nil {
+		return 0, nil
+	}
+	var b strings.Builder
+
+	m.mutex.Lock()
+
+	b.WriteString("# HELP mbserver_requests_total Modbus requests handled.\n")
+	b.WriteString("# TYPE mbserver_requests_total counter\n")
+	var keys []requestKey
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].transport != keys[j].transport {
+			return keys[i].transport < keys[j].transport
+		}
+		if keys[i].unitID != keys[j].unitID {
+			return keys[i].unitID < keys[j].unitID
+		}
+		return keys[i].function < keys[j].function
+	})
+	for _, key := range keys {
+		fmt.Fprintf(&b, "mbserver_requests_total{transport=%q,unit_id=\"%d\",function=\"%d\"} %d\n",
+			key.transport, key.unitID, key.function, m.requests[key])
+	}
+
+	b.WriteString("# HELP mbserver_exceptions_total Modbus exception responses.\n")
+	b.WriteString("# TYPE mbserver_exceptions_total counter\n")
+	var exceptions []Exception
+	for exception := range m.exceptions {
+		exceptions = append(exceptions, exception)
+	}
+	sort.Slice(exceptions, func(i, j int) bool { return exceptions[i] < exceptions[j] })
+	for _, exception := range exceptions {
+		fmt.Fprintf(&b, "mbserver_exceptions_total{code=\"%d\",exception=%q} %d\n",
+			uint8(exception), exception.String(), m.exceptions[exception])
+	}
+
+	b.WriteString("# HELP mbserver_malformed_frames_total Received frames that could not be decoded.\n")
+	b.WriteString("# TYPE mbserver_malformed_frames_total counter\n")
+	var transports []string
+	for transport := range m.malformedFrames {
+		transports = append(transports, transport)
+	}
+	sort.Strings(transports)
+	for _, transport := range transports {
+		fmt.Fprintf(&b, "mbserver_malformed_frames_total{transport=%q} %d\n", transport, m.malformedFrames[transport])
+	}
+
+	b.WriteString("# HELP mbserver_crc_errors_total Received RTU frames with a bad CRC.\n")
+	b.WriteString("# TYPE mbserver_crc_errors_total counter\n")
+	fmt.Fprintf(&b, "mbserver_crc_errors_total %d\n", m.crcErrors)
+
+	b.WriteString("# HELP mbserver_faults_total Faults injected into responses.\n")
+	b.WriteString("# TYPE mbserver_faults_total counter\n")
+	var faults []Fault
+	for fault := range m.faults {
+		faults = append(faults, fault)
+	}
+	sort.Slice(faults, func(i, j int) bool { return faults[i] < faults[j] })
+	for _, fault := range faults {
+		fmt.Fprintf(&b, "mbserver_faults_total{fault=%q} %d\n", fault.String(), m.faults[fault])
+	}
+
+	b.WriteString("# HELP mbserver_active_connections Open TCP connections.\n")
+	b.WriteString("# TYPE mbserver_active_connections gauge\n")
+	fmt.Fprintf(&b, "mbserver_active_connections %d\n", m.activeConnections)
+
+	b.WriteString("# HELP mbserver_handler_duration_seconds Time spent handling requests.\n")
+	b.WriteString("# TYPE mbserver_handler_duration_seconds histogram\n")
+	var functions []int
+	for function := range m.latency {
+		functions = append(functions, int(function))
+	}
+	sort.Ints(functions)
+	for _, function := range functions {
+		h := m.latency[uint8(function)]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(&b, "mbserver_handler_duration_seconds_bucket{function=\"%d\",le=\"%g\"} %d\n", function, bound, h.buckets[i])
+		}
+		fmt.Fprintf(&b, "mbserver_handler_duration_seconds_bucket{function=\"%d\",le=\"+Inf\"} %d\n", function, h.count)
+		fmt.Fprintf(&b, "mbserver_handler_duration_seconds_sum{function=\"%d\"} %g\n", function, h.sum)
+		fmt.Fprintf(&b, "mbserver_handler_duration_seconds_count{function=\"%d\"} %d\n", function, h.count)
+	}
+
+	m.mutex.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// ListenMetrics serves the server Metrics on http://address:port/metrics,
+// creating them if needed. Set Metrics before starting other listeners to
+// serve the metrics of a running server.
+func (s *Server) ListenMetrics(addressPort string) (err error) {
+	if s.Metrics == nil {
+		s.Metrics = NewMetrics()
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.Metrics)
+	return s.listenHTTP(addressPort, mux)
+}
+
+// listenHTTP serves the handler on "address:port" until the server is closed.
+func (s *Server) listenHTTP(addressPort string, handler http.Handler) error {
+	listen, err := net.Listen("tcp", addressPort)
+	if err != nil {
+		s.logger().Error("failed to listen", "listener", addressPort, "error", err)
+		return err
+	}
+	httpServer := &http.Server{Handler: handler}
+	s.httpServers = append(s.httpServers, httpServer)
+	go func() {
+		if err := httpServer.Serve(listen); err != nil && err != http.ErrServerClosed {
+			s.logger().Error("HTTP server error", "listener", addressPort, "error", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,70 @@
+package mbserver
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+
+	var frame TCPFrame
+	frame.Device = 1
+	frame.Function = 3
+	request := &Request{frame: &frame, transport: "tcp"}
+	m.observeRequest(request, Success, 200*time.Microsecond)
+	m.observeRequest(request, IllegalDataAddress, 2*time.Millisecond)
+
+	_, err := NewRTUFrame([]byte{0x01, 0x04, 0x02, 0xFF, 0xFF, 0xB8, 0x81})
+	m.malformedFrame("rtu", err)
+	m.setActiveConnections(2)
+
+	var b strings.Builder
+	m.WriteTo(&b)
+	got := b.String()
+
+	expect := []string{
+		`mbserver_requests_total{transport="tcp",unit_id="1",function="3"} 2`,
+		`mbserver_exceptions_total{code="2",exception="IllegalDataAddress"} 1`,
+		`mbserver_malformed_frames_total{transport="rtu"} 1`,
+		`mbserver_crc_errors_total 1`,
+		`mbserver_active_connections 2`,
+		`mbserver_handler_duration_seconds_bucket{function="3",le="0.00025"} 1`,
+		`mbserver_handler_duration_seconds_bucket{function="3",le="0.0025"} 2`,
+		`mbserver_handler_duration_seconds_count{function="3"} 2`,
+	}
+	for _, line := range expect {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("expected %q in\n%s", line, got)
+		}
+	}
+}
+
+func TestListenMetrics(t *testing.T) {
+	s := NewServer()
+	addr := getFreePort()
+	err := s.ListenMetrics(addr)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	var frame TCPFrame
+	frame.Function = 255
+	s.Metrics.observeRequest(&Request{frame: &frame, transport: "tcp"}, IllegalFunction, time.Millisecond)
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	expect := `mbserver_exceptions_total{code="1",exception="IllegalFunction"} 1`
+	if !strings.Contains(string(body), expect) {
+		t.Errorf("expected %q in\n%s", expect, body)
+	}
+}
@@ -0,0 +1,286 @@
+package mbserver
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttBuffer is the number of change events buffered for the MQTT bridge.
+// All points are republished when events are dropped.
+const mqttBuffer = 1024
+
+// mqttTimeout bounds connecting and subscribing to the broker.
+const mqttTimeout = 10 * time.Second
+
+// MQTTBridge publishes the points of a server's Profile to an MQTT broker and
+// writes the values published to their set topics.
+//
+// Each point is published to the topic Prefix/name with every change of its
+// value reported by Server.Subscribe, and on every Interval, which also picks
+// up direct writes of the application to the tables. Payloads are text:
+// "true" or "false" for bools, decimal numbers, and strings as they are.
+// Payloads published to Prefix/name/set are written to the point if it is
+// writable, with a Modbus write request passing the Policy like those of
+// clients, and published back once stored.
+type MQTTBridge struct {
+	// Broker is the URL of the broker, such as "tcp://localhost:1883" or
+	// "ssl://broker:8883".
+	Broker    string
+	ClientID  string
+	Username  string
+	Password  string
+	TLSConfig *tls.Config
+	// Prefix is the prefix of the topics, "mbserver" when empty.
+	Prefix string
+	// Points are the names of the points bridged, empty bridges all points.
+	Points []string
+	// Interval republishes all points periodically, zero publishes changes only.
+	Interval time.Duration
+	QoS      byte
+	Retain   bool
+	// UnitID is the unit ID of the write requests, the first of the
+	// profile's UnitIDs or 1 when zero.
+	UnitID    uint8
+	server    *Server
+	client    mqtt.Client
+	points    []*Point
+	events    *Subscription
+	republish chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ConnectMQTT connects the bridge to its broker and bridges the points of the
+// server's Profile until the bridge or the server is closed. The client
+// reconnects to the broker automatically and then republishes all points.
+func (s *Server) ConnectMQTT(bridge *MQTTBridge) error {
+	if s.Profile == nil {
+		return errors.New("mqtt: the server has no profile")
+	}
+	if bridge.Prefix == "" {
+		bridge.Prefix = "mbserver"
+	}
+	bridge.points = s.Profile.Points
+	if len(bridge.Points) > 0 {
+		bridge.points = nil
+		for _, name := range bridge.Points {
+			point := s.Profile.Point(name)
+			if point == nil {
+				return fmt.Errorf("mqtt: unknown point %q", name)
+			}
+			bridge.points = append(bridge.points, point)
+		}
+	}
+	for _, point := range bridge.points {
+		if strings.ContainsAny(point.Name, "+#") {
+			return fmt.Errorf("mqtt: point name %q is not a valid topic", point.Name)
+		}
+	}
+	if bridge.UnitID == 0 {
+		bridge.UnitID = 1
+		if len(s.Profile.UnitIDs) > 0 {
+			bridge.UnitID = s.Profile.UnitIDs[0]
+		}
+	}
+	bridge.server = s
+	bridge.republish = make(chan struct{}, 1)
+	bridge.stop = make(chan struct{})
+	bridge.done = make(chan struct{})
+
+	options := mqtt.NewClientOptions().
+		AddBroker(bridge.Broker).
+		SetClientID(bridge.ClientID).
+		SetUsername(bridge.Username).
+		SetPassword(bridge.Password).
+		SetTLSConfig(bridge.TLSConfig).
+		SetConnectTimeout(mqttTimeout).
+		SetOnConnectHandler(bridge.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			s.logger().Error("mqtt connection lost", "broker", bridge.Broker, "error", err)
+		})
+	bridge.client = mqtt.NewClient(options)
+	token := bridge.client.Connect()
+	if !token.WaitTimeout(mqttTimeout) {
+		bridge.client.Disconnect(0)
+		return fmt.Errorf("mqtt: timeout connecting to %s", bridge.Broker)
+	}
+	if err := token.Error(); err != nil {
+		bridge.client.Disconnect(0)
+		return fmt.Errorf("mqtt: %v", err)
+	}
+
+	s.bridgesMutex.Lock()
+	s.bridges = append(s.bridges, bridge)
+	s.bridgesMutex.Unlock()
+	bridge.events = s.Subscribe(mqttBuffer, DropOldest)
+	go bridge.run()
+	return nil
+}
+
+// Close disconnects the bridge from the broker.
+func (b *MQTTBridge) Close() {
+	b.closeOnce.Do(func() {
+		close(b.stop)
+		<-b.done
+		b.client.Disconnect(250)
+	})
+}
+
+// topic returns the topic of the point.
+func (b *MQTTBridge) topic(point *Point) string {
+	return b.Prefix + "/" + point.Name
+}
+
+// onConnect subscribes to the set topics of the writable points and has all
+// points republished.
+func (b *MQTTBridge) onConnect(client mqtt.Client) {
+	filters := make(map[string]byte)
+	handlers := make(map[string]*Point)
+	for _, point := range b.points {
+		if point.Writable() {
+			filters[b.topic(point)+"/set"] = b.QoS
+			handlers[b.topic(point)+"/set"] = point
+		}
+	}
+	if len(filters) > 0 {
+		token := client.SubscribeMultiple(filters, func(_ mqtt.Client, message mqtt.Message) {
+			if point := handlers[message.Topic()]; point != nil {
+				b.write(point, message.Payload())
+			}
+		})
+		if token.WaitTimeout(mqttTimeout) && token.Error() != nil {
+			b.server.logger().Error("mqtt subscribe failed", "broker", b.Broker, "error", token.Error())
+		}
+	}
+	select {
+	case b.republish <- struct{}{}:
+	default:
+	}
+}
+
+// write stores a payload received for the point with a Modbus request.
+func (b *MQTTBridge) write(point *Point, payload []byte) {
+	value, err := parsePayload(point, string(payload))
+	var values []uint16
+	if err == nil {
+		b.server.dataMutex.Lock()
+		values, err = point.encode(b.server, value)
+		b.server.dataMutex.Unlock()
+	}
+	if err == nil {
+		client := &Request{
+			frame:     &TCPFrame{Device: b.UnitID},
+			transport: "mqtt",
+			listener:  b.Broker,
+			client:    b.ClientID,
+		}
+		err = b.server.localWrite(client, point.table, int(point.Address), values)
+	}
+	if exception, ok := err.(Exception); ok {
+		err = errors.New(exception.String())
+	}
+	if err != nil {
+		b.server.logger().Warn("invalid mqtt write", "point", point.Name, "payload", string(payload), "error", err)
+	}
+}
+
+// parsePayload converts a text payload to a value for the point's type.
+func parsePayload(point *Point, payload string) (interface{}, error) {
+	switch point.Type {
+	case "string":
+		return payload, nil
+	case "bool":
+		return strconv.ParseBool(strings.TrimSpace(payload))
+	}
+	return json.Number(strings.TrimSpace(payload)), nil
+}
+
+// formatPayload converts a point value to a text payload.
+func formatPayload(value interface{}) string {
+	if f, ok := value.(float64); ok {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// run publishes the points changed by events, and all points on every
+// Interval, after connecting and after events were dropped, until the bridge
+// is closed.
+func (b *MQTTBridge) run() {
+	defer close(b.done)
+	defer b.events.Close()
+	var interval <-chan time.Time
+	if b.Interval > 0 {
+		ticker := time.NewTicker(b.Interval)
+		defer ticker.Stop()
+		interval = ticker.C
+	}
+
+	// values are the values of the addresses of each point, as last read or
+	// changed by events.
+	values := make(map[*Point][]uint16)
+	published := make(map[*Point]string)
+	var dropped uint64
+	for {
+		var changed []*Point
+		all := false
+		select {
+		case <-b.stop:
+			return
+		case <-b.republish:
+			all = true
+		case <-interval:
+			all = true
+		case event := <-b.events.C:
+			for _, point := range b.points {
+				current := values[point]
+				if current == nil || point.table != event.Table {
+					continue
+				}
+				first, last := int(event.Address), int(event.Address)+len(event.New)
+				for i := range current {
+					if address := int(point.Address) + i; address >= first && address < last {
+						current[i] = event.New[address-first]
+						changed = append(changed, point)
+					}
+				}
+			}
+		}
+		if n := b.events.Dropped(); n != dropped {
+			dropped, all = n, true
+		}
+
+		if all {
+			changed = b.points
+			b.server.dataMutex.Lock()
+			for _, point := range b.points {
+				values[point] = b.server.readTable(point.table, int(point.Address), point.size())
+			}
+			b.server.dataMutex.Unlock()
+		}
+		for i, point := range changed {
+			if i > 0 && changed[i-1] == point {
+				continue
+			}
+			value, err := point.decode(values[point])
+			if err != nil {
+				value = err.Error()
+			}
+			payload := formatPayload(value)
+			if last, ok := published[point]; ok && last == payload && !all {
+				continue
+			}
+			published[point] = payload
+			b.client.Publish(b.topic(point), b.QoS, b.Retain, payload)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package mbserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBroker is a minimal in-process MQTT 3.1.1 broker supporting QoS 0 and
+// 1 publishes and exact topic subscriptions.
+type testBroker struct {
+	listener  net.Listener
+	mutex     sync.Mutex
+	subs      map[string][]net.Conn
+	published chan [2]string
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	b := &testBroker{listener: listener, subs: make(map[string][]net.Conn), published: make(chan [2]string, 100)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) subscribed(topic string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.subs[topic]) > 0
+}
+
+func (b *testBroker) publish(topic, payload string) {
+	packet := append(binary.BigEndian.AppendUint16(nil, uint16(len(topic))), topic...)
+	packet = append(packet, payload...)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, conn := range b.subs[topic] {
+		writePacket(conn, 0x30, packet)
+	}
+}
+
+func writePacket(conn net.Conn, header byte, body []byte) {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	conn.Write(append(packet, body...))
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		length, shift := 0, 0
+		for {
+			digit, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			length |= int(digit&0x7F) << shift
+			shift += 7
+			if digit&0x80 == 0 {
+				break
+			}
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 1: // CONNECT
+			writePacket(conn, 0x20, []byte{0, 0})
+		case 3: // PUBLISH
+			n := int(binary.BigEndian.Uint16(body))
+			topic, rest := string(body[2:2+n]), body[2+n:]
+			if header&0x06 != 0 {
+				writePacket(conn, 0x40, rest[:2])
+				rest = rest[2:]
+			}
+			b.published <- [2]string{topic, string(rest)}
+		case 8: // SUBSCRIBE
+			ack := append([]byte(nil), body[:2]...)
+			b.mutex.Lock()
+			for rest := body[2:]; len(rest) > 2; {
+				n := int(binary.BigEndian.Uint16(rest))
+				topic := string(rest[2 : 2+n])
+				b.subs[topic] = append(b.subs[topic], conn)
+				rest = rest[3+n:]
+				ack = append(ack, 0)
+			}
+			b.mutex.Unlock()
+			writePacket(conn, 0x90, ack)
+		case 12: // PINGREQ
+			writePacket(conn, 0xD0, nil)
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+// expectPublish waits for the payload to be published to the topic.
+func (b *testBroker) expectPublish(t *testing.T, topic, payload string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case message := <-b.published:
+			if message[0] == topic && message[1] == payload {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("expected %v on %v", payload, topic)
+		}
+	}
+}
+
+func TestMQTTBridge(t *testing.T) {
+	profile, err := ParseProfile([]byte(`
+points:
+  - {name: setpoint, table: holding_registers, address: 0, type: float32, value: 20.5}
+  - {name: alarm, table: coils, address: 0, type: bool}
+  - {name: flow, table: input_registers, address: 0, type: uint16}
+`), "yaml")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s, err := NewServerFromProfile(profile)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	broker := newTestBroker(t)
+	defer broker.listener.Close()
+
+	if err := s.ConnectMQTT(&MQTTBridge{Broker: "tcp://" + broker.listener.Addr().String(), Points: []string{"level"}}); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	bridge := &MQTTBridge{Broker: "tcp://" + broker.listener.Addr().String(), ClientID: "sim", Prefix: "plant"}
+	if err := s.ConnectMQTT(bridge); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	broker.expectPublish(t, "plant/setpoint", "20.5")
+	broker.expectPublish(t, "plant/flow", "0")
+
+	// Every change is published, however quick.
+	s.dataMutex.Lock()
+	s.writeTable(InputRegisterTable, 0, []uint16{41}, ChangeEvent{Source: "test"})
+	s.writeTable(InputRegisterTable, 0, []uint16{42}, ChangeEvent{Source: "test"})
+	s.dataMutex.Unlock()
+	broker.expectPublish(t, "plant/flow", "41")
+	broker.expectPublish(t, "plant/flow", "42")
+	sub := s.Subscribe(10, DropNewest)
+
+	// Only writable points are subscribed to.
+	for !broker.subscribed("plant/alarm/set") {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if broker.subscribed("plant/flow/set") {
+		t.Errorf("expected read-only points not to be subscribed")
+	}
+	broker.publish("plant/setpoint/set", "invalid")
+	broker.publish("plant/setpoint/set", "30.25")
+	broker.publish("plant/alarm/set", "true")
+	broker.expectPublish(t, "plant/setpoint", "30.25")
+	broker.expectPublish(t, "plant/alarm", "true")
+	if s.Coils[0] != 1 {
+		t.Errorf("expected 1, got %v", s.Coils[0])
+	}
+	// Writes are Modbus requests of the bridge.
+	if event := <-sub.C; event.Client != "sim" || event.UnitID != 1 || event.Table != HoldingRegisterTable {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	s.Close()
+	bridge.Close()
+}
@@ -0,0 +1,302 @@
+package mbserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	snapshotFile  = "state.snap"
+	logFile       = "state.log"
+	snapshotMagic = "MBSTATE1"
+	// defaultSnapshotInterval is the number of logged writes after which the
+	// log is compacted into a new snapshot.
+	defaultSnapshotInterval = 10000
+	// maxLogRecord is the size of the largest possible log record.
+	maxLogRecord = 5 + 2*65535 + 4
+)
+
+// Persistence keeps the coils and holding registers of a server in a
+// directory across restarts. Every successful write request, and every write
+// by behaviors, simulations and the REST API, is appended to a write-ahead
+// log, which is compacted into a snapshot file after SnapshotInterval
+// writes. Log records are checksummed and a torn record at the end of the
+// log, left by a crash, is discarded on restore. Snapshots are replaced
+// atomically by renaming.
+type Persistence struct {
+	// SnapshotInterval is the number of logged writes after which a new
+	// snapshot is taken, 10000 when zero.
+	SnapshotInterval int
+	// NoSync skips syncing the log after each write, trading durability on
+	// power loss for speed.
+	NoSync  bool
+	dir     string
+	mutex   sync.Mutex
+	log     *os.File
+	records int
+}
+
+// OpenPersistence opens the state directory, creating it if needed. Call
+// Restore to load the state into a server before setting it as the server's
+// Persistence.
+func OpenPersistence(dir string) (*Persistence, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Persistence{dir: dir}, nil
+}
+
+// Restore loads the last snapshot into the server's coils and holding
+// registers and replays the writes logged after it.
+func (p *Persistence) Restore(s *Server) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(p.dir, snapshotFile))
+	if err == nil {
+		if err := decodeState(s, data); err != nil {
+			return fmt.Errorf("%s: %v", filepath.Join(p.dir, snapshotFile), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if p.log == nil {
+		p.log, err = os.OpenFile(filepath.Join(p.dir, logFile), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := p.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	valid, records, err := replayLog(s, bufio.NewReaderSize(p.log, maxLogRecord))
+	if err != nil {
+		return err
+	}
+	// Drop a torn record so that new records are appended after the last valid one.
+	if err := p.log.Truncate(valid); err != nil {
+		return err
+	}
+	if _, err := p.log.Seek(valid, io.SeekStart); err != nil {
+		return err
+	}
+	p.records = records
+	return nil
+}
+
+// record appends a successful write request to the log.
+func (p *Persistence) record(s *Server, frame Framer) error {
+	if p == nil {
+		return nil
+	}
+	function := frame.GetFunction()
+	if function != 5 && function != 6 && function != 15 && function != 16 {
+		return nil
+	}
+	table, _ := functionTable(function)
+	address, number, ok := requestAddressRange(frame)
+	if !ok {
+		return nil
+	}
+	return p.recordRange(s, table, address, number)
+}
+
+// recordRange appends the current values of a range of the coils or holding
+// registers to the log.
+func (p *Persistence) recordRange(s *Server, table Table, address int, number int) error {
+	if p == nil || (table != CoilTable && table != HoldingRegisterTable) {
+		return nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.log == nil {
+		return errors.New("persistence is not restored")
+	}
+
+	// Record: table, address, number, the values and the CRC-32 of all of them.
+	record := []byte{byte(table), byte(address >> 8), byte(address), byte(number >> 8), byte(number)}
+	if table == CoilTable {
+		record = append(record, s.Coils[address:address+number]...)
+	} else {
+		record = append(record, Uint16ToBytes(s.HoldingRegisters[address:address+number])...)
+	}
+	record = binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(record))
+	if _, err := p.log.Write(record); err != nil {
+		return err
+	}
+	if !p.NoSync {
+		if err := p.log.Sync(); err != nil {
+			return err
+		}
+	}
+
+	p.records++
+	interval := p.SnapshotInterval
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+	if p.records >= interval {
+		return p.snapshot(s)
+	}
+	return nil
+}
+
+// Snapshot writes the server's coils and holding registers to a new snapshot
+// between requests and empties the log.
+func (p *Persistence) Snapshot(s *Server) error {
+	s.dataMutex.Lock()
+	defer s.dataMutex.Unlock()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.snapshot(s)
+}
+
+func (p *Persistence) snapshot(s *Server) error {
+	filename := filepath.Join(p.dir, snapshotFile)
+	if err := writeFileSync(filename, encodeState(s)); err != nil {
+		return err
+	}
+	if p.log != nil {
+		// Replaying the log onto the new snapshot is harmless should the
+		// truncation not survive a crash.
+		if err := p.log.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := p.log.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	p.records = 0
+	return nil
+}
+
+// Close syncs and closes the log.
+func (p *Persistence) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.log == nil {
+		return nil
+	}
+	err := p.log.Sync()
+	if closeErr := p.log.Close(); err == nil {
+		err = closeErr
+	}
+	p.log = nil
+	return err
+}
+
+// encodeState returns the snapshot of the coils, packed eight per byte, and
+// holding registers followed by a CRC-32.
+func encodeState(s *Server) []byte {
+	data := make([]byte, 0, len(snapshotMagic)+len(s.Coils)/8+2*len(s.HoldingRegisters)+4)
+	data = append(data, snapshotMagic...)
+	packed := make([]byte, len(s.Coils)/8)
+	for i, coil := range s.Coils {
+		if coil != 0 {
+			packed[i/8] |= 1 << (uint(i) % 8)
+		}
+	}
+	data = append(data, packed...)
+	data = append(data, Uint16ToBytes(s.HoldingRegisters)...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+}
+
+func decodeState(s *Server, data []byte) error {
+	size := len(snapshotMagic) + len(s.Coils)/8 + 2*len(s.HoldingRegisters) + 4
+	if len(data) != size || !bytes.HasPrefix(data, []byte(snapshotMagic)) {
+		return errors.New("not a snapshot file")
+	}
+	if crc32.ChecksumIEEE(data[:size-4]) != binary.BigEndian.Uint32(data[size-4:]) {
+		return errors.New("snapshot checksum mismatch")
+	}
+	data = data[len(snapshotMagic):]
+	for i := range s.Coils {
+		s.Coils[i] = (data[i/8] >> (uint(i) % 8)) & 1
+	}
+	data = data[len(s.Coils)/8:]
+	copy(s.HoldingRegisters, BytesToUint16(data[:2*len(s.HoldingRegisters)]))
+	return nil
+}
+
+// replayLog applies the valid records of the log and returns the length of
+// the valid part and the number of records in it.
+func replayLog(s *Server, r *bufio.Reader) (int64, int, error) {
+	var valid int64
+	var records int
+	for {
+		header, err := r.Peek(5)
+		if err != nil {
+			return valid, records, nil
+		}
+		table := Table(header[0])
+		address := int(binary.BigEndian.Uint16(header[1:3]))
+		number := int(binary.BigEndian.Uint16(header[3:5]))
+		size := number
+		if table == HoldingRegisterTable {
+			size *= 2
+		} else if table != CoilTable {
+			return valid, records, nil
+		}
+		if address+number > 65536 {
+			return valid, records, nil
+		}
+		record, err := r.Peek(5 + size + 4)
+		if err != nil {
+			return valid, records, nil
+		}
+		if crc32.ChecksumIEEE(record[:5+size]) != binary.BigEndian.Uint32(record[5+size:]) {
+			return valid, records, nil
+		}
+
+		values := record[5 : 5+size]
+		if table == CoilTable {
+			copy(s.Coils[address:], values)
+		} else {
+			copy(s.HoldingRegisters[address:], BytesToUint16(values))
+		}
+		if _, err := r.Discard(len(record)); err != nil {
+			return valid, records, err
+		}
+		valid += int64(len(record))
+		records++
+	}
+}
+
+// writeFileSync atomically replaces the file with the data by writing and
+// syncing a temporary file and renaming it.
+func writeFileSync(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	// Sync the directory so that the rename is durable.
+	if dir, err := os.Open(filepath.Dir(filename)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
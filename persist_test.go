@@ -0,0 +1,125 @@
+package mbserver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func persistentServer(t *testing.T, dir string) (*Server, *Persistence) {
+	p, err := OpenPersistence(dir)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s := NewServer()
+	if err := p.Restore(s); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s.Persistence = p
+	return s, p
+}
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	s, p := persistentServer(t, dir)
+	s.handle(gatewayRequest(1, 6, 10, 1234))
+	s.handle(gatewayRequest(1, 5, 3, 0xFF00))
+
+	var frame TCPFrame
+	frame.Function = 16
+	SetDataWithRegisterAndNumberAndValues(&frame, 100, 3, []uint16{7, 8, 9})
+	s.handle(&Request{frame: &frame})
+	frame.Function = 15
+	SetDataWithRegisterAndNumberAndBytes(&frame, 20, 10, []byte{0xFF, 0x01})
+	s.handle(&Request{frame: &frame})
+
+	// Failed writes are not recorded.
+	frame.Function = 16
+	SetDataWithRegisterAndNumberAndValues(&frame, 65535, 2, []uint16{1, 2})
+	s.handle(&Request{frame: &frame})
+	p.Close()
+	s.Close()
+
+	s, p = persistentServer(t, dir)
+	defer s.Close()
+	defer p.Close()
+	if s.HoldingRegisters[10] != 1234 || s.Coils[3] != 1 {
+		t.Errorf("expected 1234 and 1, got %v and %v", s.HoldingRegisters[10], s.Coils[3])
+	}
+	if !isEqual([]uint16{7, 8, 9}, s.HoldingRegisters[100:103]) {
+		t.Errorf("expected %v, got %v", []uint16{7, 8, 9}, s.HoldingRegisters[100:103])
+	}
+	expect := []byte{1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0}
+	if !isEqual(expect, s.Coils[20:31]) {
+		t.Errorf("expected %v, got %v", expect, s.Coils[20:31])
+	}
+}
+
+func TestPersistenceSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	s, p := persistentServer(t, dir)
+	p.SnapshotInterval = 2
+	for i := uint16(0); i < 3; i++ {
+		s.handle(gatewayRequest(1, 6, i, i+1))
+	}
+	p.Close()
+	s.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, "state.snap")); err != nil {
+		t.Fatalf("expected a snapshot, got %v", err)
+	}
+	info, _ := os.Stat(filepath.Join(dir, "state.log"))
+	if info.Size() != 11 {
+		t.Errorf("expected one record of 11 bytes, got %v", info.Size())
+	}
+
+	s, p = persistentServer(t, dir)
+	defer s.Close()
+	defer p.Close()
+	if !isEqual([]uint16{1, 2, 3}, s.HoldingRegisters[0:3]) {
+		t.Errorf("expected %v, got %v", []uint16{1, 2, 3}, s.HoldingRegisters[0:3])
+	}
+}
+
+func TestPersistenceTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	s, p := persistentServer(t, dir)
+	s.handle(gatewayRequest(1, 6, 1, 11))
+	p.Close()
+	s.Close()
+
+	// A crash in the middle of appending the next record.
+	f, _ := os.OpenFile(filepath.Join(dir, "state.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{byte(HoldingRegisterTable), 0, 2, 0, 1, 0})
+	f.Close()
+
+	s, p = persistentServer(t, dir)
+	if s.HoldingRegisters[1] != 11 {
+		t.Errorf("expected 11, got %v", s.HoldingRegisters[1])
+	}
+	s.handle(gatewayRequest(1, 6, 2, 22))
+	p.Close()
+	s.Close()
+
+	s, p = persistentServer(t, dir)
+	defer s.Close()
+	defer p.Close()
+	if !isEqual([]uint16{11, 22}, s.HoldingRegisters[1:3]) {
+		t.Errorf("expected %v, got %v", []uint16{11, 22}, s.HoldingRegisters[1:3])
+	}
+}
+
+func TestPersistenceCorruptSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "state.snap"), []byte("MBSTATE1"), 0644)
+	p, err := OpenPersistence(dir)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer p.Close()
+	s := NewServer()
+	defer s.Close()
+	if err := p.Restore(s); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package mbserver
+
+import (
+	"fmt"
+	"log"
+	"net"
+)
+
+// AddressRange is an inclusive range of Modbus addresses.
+type AddressRange struct {
+	First uint16
+	Last  uint16
+}
+
+// contains reports whether all of the addresses [address, address+number) are in the range.
+func (r AddressRange) contains(address int, number int) bool {
+	return address >= int(r.First) && address+number-1 <= int(r.Last)
+}
+
+// overlaps reports whether any of the addresses [address, address+number) are in the range.
+func (r AddressRange) overlaps(address int, number int) bool {
+	return address <= int(r.Last) && address+number-1 >= int(r.First)
+}
+
+// PolicyRule matches requests to allow or deny. Empty fields match any request.
+type PolicyRule struct {
+	// Allow permits matching requests, otherwise they are denied.
+	Allow bool
+	// Listener is the listening address ("0.0.0.0:502") or serial device ("/dev/ttyUSB0").
+	Listener string
+	// UnitIDs are the unit identifiers (slave addresses) the rule applies to.
+	UnitIDs []uint8
+	// Clients are client IP addresses, CIDR blocks or TLS certificate common names.
+	Clients []string
+	// Functions are the Modbus function codes the rule applies to.
+	Functions []uint8
+	// Addresses restricts the rule to requests accessing the address range.
+	// An allow rule matches requests entirely within the range, a deny rule
+	// matches requests touching any address in the range.
+	Addresses *AddressRange
+}
+
+type policyRule struct {
+	PolicyRule
+	networks []*net.IPNet
+	names    []string
+}
+
+// Policy is an ordered list of rules evaluated before a request is passed to
+// its function handler. The first matching rule decides; requests matching no
+// rule are allowed when DefaultAllow is set. Denied requests are answered
+// with IllegalDataAddress when the deciding rule restricts addresses, and
+// IllegalFunction otherwise.
+type Policy struct {
+	DefaultAllow bool
+	// AuditLog receives a line for every denied request. The server Logger is used when nil.
+	AuditLog *log.Logger
+	rules    []policyRule
+}
+
+// NewPolicy creates a policy without rules.
+func NewPolicy(defaultAllow bool) *Policy {
+	return &Policy{DefaultAllow: defaultAllow}
+}
+
+// AddRule appends a rule to the policy.
+func (p *Policy) AddRule(rule PolicyRule) error {
+	if rule.Addresses != nil && rule.Addresses.First > rule.Addresses.Last {
+		return fmt.Errorf("policy address range %d-%d is empty", rule.Addresses.First, rule.Addresses.Last)
+	}
+
+	compiled := policyRule{PolicyRule: rule}
+	for _, client := range rule.Clients {
+		if network, err := parseCIDR(client); err == nil {
+			compiled.networks = append(compiled.networks, network)
+		} else {
+			compiled.names = append(compiled.names, client)
+		}
+	}
+	p.rules = append(p.rules, compiled)
+	return nil
+}
+
+// check returns nil if the request is allowed, otherwise the exception to
+// respond with.
+func (p *Policy) check(request *Request, logger Logger) *Exception {
+	unitID := getDevice(request.frame)
+	function := request.frame.GetFunction()
+	address, number, hasAddress := requestAddressRange(request.frame)
+
+	for _, rule := range p.rules {
+		if rule.Listener != "" && rule.Listener != request.listener {
+			continue
+		}
+		if len(rule.UnitIDs) > 0 && !containsUint8(rule.UnitIDs, unitID) {
+			continue
+		}
+		if len(rule.Functions) > 0 && !containsUint8(rule.Functions, function) {
+			continue
+		}
+		if len(rule.Clients) > 0 && !rule.matchClient(request) {
+			continue
+		}
+		if rule.Addresses != nil {
+			if !hasAddress {
+				continue
+			}
+			if rule.Allow && !rule.Addresses.contains(address, number) {
+				continue
+			}
+			if !rule.Allow && !rule.Addresses.overlaps(address, number) {
+				continue
+			}
+		}
+
+		if rule.Allow {
+			return nil
+		}
+		exception := &IllegalFunction
+		if rule.Addresses != nil {
+			exception = &IllegalDataAddress
+		}
+		p.audit(request, exception, logger)
+		return exception
+	}
+
+	if p.DefaultAllow {
+		return nil
+	}
+	p.audit(request, &IllegalFunction, logger)
+	return &IllegalFunction
+}
+
+func (rule *policyRule) matchClient(request *Request) bool {
+	ip := net.ParseIP(request.client)
+	for _, network := range rule.networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	for _, name := range rule.names {
+		if request.identity != "" && name == request.identity {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) audit(request *Request, exception *Exception, logger Logger) {
+	address, number, _ := requestAddressRange(request.frame)
+	if p.AuditLog == nil {
+		logger.Warn("policy denied request", append(requestFields(request),
+			"address", address, "quantity", number, "exception", exception.String())...)
+		return
+	}
+	p.AuditLog.Printf("policy denied function %d unit %d addresses %d+%d from %q (%s) on %q: %v\n",
+		request.frame.GetFunction(), getDevice(request.frame), address, number,
+		request.client, request.identity, request.listener, exception.String())
+}
+
+func containsUint8(values []uint8, value uint8) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
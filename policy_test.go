@@ -0,0 +1,73 @@
+package mbserver
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func policyRequest(function uint8, device uint8, register uint16, number uint16, client string) *Request {
+	var frame TCPFrame
+	frame.Device = device
+	frame.Function = function
+	SetDataWithRegisterAndNumber(&frame, register, number)
+	return &Request{frame: &frame, listener: "0.0.0.0:502", client: client}
+}
+
+func TestPolicy(t *testing.T) {
+	var audit bytes.Buffer
+	policy := NewPolicy(false)
+	policy.AuditLog = log.New(&audit, "", 0)
+
+	// Holding registers 100-199 are protected.
+	err := policy.AddRule(PolicyRule{Functions: []uint8{6, 16}, Addresses: &AddressRange{100, 199}})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// Engineering workstations may write to unit 1.
+	err = policy.AddRule(PolicyRule{Allow: true, UnitIDs: []uint8{1}, Clients: []string{"10.0.5.0/24"}})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	// Everyone may read.
+	err = policy.AddRule(PolicyRule{Allow: true, Functions: []uint8{1, 2, 3, 4}})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	s := NewServer()
+	s.Policy = policy
+
+	tests := []struct {
+		request *Request
+		expect  Exception
+	}{
+		{policyRequest(3, 1, 0, 10, "10.0.9.1"), Success},
+		{policyRequest(6, 1, 10, 7, "10.0.5.20"), Success},
+		{policyRequest(16, 1, 95, 10, "10.0.5.20"), IllegalDataAddress},
+		{policyRequest(6, 1, 10, 7, "10.0.9.1"), IllegalFunction},
+		{policyRequest(6, 2, 10, 7, "10.0.5.20"), IllegalFunction},
+	}
+	for i, test := range tests {
+		response := s.handle(test.request)
+		exception := GetException(response)
+		if exception != test.expect {
+			t.Errorf("%d: expected %v, got %v", i, test.expect.String(), exception.String())
+		}
+	}
+
+	if !strings.Contains(audit.String(), "policy denied function 16 unit 1 addresses 95+10") {
+		t.Errorf("expected audit log entry, got %q", audit.String())
+	}
+	if lines := strings.Count(audit.String(), "\n"); lines != 3 {
+		t.Errorf("expected 3 audit log entries, got %v", lines)
+	}
+}
+
+func TestPolicyBadAddressRange(t *testing.T) {
+	err := NewPolicy(true).AddRule(PolicyRule{Addresses: &AddressRange{10, 9}})
+	if err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
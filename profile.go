@@ -0,0 +1,766 @@
+package mbserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Profile describes a simulated device: the unit IDs it answers, the address
+// ranges and named points it exposes with their initial values and access
+// modes, the function codes it supports and its identification. Profiles are
+// read from YAML or JSON files with LoadProfile.
+//
+// When a profile declares ranges or points, requests for any other address are
+// answered with IllegalDataAddress, as are writes to read-only addresses.
+type Profile struct {
+	Name string `json:"name" yaml:"name"`
+	// UnitIDs are the unit identifiers answered, empty answers all.
+	UnitIDs []uint8 `json:"unit_ids" yaml:"unit_ids"`
+	// Order is the default word order of points, "ABCD" when empty.
+	Order string `json:"order" yaml:"order"`
+	// Functions are the supported function codes, empty keeps the defaults.
+	Functions      []uint8               `json:"functions" yaml:"functions"`
+	Identification *DeviceIdentification `json:"identification" yaml:"identification"`
+	Ranges         []ProfileRange        `json:"ranges" yaml:"ranges"`
+	Points         []*Point              `json:"points" yaml:"points"`
+	// Simulations drive points over time once started with Server.Simulate.
+	Simulations []*Simulation `json:"simulations" yaml:"simulations"`
+	// Behaviors run scripts on writes and timers once started with Server.Behave.
+	Behaviors []*Behavior `json:"behaviors" yaml:"behaviors"`
+	order     WordOrder
+	points    map[string]*Point
+}
+
+// ProfileRange is a range of addresses of one table.
+type ProfileRange struct {
+	// Table is "coils", "discrete_inputs", "holding_registers" or "input_registers".
+	Table string `json:"table" yaml:"table"`
+	First uint16 `json:"first" yaml:"first"`
+	Last  uint16 `json:"last" yaml:"last"`
+	// Access is "read" or "read-write". Coils and holding registers default
+	// to "read-write", discrete inputs and input registers are read-only.
+	Access string `json:"access" yaml:"access"`
+	// Value initializes every address of the range, Values the addresses
+	// from First on.
+	Value  interface{}   `json:"value" yaml:"value"`
+	Values []interface{} `json:"values" yaml:"values"`
+	table  Table
+	write  bool
+}
+
+// Point is a named, typed value stored at an address of one table.
+type Point struct {
+	Name    string `json:"name" yaml:"name"`
+	Table   string `json:"table" yaml:"table"`
+	Address uint16 `json:"address" yaml:"address"`
+	// Type is "bool" for coils and discrete inputs, or one of "uint16",
+	// "int16", "uint32", "int32", "uint64", "int64", "float32", "float64",
+	// "bcd16", "bcd32" and "string" for registers.
+	Type string `json:"type" yaml:"type"`
+	// Order overrides the profile's word order.
+	Order string `json:"order" yaml:"order"`
+	// Length is the number of registers of a string.
+	Length int    `json:"length" yaml:"length"`
+	Access string `json:"access" yaml:"access"`
+	// Value is the initial value.
+	Value interface{} `json:"value" yaml:"value"`
+	table Table
+	order WordOrder
+	write bool
+}
+
+// pointSizes are the number of registers of each point type.
+var pointSizes = map[string]int{
+	"bool": 1, "uint16": 1, "int16": 1, "bcd16": 1,
+	"uint32": 2, "int32": 2, "float32": 2, "bcd32": 2,
+	"uint64": 4, "int64": 4, "float64": 4,
+}
+
+// LoadProfile reads and validates a profile from a YAML (".yaml", ".yml") or
+// JSON (".json") file.
+func LoadProfile(filename string) (*Profile, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var format string
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		format = "json"
+	case ".yaml", ".yml":
+		format = "yaml"
+	default:
+		return nil, fmt.Errorf("%s: unknown profile format, expected .yaml, .yml or .json", filename)
+	}
+	profile, err := ParseProfile(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return profile, nil
+}
+
+// ParseProfile parses and validates a profile in the format "yaml" or "json".
+func ParseProfile(data []byte, format string) (*Profile, error) {
+	profile := &Profile{}
+	switch format {
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		decoder.UseNumber()
+		if err := decoder.Decode(profile); err != nil {
+			return nil, jsonError(data, err)
+		}
+	case "yaml":
+		if err := yaml.UnmarshalStrict(data, profile); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown profile format %q", format)
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// jsonError adds the line and column to JSON syntax and type errors.
+func jsonError(data []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	// The offset is just past the offending character or value.
+	column := int(offset) - 1 - bytes.LastIndexByte(data[:offset], '\n')
+	return fmt.Errorf("line %d column %d: %v", line, column, err)
+}
+
+// Validate checks the profile and resolves its names. Errors name the
+// offending field, such as "points[2] (flow): unknown type \"float\"".
+func (p *Profile) Validate() error {
+	var err error
+	p.order = OrderABCD
+	if p.Order != "" {
+		if p.order, err = ParseWordOrder(p.Order); err != nil {
+			return fmt.Errorf("order: %v", err)
+		}
+	}
+
+	for i, fn := range p.Functions {
+		switch fn {
+		case 1, 2, 3, 4, 5, 6, 15, 16:
+		case 43:
+			if p.Identification == nil {
+				return fmt.Errorf("functions[%d]: function 43 requires identification", i)
+			}
+		default:
+			return fmt.Errorf("functions[%d]: unsupported function %d", i, fn)
+		}
+	}
+	if id := p.Identification; id != nil {
+		for i, value := range id.objects() {
+			if i <= 2 && value == "" {
+				return fmt.Errorf("identification: %s is required", []string{"vendor_name", "product_code", "revision"}[i])
+			}
+			if len(value) > 245 {
+				return fmt.Errorf("identification: object %d is longer than 245 characters", i)
+			}
+		}
+	}
+
+	for i := range p.Ranges {
+		r := &p.Ranges[i]
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("ranges[%d] (%s %d-%d): %v", i, r.Table, r.First, r.Last, err)
+		}
+	}
+
+	p.points = make(map[string]*Point)
+	for i, point := range p.Points {
+		if point == nil {
+			return fmt.Errorf("points[%d]: empty point", i)
+		}
+		if err := point.validate(p.order); err != nil {
+			return fmt.Errorf("points[%d] (%s): %v", i, point.Name, err)
+		}
+		if _, ok := p.points[point.Name]; ok {
+			return fmt.Errorf("points[%d] (%s): duplicate name", i, point.Name)
+		}
+		for j, other := range p.Points[:i] {
+			if other.table == point.table && other.addresses().overlaps(int(point.Address), point.size()) {
+				return fmt.Errorf("points[%d] (%s): addresses %d-%d overlap points[%d] (%s)", i, point.Name,
+					point.Address, point.addresses().Last, j, other.Name)
+			}
+		}
+		p.points[point.Name] = point
+	}
+
+	for i, sim := range p.Simulations {
+		if sim == nil {
+			return fmt.Errorf("simulations[%d]: empty simulation", i)
+		}
+		if err := sim.validate(p); err != nil {
+			return fmt.Errorf("simulations[%d] (%s): %v", i, sim.Point, err)
+		}
+	}
+
+	for i, b := range p.Behaviors {
+		if b == nil {
+			return fmt.Errorf("behaviors[%d]: empty behavior", i)
+		}
+		if err := b.validate(p); err != nil {
+			return fmt.Errorf("behaviors[%d] (%s): %v", i, b.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *ProfileRange) validate() error {
+	var err error
+	if r.table, err = ParseTable(r.Table); err != nil {
+		return err
+	}
+	if r.First > r.Last {
+		return errors.New("first address is after last address")
+	}
+	if r.write, err = parseAccess(r.Access, r.table); err != nil {
+		return err
+	}
+	if len(r.Values) > int(r.Last-r.First)+1 {
+		return fmt.Errorf("%d values exceed the range of %d addresses", len(r.Values), int(r.Last-r.First)+1)
+	}
+	if r.Value != nil {
+		if _, err := rangeValue(r.table, r.Value); err != nil {
+			return fmt.Errorf("value: %v", err)
+		}
+	}
+	for i, value := range r.Values {
+		if _, err := rangeValue(r.table, value); err != nil {
+			return fmt.Errorf("values[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (point *Point) validate(order WordOrder) error {
+	var err error
+	if point.Name == "" {
+		return errors.New("name is required")
+	}
+	if point.table, err = ParseTable(point.Table); err != nil {
+		return err
+	}
+	if point.write, err = parseAccess(point.Access, point.table); err != nil {
+		return err
+	}
+	point.order = order
+	if point.Order != "" {
+		if point.order, err = ParseWordOrder(point.Order); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case point.Type == "string":
+		if point.Length <= 0 {
+			return errors.New("type string requires a length")
+		}
+	case pointSizes[point.Type] == 0:
+		return fmt.Errorf("unknown type %q", point.Type)
+	case point.Length != 0:
+		return fmt.Errorf("length is only valid for type string")
+	}
+	if isBitTable(point.table) != (point.Type == "bool") {
+		return fmt.Errorf("type %s cannot be stored in %v", point.Type, point.table)
+	}
+	if int(point.Address)+point.size()-1 > 65535 {
+		return fmt.Errorf("type %s at address %d exceeds the %v table", point.Type, point.Address, point.table)
+	}
+	if point.Value != nil {
+		// Check the value by storing it in scratch registers.
+		registers := make([]uint16, point.size())
+		if err := point.store(NewRegisterView(registers, point.order), 0, point.Value); err != nil {
+			return fmt.Errorf("value: %v", err)
+		}
+	}
+	return nil
+}
+
+// parseAccess reports whether the access mode allows writes.
+func parseAccess(access string, table Table) (bool, error) {
+	writable := table == CoilTable || table == HoldingRegisterTable
+	switch access {
+	case "":
+		return writable, nil
+	case "read":
+		return false, nil
+	case "read-write":
+		if !writable {
+			return false, fmt.Errorf("%v are read-only", table)
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown access %q, expected read or read-write", access)
+}
+
+// rangeValue converts a range value to a register value, or 0 or 1 for bit tables.
+func rangeValue(table Table, value interface{}) (uint16, error) {
+	if isBitTable(table) {
+		on, err := toBool(value)
+		if on {
+			return 1, err
+		}
+		return 0, err
+	}
+	n, err := toInt(value, 0, math.MaxUint16)
+	return uint16(n), err
+}
+
+// Point returns the point with the name, or nil.
+func (p *Profile) Point(name string) *Point {
+	return p.points[name]
+}
+
+// size returns the number of addresses of the point.
+func (point *Point) size() int {
+	if point.Type == "string" {
+		return point.Length
+	}
+	return pointSizes[point.Type]
+}
+
+func (point *Point) addresses() AddressRange {
+	return AddressRange{point.Address, uint16(int(point.Address) + point.size() - 1)}
+}
+
+// Writable reports whether clients may write the point.
+func (point *Point) Writable() bool {
+	return point.write
+}
+
+// Apply initializes the server's tables and restricts its unit IDs,
+// addresses and functions to those of the profile. The restrictions replace
+// the server's Policy.
+func (p *Profile) Apply(s *Server) error {
+	if p.points == nil {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range p.Ranges {
+		if r.Value != nil {
+			value, _ := rangeValue(r.table, r.Value)
+			for address := int(r.First); address <= int(r.Last); address++ {
+				setTableValue(s, r.table, address, value)
+			}
+		}
+		for i, v := range r.Values {
+			value, _ := rangeValue(r.table, v)
+			setTableValue(s, r.table, int(r.First)+i, value)
+		}
+	}
+	for _, point := range p.Points {
+		if point.Value != nil {
+			if err := point.Set(s, point.Value); err != nil {
+				return fmt.Errorf("point %s: %v", point.Name, err)
+			}
+		}
+	}
+
+	if len(p.Functions) > 0 {
+		for fn := range s.function {
+			if !containsUint8(p.Functions, uint8(fn)) {
+				s.function[fn] = nil
+			}
+		}
+	}
+	if p.Identification != nil {
+		s.Identification = p.Identification
+	}
+	if policy := p.policy(); policy != nil {
+		s.Policy = policy
+	}
+	s.Profile = p
+	return nil
+}
+
+// NewServerFromProfile creates a server and applies the profile to it.
+func NewServerFromProfile(p *Profile) (*Server, error) {
+	s := NewServer()
+	if err := p.Apply(s); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func setTableValue(s *Server, table Table, address int, value uint16) {
+	switch table {
+	case CoilTable:
+		s.Coils[address] = byte(value)
+	case DiscreteInputTable:
+		s.DiscreteInputs[address] = byte(value)
+	case HoldingRegisterTable:
+		s.HoldingRegisters[address] = value
+	case InputRegisterTable:
+		s.InputRegisters[address] = value
+	}
+}
+
+// profileArea is a range of declared addresses of a table.
+type profileArea struct {
+	table     Table
+	addresses AddressRange
+	write     bool
+}
+
+// policy returns the policy enforcing the profile's unit IDs, address ranges
+// and access modes, or nil if the profile restricts neither.
+func (p *Profile) policy() *Policy {
+	var areas []profileArea
+	for _, r := range p.Ranges {
+		areas = append(areas, profileArea{r.table, AddressRange{r.First, r.Last}, r.write})
+	}
+	for _, point := range p.Points {
+		areas = append(areas, profileArea{point.table, point.addresses(), point.write})
+	}
+	if len(areas) == 0 && len(p.UnitIDs) == 0 {
+		return nil
+	}
+
+	policy := NewPolicy(len(p.UnitIDs) == 0)
+	tableFunctions := map[Table][]uint8{
+		CoilTable:            {1, 5, 15},
+		DiscreteInputTable:   {2},
+		HoldingRegisterTable: {3, 6, 16},
+		InputRegisterTable:   {4},
+	}
+
+	// Writes touching read-only addresses are denied first.
+	for _, area := range areas {
+		if !area.write && (area.table == CoilTable || area.table == HoldingRegisterTable) {
+			addresses := area.addresses
+			policy.AddRule(PolicyRule{UnitIDs: p.UnitIDs, Functions: tableFunctions[area.table][1:], Addresses: &addresses})
+		}
+	}
+	// Requests within contiguous declared addresses are allowed, others denied.
+	if len(areas) > 0 {
+		for _, table := range []Table{CoilTable, DiscreteInputTable, HoldingRegisterTable, InputRegisterTable} {
+			for _, span := range mergeAreas(areas, table) {
+				span := span
+				policy.AddRule(PolicyRule{Allow: true, UnitIDs: p.UnitIDs, Functions: tableFunctions[table], Addresses: &span})
+			}
+			policy.AddRule(PolicyRule{UnitIDs: p.UnitIDs, Functions: tableFunctions[table], Addresses: &AddressRange{0, 65535}})
+		}
+	}
+	// Other functions are allowed for the profile's unit IDs.
+	if len(p.UnitIDs) > 0 {
+		policy.AddRule(PolicyRule{Allow: true, UnitIDs: p.UnitIDs})
+	}
+	return policy
+}
+
+// mergeAreas returns the contiguous address ranges covered by the areas of the table.
+func mergeAreas(areas []profileArea, table Table) []AddressRange {
+	var ranges []AddressRange
+	for _, area := range areas {
+		if area.table == table {
+			ranges = append(ranges, area.addresses)
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].First < ranges[j].First })
+
+	var merged []AddressRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && int(r.First) <= int(merged[n-1].Last)+1 {
+			if r.Last > merged[n-1].Last {
+				merged[n-1].Last = r.Last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Get returns the point's value from the server's tables: a bool, string,
+// float64 for the float types, int64 for the signed and uint64 for the
+// unsigned and BCD types.
+func (point *Point) Get(s *Server) (interface{}, error) {
+	return point.decode(s.readTable(point.table, int(point.Address), point.size()))
+}
+
+// decode returns the point's value from the values of its addresses.
+func (point *Point) decode(values []uint16) (interface{}, error) {
+	if isBitTable(point.table) {
+		return values[0] != 0, nil
+	}
+	v := NewRegisterView(values, point.order)
+	address := uint16(0)
+	switch point.Type {
+	case "uint16":
+		return uint64(v.registers[address]), nil
+	case "int16":
+		return int64(int16(v.registers[address])), nil
+	case "uint32":
+		return uint64(v.Uint32(address)), nil
+	case "int32":
+		return int64(v.Int32(address)), nil
+	case "uint64":
+		return v.Uint64(address), nil
+	case "int64":
+		return v.Int64(address), nil
+	case "float32":
+		return float64(v.Float32(address)), nil
+	case "float64":
+		return v.Float64(address), nil
+	case "bcd16":
+		value, err := v.BCD16(address)
+		return uint64(value), err
+	case "bcd32":
+		value, err := v.BCD32(address)
+		return uint64(value), err
+	case "string":
+		return v.String(address, point.Length), nil
+	}
+	return nil, fmt.Errorf("unknown type %q", point.Type)
+}
+
+// Set stores a value in the server's tables. Numbers may be given as any Go
+// integer or float type, or a json.Number, and must be in the point type's range.
+func (point *Point) Set(s *Server, value interface{}) error {
+	switch point.table {
+	case CoilTable, DiscreteInputTable:
+		on, err := toBool(value)
+		if err != nil {
+			return err
+		}
+		bits := s.Coils
+		if point.table == DiscreteInputTable {
+			bits = s.DiscreteInputs
+		}
+		bits[point.Address] = 0
+		if on {
+			bits[point.Address] = 1
+		}
+		return nil
+	}
+	return point.store(NewRegisterView(point.registers(s), point.order), point.Address, value)
+}
+
+// encode returns the values of the point's addresses holding the value.
+func (point *Point) encode(s *Server, value interface{}) ([]uint16, error) {
+	switch point.table {
+	case CoilTable, DiscreteInputTable:
+		on, err := toBool(value)
+		if err != nil {
+			return nil, err
+		}
+		if on {
+			return []uint16{1}, nil
+		}
+		return []uint16{0}, nil
+	}
+	registers := s.readTable(point.table, int(point.Address), point.size())
+	if err := point.store(NewRegisterView(registers, point.order), 0, value); err != nil {
+		return nil, err
+	}
+	return registers, nil
+}
+
+// writePoint stores the value of the point like writeTable. The caller holds
+// the data lock.
+func (s *Server) writePoint(point *Point, value interface{}, writer ChangeEvent) error {
+	values, err := point.encode(s, value)
+	if err != nil {
+		return err
+	}
+	return s.writeTable(point.table, int(point.Address), values, writer)
+}
+
+func (point *Point) registers(s *Server) []uint16 {
+	if point.table == InputRegisterTable {
+		return s.InputRegisters
+	}
+	return s.HoldingRegisters
+}
+
+// store stores a register value at the address of the view.
+func (point *Point) store(v *RegisterView, address uint16, value interface{}) error {
+	if point.Type == "bool" {
+		_, err := toBool(value)
+		return err
+	}
+	if point.Type == "string" {
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected a string, got %v", value)
+		}
+		if len(str) > 2*point.Length {
+			return fmt.Errorf("string %q is longer than %d characters", str, 2*point.Length)
+		}
+		v.SetString(address, point.Length, str)
+		return nil
+	}
+	if point.Type == "float32" || point.Type == "float64" {
+		f, err := toFloat(value)
+		if err != nil {
+			return err
+		}
+		if point.Type == "float32" {
+			v.SetFloat32(address, float32(f))
+		} else {
+			v.SetFloat64(address, f)
+		}
+		return nil
+	}
+
+	limits := map[string][2]float64{
+		"uint16": {0, math.MaxUint16}, "int16": {math.MinInt16, math.MaxInt16},
+		"uint32": {0, math.MaxUint32}, "int32": {math.MinInt32, math.MaxInt32},
+		"uint64": {0, math.MaxUint64}, "int64": {math.MinInt64, math.MaxInt64},
+		"bcd16": {0, 9999}, "bcd32": {0, 99999999},
+	}[point.Type]
+	if point.Type == "uint64" {
+		n, err := toUint64(value)
+		if err != nil {
+			return err
+		}
+		v.SetUint64(address, n)
+		return nil
+	}
+	n, err := toInt(value, limits[0], limits[1])
+	if err != nil {
+		return err
+	}
+	switch point.Type {
+	case "uint16", "int16":
+		v.registers[address] = uint16(n)
+	case "uint32":
+		v.SetUint32(address, uint32(n))
+	case "int32":
+		v.SetInt32(address, int32(n))
+	case "int64":
+		v.SetInt64(address, n)
+	case "bcd16":
+		return v.SetBCD16(address, uint16(n))
+	case "bcd32":
+		return v.SetBCD32(address, uint32(n))
+	}
+	return nil
+}
+
+func toBool(value interface{}) (bool, error) {
+	if b, ok := value.(bool); ok {
+		return b, nil
+	}
+	n, err := toInt(value, 0, 1)
+	if err != nil {
+		return false, fmt.Errorf("expected a bool, got %v", value)
+	}
+	return n == 1, nil
+}
+
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case json.Number:
+		return v.Float64()
+	case uint, uint64:
+		u, err := toUint64(v)
+		return float64(u), err
+	}
+	n, err := toInt(value, math.MinInt64, math.MaxInt64)
+	if err != nil {
+		return 0, fmt.Errorf("expected a number, got %v", value)
+	}
+	return float64(n), nil
+}
+
+// toInt converts an integral number to an int64 between min and max.
+func toInt(value interface{}, min, max float64) (int64, error) {
+	var n int64
+	switch v := value.(type) {
+	case int:
+		n = int64(v)
+	case int8:
+		n = int64(v)
+	case int16:
+		n = int64(v)
+	case int32:
+		n = int64(v)
+	case int64:
+		n = v
+	case uint8:
+		n = int64(v)
+	case uint16:
+		n = int64(v)
+	case uint32:
+		n = int64(v)
+	case uint, uint64:
+		u, _ := toUint64(v)
+		if u > math.MaxInt64 {
+			return 0, fmt.Errorf("value %v out of range %.0f to %.0f", value, min, max)
+		}
+		n = int64(u)
+	case json.Number:
+		i, err := strconv.ParseInt(v.String(), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("expected an integer, got %v", value)
+		}
+		n = i
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return 0, fmt.Errorf("expected an integer, got %v", value)
+		}
+		n = int64(v)
+	default:
+		return 0, fmt.Errorf("expected an integer, got %v", value)
+	}
+	if float64(n) < min || float64(n) > max {
+		return 0, fmt.Errorf("value %v out of range %.0f to %.0f", value, min, max)
+	}
+	return n, nil
+}
+
+// toUint64 converts an integral number to a uint64.
+func toUint64(value interface{}) (uint64, error) {
+	switch v := value.(type) {
+	case uint:
+		return uint64(v), nil
+	case uint64:
+		return v, nil
+	case json.Number:
+		u, err := strconv.ParseUint(v.String(), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("expected an unsigned integer, got %v", value)
+		}
+		return u, nil
+	}
+	n, err := toInt(value, 0, math.MaxInt64)
+	return uint64(n), err
+}
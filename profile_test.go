@@ -0,0 +1,262 @@
+package mbserver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testProfile = `
+name: pump
+unit_ids: [1, 2]
+order: CDAB
+functions: [1, 2, 3, 4, 5, 6, 15, 16, 43]
+identification:
+  vendor_name: ACME
+  product_code: P-100
+  revision: "1.2"
+  model_name: Pump 100
+ranges:
+  - table: holding_registers
+    first: 0
+    last: 9
+    value: 7
+  - table: holding_registers
+    first: 10
+    last: 19
+    access: read
+    values: [1, 2, 3]
+  - table: coils
+    first: 0
+    last: 15
+points:
+  - name: flow
+    table: input_registers
+    address: 100
+    type: float32
+    value: 12.5
+  - name: serial
+    table: holding_registers
+    address: 20
+    type: string
+    length: 4
+    access: read
+    value: SN-0042
+  - name: running
+    table: coils
+    address: 3
+    type: bool
+    value: true
+  - name: total
+    table: holding_registers
+    address: 24
+    type: uint64
+    order: ABCD
+    value: 18446744073709551615
+`
+
+func TestProfile(t *testing.T) {
+	profile, err := ParseProfile([]byte(testProfile), "yaml")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s, err := NewServerFromProfile(profile)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer s.Close()
+
+	if !isEqual([]uint16{7, 7, 1, 2, 3, 0}, s.HoldingRegisters[8:14]) {
+		t.Errorf("expected %v, got %v", []uint16{7, 7, 1, 2, 3, 0}, s.HoldingRegisters[8:14])
+	}
+	if !isEqual([]uint16{0, 0x4148}, s.InputRegisters[100:102]) {
+		t.Errorf("expected %v, got %v", []uint16{0, 0x4148}, s.InputRegisters[100:102])
+	}
+	if s.Coils[3] != 1 {
+		t.Errorf("expected 1, got %v", s.Coils[3])
+	}
+	for name, expect := range map[string]interface{}{
+		"flow":    float64(12.5),
+		"serial":  "SN-0042",
+		"running": true,
+		"total":   uint64(18446744073709551615),
+	} {
+		got, err := profile.Point(name).Get(s)
+		if err != nil || got != expect {
+			t.Errorf("%s: expected %v, got %v %v", name, expect, got, err)
+		}
+	}
+
+	tests := []struct {
+		unitID   uint8
+		function uint8
+		address  uint16
+		number   uint16
+		expect   Exception
+	}{
+		{1, 3, 0, 20, Success},            // contiguous ranges
+		{2, 3, 18, 10, Success},           // range and points
+		{1, 3, 28, 1, IllegalDataAddress}, // undeclared
+		{3, 3, 0, 1, IllegalFunction},     // other unit ID
+		{1, 6, 5, 1, Success},
+		{1, 6, 12, 1, IllegalDataAddress}, // read-only range
+		{1, 16, 8, 3, IllegalDataAddress}, // touches read-only range
+		{1, 6, 21, 1, IllegalDataAddress}, // read-only point
+		{1, 6, 25, 1, Success},
+		{1, 4, 100, 2, Success},
+		{1, 4, 99, 2, IllegalDataAddress},
+		{1, 1, 0, 16, Success},
+		{1, 2, 0, 1, IllegalDataAddress},
+	}
+	for _, test := range tests {
+		response := s.handle(gatewayRequest(test.unitID, test.function, test.address, test.number))
+		if exception := GetException(response); exception != test.expect {
+			t.Errorf("unit %d function %d address %d+%d: expected %v, got %v", test.unitID, test.function,
+				test.address, test.number, test.expect.String(), exception.String())
+		}
+	}
+}
+
+func TestProfileFunctions(t *testing.T) {
+	profile, err := ParseProfile([]byte(`{"functions": [3], "ranges": [{"table": "holding_registers", "first": 0, "last": 9}]}`), "json")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s, err := NewServerFromProfile(profile)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer s.Close()
+
+	if exception := GetException(s.handle(gatewayRequest(1, 3, 0, 1))); exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+	}
+	if exception := GetException(s.handle(gatewayRequest(1, 6, 0, 1))); exception != IllegalFunction {
+		t.Errorf("expected IllegalFunction, got %v", exception.String())
+	}
+}
+
+func TestReadDeviceIdentification(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	var frame TCPFrame
+	frame.Device = 1
+	frame.Function = 43
+	frame.Data = []byte{0x0E, 1, 0}
+	if exception := GetException(s.handle(&Request{frame: &frame})); exception != IllegalFunction {
+		t.Errorf("expected IllegalFunction, got %v", exception.String())
+	}
+
+	s.Identification = &DeviceIdentification{VendorName: "ACME", ProductCode: "P1", MajorMinorRevision: "1.0", ModelName: "M"}
+	response := s.handle(&Request{frame: &frame})
+	expect := []byte{0x0E, 1, 0x82, 0, 0, 3, 0, 4, 'A', 'C', 'M', 'E', 1, 2, 'P', '1', 2, 3, '1', '.', '0'}
+	if !isEqual(expect, response.GetData()) {
+		t.Errorf("expected %v, got %v", expect, response.GetData())
+	}
+
+	// Regular stream skips empty objects.
+	frame.Data = []byte{0x0E, 2, 0}
+	response = s.handle(&Request{frame: &frame})
+	expect = append(expect[:5:5], 4, 0, 4, 'A', 'C', 'M', 'E', 1, 2, 'P', '1', 2, 3, '1', '.', '0', 5, 1, 'M')
+	expect[1] = 2
+	if !isEqual(expect, response.GetData()) {
+		t.Errorf("expected %v, got %v", expect, response.GetData())
+	}
+
+	// Individual access.
+	frame.Data = []byte{0x0E, 4, 5}
+	response = s.handle(&Request{frame: &frame})
+	expect = []byte{0x0E, 4, 0x82, 0, 0, 1, 5, 1, 'M'}
+	if !isEqual(expect, response.GetData()) {
+		t.Errorf("expected %v, got %v", expect, response.GetData())
+	}
+	frame.Data = []byte{0x0E, 4, 3}
+	if exception := GetException(s.handle(&Request{frame: &frame})); exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+}
+
+func TestProfileErrors(t *testing.T) {
+	tests := []struct {
+		format  string
+		profile string
+		expect  string
+	}{
+		{"json", "{\n  \"name\": \"x\",\n  \"unit_ids\": [1,]\n}", "line 3 column 18"},
+		{"json", `{"unit_ids": [300]}`, "line 1 column 17"},
+		{"json", `{"unknown": 1}`, `unknown field "unknown"`},
+		{"yaml", "name: x\nunit_ids: [1, 2\n", "line 2"},
+		{"yaml", "points:\n  - name: a\n    table: coil\n", `points[0] (a): unknown table "coil"`},
+		{"yaml", "order: ABDC\n", `order: unknown word order "ABDC"`},
+		{"yaml", "functions: [43]\n", "functions[0]: function 43 requires identification"},
+		{"yaml", "functions: [7]\n", "functions[0]: unsupported function 7"},
+		{"yaml", "identification:\n  vendor_name: a\n", "identification: product_code is required"},
+		{"yaml", "ranges:\n  - {table: input_registers, first: 0, last: 1, access: read-write}\n",
+			"ranges[0] (input_registers 0-1): input_registers are read-only"},
+		{"yaml", "ranges:\n  - {table: coils, first: 5, last: 1}\n", "ranges[0] (coils 5-1): first address is after last address"},
+		{"yaml", "ranges:\n  - {table: holding_registers, first: 0, last: 1, values: [1, 2, 3]}\n",
+			"ranges[0] (holding_registers 0-1): 3 values exceed the range of 2 addresses"},
+		{"yaml", "ranges:\n  - {table: holding_registers, first: 0, last: 1, value: 70000}\n",
+			"ranges[0] (holding_registers 0-1): value: value 70000 out of range 0 to 65535"},
+		{"yaml", "points:\n  - {name: a, table: holding_registers, address: 0, type: float}\n", `points[0] (a): unknown type "float"`},
+		{"yaml", "points:\n  - {name: a, table: coils, address: 0, type: uint16}\n", "points[0] (a): type uint16 cannot be stored in coils"},
+		{"yaml", "points:\n  - {name: a, table: holding_registers, address: 65535, type: uint32}\n",
+			"points[0] (a): type uint32 at address 65535 exceeds the holding_registers table"},
+		{"yaml", "points:\n  - {name: a, table: holding_registers, address: 0, type: string}\n", "points[0] (a): type string requires a length"},
+		{"yaml", "points:\n  - {name: a, table: holding_registers, address: 0, type: int16, value: 1.5}\n",
+			"points[0] (a): value: expected an integer, got 1.5"},
+		{"yaml", "points:\n  - {name: a, table: holding_registers, address: 0, type: bcd16, value: 10000}\n",
+			"points[0] (a): value: value 10000 out of range 0 to 9999"},
+		{"yaml", "points:\n  - {name: a, table: holding_registers, address: 0, type: uint32}\n  - {name: b, table: holding_registers, address: 1, type: uint16}\n",
+			"points[1] (b): addresses 1-1 overlap points[0] (a)"},
+		{"yaml", "points:\n  - {name: a, table: coils, address: 0, type: bool}\n  - {name: a, table: coils, address: 1, type: bool}\n",
+			"points[1] (a): duplicate name"},
+	}
+	for _, test := range tests {
+		_, err := ParseProfile([]byte(test.profile), test.format)
+		if err == nil || !strings.Contains(err.Error(), test.expect) {
+			t.Errorf("%q: expected %q, got %v", test.profile, test.expect, err)
+		}
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "device.json")
+	os.WriteFile(filename, []byte(`{"points": [{"name": "a", "table": "holding_registers", "address": 0, "type": "int32", "value": -5}]}`), 0644)
+
+	profile, err := LoadProfile(filename)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s := NewServer()
+	defer s.Close()
+	if err := profile.Apply(s); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if got, _ := profile.Point("a").Get(s); got != int64(-5) {
+		t.Errorf("expected -5, got %v", got)
+	}
+	if s.Profile != profile {
+		t.Errorf("expected the server profile to be set")
+	}
+
+	os.WriteFile(filename, []byte(`{"points": [{"name": "a"}]}`), 0644)
+	_, err = LoadProfile(filename)
+	if err == nil || !strings.HasPrefix(err.Error(), filename+": points[0] (a): ") {
+		t.Errorf("expected an error naming the file and point, got %v", err)
+	}
+}
+
+func TestParseTable(t *testing.T) {
+	for name, expect := range map[string]Table{"coils": CoilTable, "di": DiscreteInputTable, "hr": HoldingRegisterTable, "input_registers": InputRegisterTable} {
+		if table, err := ParseTable(name); err != nil || table != expect {
+			t.Errorf("%s: expected %v, got %v %v", name, expect, table, err)
+		}
+	}
+	if _, err := ParseTable("registers"); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+package mbserver
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+)
+
+// WordOrder is the order of the bytes of values spanning several registers,
+// named after the placement of the bytes A (most significant) to D of a
+// 32 bit value.
+type WordOrder uint8
+
+// Word orders.
+const (
+	// OrderABCD is big endian, the Modbus default.
+	OrderABCD WordOrder = iota
+	// OrderCDAB swaps the registers.
+	OrderCDAB
+	// OrderBADC swaps the bytes within each register.
+	OrderBADC
+	// OrderDCBA is little endian.
+	OrderDCBA
+)
+
+func (o WordOrder) String() string {
+	switch o {
+	case OrderABCD:
+		return "ABCD"
+	case OrderCDAB:
+		return "CDAB"
+	case OrderBADC:
+		return "BADC"
+	case OrderDCBA:
+		return "DCBA"
+	}
+	return fmt.Sprintf("WordOrder(%d)", uint8(o))
+}
+
+// ParseWordOrder parses "ABCD", "CDAB", "BADC" or "DCBA".
+func ParseWordOrder(s string) (WordOrder, error) {
+	for _, o := range []WordOrder{OrderABCD, OrderCDAB, OrderBADC, OrderDCBA} {
+		if o.String() == s {
+			return o, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown word order %q", s)
+}
+
+func (o WordOrder) swapWords() bool {
+	return o == OrderCDAB || o == OrderDCBA
+}
+
+func (o WordOrder) swapBytes() bool {
+	return o == OrderBADC || o == OrderDCBA
+}
+
+// RegisterView reads and writes typed values in a register table such as
+// Server.HoldingRegisters. Addresses outside the table panic. The view does
+// no locking of its own.
+type RegisterView struct {
+	registers []uint16
+	order     WordOrder
+	ranges    []orderRange
+}
+
+type orderRange struct {
+	addresses AddressRange
+	order     WordOrder
+}
+
+// NewRegisterView creates a view of the registers using the word order for
+// all addresses without a range specific order.
+func NewRegisterView(registers []uint16, order WordOrder) *RegisterView {
+	return &RegisterView{registers: registers, order: order}
+}
+
+// SetOrder sets the word order of values starting within the address range.
+func (v *RegisterView) SetOrder(addresses AddressRange, order WordOrder) {
+	v.ranges = append(v.ranges, orderRange{addresses, order})
+}
+
+// Order returns the word order of values starting at address.
+func (v *RegisterView) Order(address uint16) WordOrder {
+	for i := len(v.ranges) - 1; i >= 0; i-- {
+		if v.ranges[i].addresses.contains(int(address), 1) {
+			return v.ranges[i].order
+		}
+	}
+	return v.order
+}
+
+// get returns the big endian bytes of the value stored in count registers.
+func (v *RegisterView) get(address uint16, count int) []byte {
+	order := v.Order(address)
+	raw := make([]byte, 2*count)
+	for i := 0; i < count; i++ {
+		register := v.registers[int(address)+i]
+		if order.swapWords() {
+			register = v.registers[int(address)+count-1-i]
+		}
+		if order.swapBytes() {
+			raw[2*i], raw[2*i+1] = byte(register), byte(register>>8)
+		} else {
+			raw[2*i], raw[2*i+1] = byte(register>>8), byte(register)
+		}
+	}
+	return raw
+}
+
+// set stores the big endian bytes of a value in len(raw)/2 registers.
+func (v *RegisterView) set(address uint16, raw []byte) {
+	order := v.Order(address)
+	count := len(raw) / 2
+	_ = v.registers[int(address)+count-1]
+	for i := 0; i < count; i++ {
+		var register uint16
+		if order.swapBytes() {
+			register = uint16(raw[2*i+1])<<8 | uint16(raw[2*i])
+		} else {
+			register = uint16(raw[2*i])<<8 | uint16(raw[2*i+1])
+		}
+		if order.swapWords() {
+			v.registers[int(address)+count-1-i] = register
+		} else {
+			v.registers[int(address)+i] = register
+		}
+	}
+}
+
+func (v *RegisterView) uint(address uint16, count int) uint64 {
+	var value uint64
+	for _, b := range v.get(address, count) {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func (v *RegisterView) setUint(address uint16, count int, value uint64) {
+	raw := make([]byte, 2*count)
+	for i := len(raw) - 1; i >= 0; i-- {
+		raw[i] = byte(value)
+		value >>= 8
+	}
+	v.set(address, raw)
+}
+
+// Uint32 returns the unsigned 32 bit value in the two registers at address.
+func (v *RegisterView) Uint32(address uint16) uint32 {
+	return uint32(v.uint(address, 2))
+}
+
+// SetUint32 stores an unsigned 32 bit value in the two registers at address.
+func (v *RegisterView) SetUint32(address uint16, value uint32) {
+	v.setUint(address, 2, uint64(value))
+}
+
+// Int32 returns the signed 32 bit value in the two registers at address.
+func (v *RegisterView) Int32(address uint16) int32 {
+	return int32(v.uint(address, 2))
+}
+
+// SetInt32 stores a signed 32 bit value in the two registers at address.
+func (v *RegisterView) SetInt32(address uint16, value int32) {
+	v.setUint(address, 2, uint64(uint32(value)))
+}
+
+// Uint64 returns the unsigned 64 bit value in the four registers at address.
+func (v *RegisterView) Uint64(address uint16) uint64 {
+	return v.uint(address, 4)
+}
+
+// SetUint64 stores an unsigned 64 bit value in the four registers at address.
+func (v *RegisterView) SetUint64(address uint16, value uint64) {
+	v.setUint(address, 4, value)
+}
+
+// Int64 returns the signed 64 bit value in the four registers at address.
+func (v *RegisterView) Int64(address uint16) int64 {
+	return int64(v.uint(address, 4))
+}
+
+// SetInt64 stores a signed 64 bit value in the four registers at address.
+func (v *RegisterView) SetInt64(address uint16, value int64) {
+	v.setUint(address, 4, uint64(value))
+}
+
+// Float32 returns the IEEE 754 single precision value in the two registers at address.
+func (v *RegisterView) Float32(address uint16) float32 {
+	return math.Float32frombits(v.Uint32(address))
+}
+
+// SetFloat32 stores an IEEE 754 single precision value in the two registers at address.
+func (v *RegisterView) SetFloat32(address uint16, value float32) {
+	v.SetUint32(address, math.Float32bits(value))
+}
+
+// Float64 returns the IEEE 754 double precision value in the four registers at address.
+func (v *RegisterView) Float64(address uint16) float64 {
+	return math.Float64frombits(v.Uint64(address))
+}
+
+// SetFloat64 stores an IEEE 754 double precision value in the four registers at address.
+func (v *RegisterView) SetFloat64(address uint16, value float64) {
+	v.SetUint64(address, math.Float64bits(value))
+}
+
+// String returns the ASCII string of up to 2*count characters stored in count
+// registers at address, two characters per register. Trailing NUL characters
+// are removed. Only the byte order within registers applies to strings.
+func (v *RegisterView) String(address uint16, count int) string {
+	raw := make([]byte, 2*count)
+	swap := v.Order(address).swapBytes()
+	for i := 0; i < count; i++ {
+		register := v.registers[int(address)+i]
+		if swap {
+			raw[2*i], raw[2*i+1] = byte(register), byte(register>>8)
+		} else {
+			raw[2*i], raw[2*i+1] = byte(register>>8), byte(register)
+		}
+	}
+	return string(bytes.TrimRight(raw, "\x00"))
+}
+
+// SetString stores the ASCII string in count registers at address, padded
+// with NUL characters. Longer strings are truncated.
+func (v *RegisterView) SetString(address uint16, count int, value string) {
+	raw := make([]byte, 2*count)
+	copy(raw, value)
+	swap := v.Order(address).swapBytes()
+	_ = v.registers[int(address)+count-1]
+	for i := 0; i < count; i++ {
+		if swap {
+			v.registers[int(address)+i] = uint16(raw[2*i+1])<<8 | uint16(raw[2*i])
+		} else {
+			v.registers[int(address)+i] = uint16(raw[2*i])<<8 | uint16(raw[2*i+1])
+		}
+	}
+}
+
+// BCD16 returns the four digit binary coded decimal value in the register at address.
+func (v *RegisterView) BCD16(address uint16) (uint16, error) {
+	value, err := fromBCD(uint64(v.registers[address]), 4)
+	return uint16(value), err
+}
+
+// SetBCD16 stores a value from 0 to 9999 as binary coded decimal in the register at address.
+func (v *RegisterView) SetBCD16(address uint16, value uint16) error {
+	bcd, err := toBCD(uint64(value), 4)
+	if err != nil {
+		return err
+	}
+	v.registers[address] = uint16(bcd)
+	return nil
+}
+
+// BCD32 returns the eight digit binary coded decimal value in the two registers at address.
+func (v *RegisterView) BCD32(address uint16) (uint32, error) {
+	value, err := fromBCD(v.uint(address, 2), 8)
+	return uint32(value), err
+}
+
+// SetBCD32 stores a value from 0 to 99999999 as binary coded decimal in the two registers at address.
+func (v *RegisterView) SetBCD32(address uint16, value uint32) error {
+	bcd, err := toBCD(uint64(value), 8)
+	if err != nil {
+		return err
+	}
+	v.setUint(address, 2, bcd)
+	return nil
+}
+
+func fromBCD(bcd uint64, digits int) (uint64, error) {
+	var value uint64
+	for i := digits - 1; i >= 0; i-- {
+		digit := (bcd >> (4 * uint(i))) & 0x0f
+		if digit > 9 {
+			return 0, fmt.Errorf("invalid BCD value 0x%x", bcd)
+		}
+		value = value*10 + digit
+	}
+	return value, nil
+}
+
+func toBCD(value uint64, digits int) (uint64, error) {
+	var bcd uint64
+	for i := 0; i < digits; i++ {
+		bcd |= (value % 10) << (4 * uint(i))
+		value /= 10
+	}
+	if value != 0 {
+		return 0, fmt.Errorf("value exceeds %d BCD digits", digits)
+	}
+	return bcd, nil
+}
@@ -0,0 +1,95 @@
+package mbserver
+
+import "testing"
+
+func TestRegisterViewOrders(t *testing.T) {
+	tests := []struct {
+		order  WordOrder
+		expect []uint16
+	}{
+		{OrderABCD, []uint16{0x1122, 0x3344}},
+		{OrderCDAB, []uint16{0x3344, 0x1122}},
+		{OrderBADC, []uint16{0x2211, 0x4433}},
+		{OrderDCBA, []uint16{0x4433, 0x2211}},
+	}
+	for _, test := range tests {
+		registers := make([]uint16, 4)
+		v := NewRegisterView(registers, test.order)
+		v.SetUint32(1, 0x11223344)
+		if !isEqual(test.expect, registers[1:3]) {
+			t.Errorf("%v: expected %x, got %x", test.order, test.expect, registers[1:3])
+		}
+		if got := v.Uint32(1); got != 0x11223344 {
+			t.Errorf("%v: expected %x, got %x", test.order, 0x11223344, got)
+		}
+	}
+}
+
+func TestRegisterViewTypes(t *testing.T) {
+	s := NewServer()
+	v := NewRegisterView(s.HoldingRegisters, OrderABCD)
+	v.SetOrder(AddressRange{100, 199}, OrderCDAB)
+
+	v.SetFloat32(0, 3.5)
+	if !isEqual([]uint16{0x4060, 0}, s.HoldingRegisters[0:2]) {
+		t.Errorf("expected %x, got %x", []uint16{0x4060, 0}, s.HoldingRegisters[0:2])
+	}
+	v.SetFloat32(100, 3.5)
+	if !isEqual([]uint16{0, 0x4060}, s.HoldingRegisters[100:102]) {
+		t.Errorf("expected %x, got %x", []uint16{0, 0x4060}, s.HoldingRegisters[100:102])
+	}
+	if got := v.Float32(100); got != 3.5 {
+		t.Errorf("expected 3.5, got %v", got)
+	}
+
+	v.SetInt32(10, -2)
+	if got := v.Int32(10); got != -2 {
+		t.Errorf("expected -2, got %v", got)
+	}
+	v.SetInt64(20, -1234567890123)
+	if got := v.Int64(20); got != -1234567890123 {
+		t.Errorf("expected -1234567890123, got %v", got)
+	}
+	v.SetUint64(30, 1<<63)
+	if got := v.Uint64(30); got != 1<<63 {
+		t.Errorf("expected %v, got %v", uint64(1<<63), got)
+	}
+	v.SetFloat64(40, -0.125)
+	if got := v.Float64(40); got != -0.125 {
+		t.Errorf("expected -0.125, got %v", got)
+	}
+
+	v.SetString(50, 3, "PUMP1")
+	if !isEqual([]uint16{0x5055, 0x4d50, 0x3100}, s.HoldingRegisters[50:53]) {
+		t.Errorf("expected %x, got %x", []uint16{0x5055, 0x4d50, 0x3100}, s.HoldingRegisters[50:53])
+	}
+	if got := v.String(50, 3); got != "PUMP1" {
+		t.Errorf("expected PUMP1, got %q", got)
+	}
+}
+
+func TestRegisterViewBCD(t *testing.T) {
+	registers := make([]uint16, 4)
+	v := NewRegisterView(registers, OrderABCD)
+
+	if err := v.SetBCD16(0, 1234); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if registers[0] != 0x1234 {
+		t.Errorf("expected 0x1234, got 0x%x", registers[0])
+	}
+	if err := v.SetBCD32(1, 12345678); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	got, err := v.BCD32(1)
+	if err != nil || got != 12345678 {
+		t.Errorf("expected 12345678, got %v %v", got, err)
+	}
+	if err := v.SetBCD16(0, 10000); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	registers[3] = 0x12A4
+	if _, err := v.BCD16(3); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
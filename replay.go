@@ -0,0 +1,231 @@
+package mbserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Exchange is a recorded request and the response sent to it.
+type Exchange struct {
+	// Transport is "tcp" for Modbus TCP frames, "udp" for Modbus TCP frames
+	// in datagrams and "rtu" for RTU frames.
+	Transport string
+	Request   []byte
+	Response  []byte
+}
+
+// ReplayDiff describes a replayed request whose response differs from the
+// recorded one.
+type ReplayDiff struct {
+	// Index of the exchange in the replayed sequence.
+	Index    int
+	Request  []byte
+	Expected []byte
+	Got      []byte
+}
+
+func (d ReplayDiff) String() string {
+	return fmt.Sprintf("exchange %d: request % x: expected % x, got % x", d.Index, d.Request, d.Expected, d.Got)
+}
+
+// Replay passes each recorded request through the server's request pipeline,
+// bypassing the network, and returns the exchanges whose responses differ
+// from the recording. Requests are handled in order, synchronously with
+// requests from any active listeners, and routed by the Gateway if set.
+func (s *Server) Replay(exchanges []Exchange) ([]ReplayDiff, error) {
+	var diffs []ReplayDiff
+	conn := &replayConn{response: make(chan []byte, 1)}
+
+	for i, exchange := range exchanges {
+		var frame Framer
+		var err error
+		switch exchange.Transport {
+		case "tcp", "udp":
+			frame, err = NewTCPFrame(exchange.Request)
+		case "rtu":
+			frame, err = NewRTUFrame(exchange.Request)
+		default:
+			err = fmt.Errorf("unknown transport %q", exchange.Transport)
+		}
+		if err != nil {
+			return diffs, fmt.Errorf("exchange %d: %v", i, err)
+		}
+
+		s.dispatch(&Request{conn: conn, frame: frame, transport: exchange.Transport, listener: "replay"})
+		got := <-conn.response
+
+		if !bytes.Equal(got, exchange.Response) {
+			diffs = append(diffs, ReplayDiff{i, exchange.Request, exchange.Response, got})
+		}
+	}
+	return diffs, nil
+}
+
+// replayConn receives the responses written by the request handler.
+type replayConn struct {
+	response chan []byte
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *replayConn) Write(p []byte) (int, error) {
+	c.response <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (c *replayConn) Close() error {
+	return nil
+}
+
+// ReadCapture reads the Modbus exchanges from a pcapng stream, such as one
+// written by Capture. Packets on Ethernet and raw IP interfaces are treated
+// as Modbus TCP over TCP or UDP; on user link types as Modbus RTU. TCP and UDP
+// requests are paired with the next packet of the reverse flow, RTU frames
+// are paired in order.
+func ReadCapture(r io.Reader) ([]Exchange, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var exchanges []Exchange
+	var order binary.ByteOrder = binary.LittleEndian
+	var linkTypes []uint16
+	pending := make(map[string]int)
+	rtuPending := -1
+
+	for len(data) > 0 {
+		if len(data) < 12 {
+			return nil, fmt.Errorf("pcapng: truncated block")
+		}
+		blockType := order.Uint32(data[0:4])
+		if blockType == 0x0A0D0D0A {
+			if binary.BigEndian.Uint32(data[8:12]) == 0x1A2B3C4D {
+				order = binary.BigEndian
+			} else {
+				order = binary.LittleEndian
+			}
+			linkTypes = nil
+		}
+		length := int(order.Uint32(data[4:8]))
+		if length < 12 || length > len(data) {
+			return nil, fmt.Errorf("pcapng: bad block length %d", length)
+		}
+		block := data[:length]
+		data = data[length:]
+
+		switch blockType {
+		case 1: // Interface description block
+			linkTypes = append(linkTypes, order.Uint16(block[8:10]))
+		case 6: // Enhanced packet block
+			if length < 32 {
+				return nil, fmt.Errorf("pcapng: bad packet block length %d", length)
+			}
+			iface := int(order.Uint32(block[8:12]))
+			captured := int(order.Uint32(block[20:24]))
+			if iface >= len(linkTypes) || 28+captured > length-4 {
+				return nil, fmt.Errorf("pcapng: bad packet block")
+			}
+			packet := block[28 : 28+captured]
+
+			linkType := linkTypes[iface]
+			if linkType >= LinkTypeUser0 && linkType <= LinkTypeUser0+15 {
+				if rtuPending < 0 {
+					exchanges = append(exchanges, Exchange{Transport: "rtu", Request: packet})
+					rtuPending = len(exchanges) - 1
+				} else {
+					exchanges[rtuPending].Response = packet
+					rtuPending = -1
+				}
+				continue
+			}
+
+			transport, flow, reverse, payload, ok := ipPayload(linkType, packet)
+			if !ok || len(payload) == 0 {
+				continue
+			}
+			if i, ok := pending[reverse]; ok {
+				exchanges[i].Response = payload
+				delete(pending, reverse)
+			} else {
+				exchanges = append(exchanges, Exchange{Transport: transport, Request: payload})
+				pending[flow] = len(exchanges) - 1
+			}
+		}
+	}
+	return exchanges, nil
+}
+
+// ipPayload extracts the transport, "tcp" or "udp", the flow identifiers and
+// the payload of an Ethernet or raw IP packet.
+func ipPayload(linkType uint16, packet []byte) (transport string, flow string, reverse string, payload []byte, ok bool) {
+	const linkTypeEthernet = 1
+	switch linkType {
+	case linkTypeEthernet:
+		if len(packet) < 14 {
+			return "", "", "", nil, false
+		}
+		packet = packet[14:]
+	case LinkTypeRaw:
+	default:
+		return "", "", "", nil, false
+	}
+	if len(packet) < 1 {
+		return "", "", "", nil, false
+	}
+
+	var src, dst []byte
+	var protocol byte
+	var segment []byte
+	switch packet[0] >> 4 {
+	case 4:
+		headerLen := int(packet[0]&0x0f) * 4
+		if len(packet) < headerLen || headerLen < 20 {
+			return "", "", "", nil, false
+		}
+		total := int(binary.BigEndian.Uint16(packet[2:4]))
+		if total >= headerLen && total <= len(packet) {
+			packet = packet[:total]
+		}
+		protocol, src, dst, segment = packet[9], packet[12:16], packet[16:20], packet[headerLen:]
+	case 6:
+		if len(packet) < 40 {
+			return "", "", "", nil, false
+		}
+		protocol, src, dst, segment = packet[6], packet[8:24], packet[24:40], packet[40:]
+	default:
+		return "", "", "", nil, false
+	}
+
+	switch protocol {
+	case 6:
+		if len(segment) < 20 {
+			return "", "", "", nil, false
+		}
+		dataOffset := int(segment[12]>>4) * 4
+		if dataOffset < 20 || dataOffset > len(segment) {
+			return "", "", "", nil, false
+		}
+		transport, payload = "tcp", segment[dataOffset:]
+	case 17:
+		if len(segment) < 8 {
+			return "", "", "", nil, false
+		}
+		length := int(binary.BigEndian.Uint16(segment[4:6]))
+		if length < 8 || length > len(segment) {
+			return "", "", "", nil, false
+		}
+		transport, payload = "udp", segment[8:length]
+	default:
+		return "", "", "", nil, false
+	}
+	srcPort := binary.BigEndian.Uint16(segment[0:2])
+	dstPort := binary.BigEndian.Uint16(segment[2:4])
+	flow = fmt.Sprintf("%s %x:%d>%x:%d", transport, src, srcPort, dst, dstPort)
+	reverse = fmt.Sprintf("%s %x:%d>%x:%d", transport, dst, dstPort, src, srcPort)
+	return transport, flow, reverse, payload, true
+}
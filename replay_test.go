@@ -0,0 +1,174 @@
+package mbserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// recordExchanges handles the requests on a new server and captures the traffic.
+func recordExchanges(t *testing.T, packets ...[]byte) *bytes.Buffer {
+	var out bytes.Buffer
+	c, err := NewCapture(&out)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	s := NewServer()
+	s.HoldingRegisters[1] = 7
+	conn := &addrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 502},
+		remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000},
+	}
+	for _, packet := range packets {
+		frame, err := NewTCPFrame(packet)
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		request := &Request{conn: conn, frame: frame}
+		err = c.captureRequest(request, s.handle(request).Bytes())
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	return &out
+}
+
+func TestReplay(t *testing.T) {
+	capture := recordExchanges(t,
+		[]byte{0, 1, 0, 0, 0, 6, 1, 3, 0, 1, 0, 1},
+		[]byte{0, 2, 0, 0, 0, 6, 1, 6, 0, 2, 0, 9},
+		[]byte{0, 3, 0, 0, 0, 6, 1, 3, 0, 1, 0, 2},
+	)
+
+	exchanges, err := ReadCapture(capture)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(exchanges) != 3 {
+		t.Fatalf("expected 3 exchanges, got %d", len(exchanges))
+	}
+	expect := []byte{0, 3, 0, 0, 0, 7, 1, 3, 4, 0, 7, 0, 9}
+	if !isEqual(expect, exchanges[2].Response) {
+		t.Errorf("expected %v, got %v", expect, exchanges[2].Response)
+	}
+
+	s := NewServer()
+	s.HoldingRegisters[1] = 7
+	diffs, err := s.Replay(exchanges)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected no differences, got %v", diffs)
+	}
+
+	// A handler that ignores writes changes the last response.
+	s = NewServer()
+	s.HoldingRegisters[1] = 7
+	s.RegisterFunctionHandler(6, func(s *Server, frame Framer) ([]byte, *Exception) {
+		return frame.GetData()[0:4], &Success
+	})
+	diffs, err = s.Replay(exchanges)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(diffs) != 1 || diffs[0].Index != 2 {
+		t.Fatalf("expected a difference in exchange 2, got %v", diffs)
+	}
+	expect = []byte{0, 3, 0, 0, 0, 7, 1, 3, 4, 0, 7, 0, 0}
+	if !isEqual(expect, diffs[0].Got) {
+		t.Errorf("expected %v, got %v", expect, diffs[0].Got)
+	}
+}
+
+func TestReadCaptureTruncated(t *testing.T) {
+	capture := recordExchanges(t, []byte{0, 1, 0, 0, 0, 6, 1, 3, 0, 1, 0, 1})
+	_, err := ReadCapture(bytes.NewReader(capture.Bytes()[:capture.Len()-4]))
+	if err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
+
+func TestReadCaptureBlockTrailer(t *testing.T) {
+	capture := recordExchanges(t, []byte{0, 1, 0, 0, 0, 6, 1, 3, 0, 1, 0, 1}).Bytes()
+	// The captured length of the first packet block, after the section and
+	// interface headers, runs into the trailing block length.
+	block := capture[28+20+20:]
+	length := binary.LittleEndian.Uint32(block[4:8])
+	binary.LittleEndian.PutUint32(block[20:24], length-28)
+	if _, err := ReadCapture(bytes.NewReader(capture)); err == nil || err.Error() != "pcapng: bad packet block" {
+		t.Errorf("expected a bad packet block, got %v", err)
+	}
+}
+
+func TestReplayGateway(t *testing.T) {
+	upstream := NewServer()
+	upstream.HoldingRegisters[1] = 7
+	addr := getFreePort()
+	if err := upstream.ListenTCP(addr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer upstream.Close()
+
+	exchanges, err := ReadCapture(recordExchanges(t, []byte{0, 1, 0, 0, 0, 6, 1, 3, 0, 1, 0, 1}))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s := NewServer()
+	defer s.Close()
+	s.Gateway = NewGateway()
+	s.Gateway.Route(NewTCPPool(addr, 1, time.Second), 1)
+	diffs, err := s.Replay(exchanges)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected no differences, got %v", diffs)
+	}
+}
+
+func TestReplayUDPCapture(t *testing.T) {
+	var out bytes.Buffer
+	c, err := NewCapture(&out)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s := NewServer()
+	defer s.Close()
+	s.Capture = c
+	s.HoldingRegisters[10] = 1234
+	if err := s.ListenUDP("127.0.0.1:0"); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	conn, err := net.Dial("udp", s.packetConns[0].LocalAddr().String())
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer conn.Close()
+	frame := &TCPFrame{TransactionIdentifier: 7, Device: 1, Function: 3}
+	SetDataWithRegisterAndNumber(frame, 10, 1)
+	conn.Write(frame.Bytes())
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 512)); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	// The exchange is captured before the response is written.
+	c.mutex.Lock()
+	capture := bytes.NewReader(out.Bytes())
+	c.mutex.Unlock()
+	exchanges, err := ReadCapture(capture)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(exchanges) != 1 || exchanges[0].Transport != "udp" || !isEqual(frame.Bytes(), exchanges[0].Request) {
+		t.Fatalf("expected the UDP exchange, got %v", exchanges)
+	}
+	diffs, err := s.Replay(exchanges)
+	if err != nil || len(diffs) != 0 {
+		t.Errorf("expected no differences, got %v %v", diffs, err)
+	}
+}
@@ -0,0 +1,731 @@
+package mbserver
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Script is a compiled list of assignments to points and table addresses,
+// separated by semicolons or new lines:
+//
+//	input_registers[5] += clamp(holding_registers[20] - input_registers[5], -10, 10)
+//	level = coils[3] ? level - 0.5 : level
+//
+// Tables are indexed by address and may be abbreviated to c, di, hr and ir.
+// Point names read and write the typed points of the Profile. Values are
+// numbers; conditions are true when not zero. Registers accept -32768 to
+// 65535, negative values being stored as int16, and bits are set when the
+// value is not zero. Assignments may use =, += and -=. Expressions use
+// + - * / %, comparisons, && || !, the ternary ?: and the functions min,
+// max, abs, clamp(x, lo, hi), round, floor, ceil, sqrt, sin, cos, int16(x),
+// bit(x, n), rand() and now() in seconds.
+type Script struct {
+	source     string
+	statements []*scriptStatement
+}
+
+// Expression is a compiled Script expression.
+type Expression struct {
+	source string
+	node   scriptNode
+}
+
+// scriptEnv is the state a script is evaluated in, source naming the
+// writer of its assignments.
+type scriptEnv struct {
+	s      *Server
+	vars   map[string]float64
+	source string
+}
+
+type scriptNode interface {
+	eval(env *scriptEnv) (float64, error)
+}
+
+type scriptStatement struct {
+	target scriptNode
+	op     string
+	value  scriptNode
+}
+
+// CompileScript compiles the statements of a script. Names are resolved in
+// the profile, which may be nil, and vars are the names of the variables
+// provided when the script runs.
+func CompileScript(source string, profile *Profile, vars ...string) (*Script, error) {
+	p, err := newScriptParser(source, profile, vars)
+	if err != nil {
+		return nil, err
+	}
+	script := &Script{source: source}
+	for {
+		p.skipSeparators()
+		if p.peek().kind == tokenEOF {
+			break
+		}
+		statement, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		script.statements = append(script.statements, statement)
+		if t := p.peek(); t.kind != tokenEOF && t.text != ";" && t.text != "\n" {
+			return nil, p.errorf(t, "expected the end of the statement, got %q", t.text)
+		}
+	}
+	return script, nil
+}
+
+// CompileExpression compiles an expression like CompileScript.
+func CompileExpression(source string, profile *Profile, vars ...string) (*Expression, error) {
+	p, err := newScriptParser(source, profile, vars)
+	if err != nil {
+		return nil, err
+	}
+	p.skipSeparators()
+	node, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSeparators()
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+	return &Expression{source: source, node: node}, nil
+}
+
+func (script *Script) String() string {
+	return script.source
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+// run runs the script on the server's tables, writing like writeTable on
+// behalf of the source. The caller holds the data lock.
+func (script *Script) run(s *Server, vars map[string]float64, source string) error {
+	env := &scriptEnv{s: s, vars: vars, source: source}
+	for _, statement := range script.statements {
+		value, err := statement.value.eval(env)
+		if err != nil {
+			return err
+		}
+		if statement.op != "=" {
+			current, err := statement.target.eval(env)
+			if err != nil {
+				return err
+			}
+			if statement.op == "+=" {
+				value = current + value
+			} else {
+				value = current - value
+			}
+		}
+		if err := assign(env, statement.target, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eval evaluates the expression on the server's tables. The caller holds
+// the data lock.
+func (e *Expression) eval(s *Server, vars map[string]float64) (float64, error) {
+	return e.node.eval(&scriptEnv{s: s, vars: vars})
+}
+
+func assign(env *scriptEnv, target scriptNode, value float64) error {
+	switch target := target.(type) {
+	case *pointNode:
+		if target.point.Type == "string" {
+			return fmt.Errorf("cannot assign a number to string point %s", target.point.Name)
+		}
+		err := env.s.writePoint(target.point, simulatedValue(target.point, value), ChangeEvent{Source: env.source})
+		if err != nil {
+			return fmt.Errorf("%s: %v", target.point.Name, err)
+		}
+		return nil
+	case *indexNode:
+		address, err := target.resolve(env)
+		if err != nil {
+			return err
+		}
+		if isBitTable(target.table) {
+			if value != 0 {
+				value = 1
+			}
+		} else {
+			value = math.Round(value)
+			if value < -32768 || value > 65535 {
+				return fmt.Errorf("%v[%d]: value %v out of range -32768 to 65535", target.table, address, value)
+			}
+			if value < 0 {
+				value += 65536
+			}
+		}
+		return env.s.writeTable(target.table, address, []uint16{uint16(value)}, ChangeEvent{Source: env.source})
+	}
+	return errors.New("invalid assignment")
+}
+
+// Tokens.
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenName
+	tokenOperator
+)
+
+type scriptToken struct {
+	kind     tokenKind
+	text     string
+	number   float64
+	position int
+}
+
+// scriptOperators are the operators, longest first.
+var scriptOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "+=", "-=",
+	"+", "-", "*", "/", "%", "<", ">", "!", "?", ":", "(", ")", "[", "]", ",", "=", ";", "\n"}
+
+func tokenize(source string) ([]scriptToken, error) {
+	var tokens []scriptToken
+	for i := 0; i < len(source); {
+		c := rune(source[i])
+		switch {
+		case c == '#':
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case c == '\n':
+			tokens = append(tokens, scriptToken{kind: tokenOperator, text: "\n", position: i})
+			i++
+		case unicode.IsSpace(c):
+			i++
+		case c >= '0' && c <= '9' || c == '.':
+			start := i
+			for i < len(source) && (isNameChar(rune(source[i])) || source[i] == '.') {
+				i++
+			}
+			text := source[start:i]
+			number, err := parseScriptNumber(text)
+			if err != nil {
+				return nil, fmt.Errorf("position %d: invalid number %q", start+1, text)
+			}
+			tokens = append(tokens, scriptToken{kind: tokenNumber, text: text, number: number, position: start})
+		case isNameChar(c):
+			start := i
+			for i < len(source) && isNameChar(rune(source[i])) {
+				i++
+			}
+			tokens = append(tokens, scriptToken{kind: tokenName, text: source[start:i], position: start})
+		default:
+			found := false
+			for _, op := range scriptOperators {
+				if strings.HasPrefix(source[i:], op) {
+					tokens = append(tokens, scriptToken{kind: tokenOperator, text: op, position: i})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("position %d: unexpected %q", i+1, c)
+			}
+		}
+	}
+	return append(tokens, scriptToken{kind: tokenEOF, position: len(source)}), nil
+}
+
+func isNameChar(c rune) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func parseScriptNumber(text string) (float64, error) {
+	if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") || strings.HasPrefix(text, "0b") {
+		n, err := strconv.ParseUint(text, 0, 64)
+		return float64(n), err
+	}
+	return strconv.ParseFloat(text, 64)
+}
+
+// Parser.
+
+type scriptParser struct {
+	tokens  []scriptToken
+	next    int
+	profile *Profile
+	vars    map[string]bool
+}
+
+func newScriptParser(source string, profile *Profile, vars []string) (*scriptParser, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &scriptParser{tokens: tokens, profile: profile, vars: make(map[string]bool)}
+	for _, name := range vars {
+		p.vars[name] = true
+	}
+	return p, nil
+}
+
+func (p *scriptParser) errorf(t scriptToken, format string, args ...interface{}) error {
+	return fmt.Errorf("position %d: %s", t.position+1, fmt.Sprintf(format, args...))
+}
+
+func (p *scriptParser) peek() scriptToken {
+	return p.tokens[p.next]
+}
+
+func (p *scriptParser) take() scriptToken {
+	t := p.tokens[p.next]
+	if t.kind != tokenEOF {
+		p.next++
+	}
+	return t
+}
+
+// accept takes the next token if it is the operator.
+func (p *scriptParser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokenOperator && t.text == op {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *scriptParser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		if t.kind == tokenEOF {
+			return p.errorf(t, "expected %q at the end", op)
+		}
+		return p.errorf(t, "expected %q, got %q", op, t.text)
+	}
+	return nil
+}
+
+func (p *scriptParser) skipSeparators() {
+	for p.accept(";") || p.accept("\n") {
+	}
+}
+
+// skipNewLines allows expressions to continue on the next line after an
+// operator.
+func (p *scriptParser) skipNewLines() {
+	for p.accept("\n") {
+	}
+}
+
+func (p *scriptParser) statement() (*scriptStatement, error) {
+	t := p.peek()
+	target, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	switch target.(type) {
+	case *pointNode, *indexNode:
+	default:
+		return nil, p.errorf(t, "expected a point or table address to assign")
+	}
+	op := p.take()
+	if op.kind != tokenOperator || (op.text != "=" && op.text != "+=" && op.text != "-=") {
+		return nil, p.errorf(op, "expected an assignment, got %q", op.text)
+	}
+	p.skipNewLines()
+	value, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	return &scriptStatement{target: target, op: op.text, value: value}, nil
+}
+
+func (p *scriptParser) expression() (scriptNode, error) {
+	cond, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("?") {
+		return cond, nil
+	}
+	p.skipNewLines()
+	then, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	p.skipNewLines()
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	p.skipNewLines()
+	otherwise, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	return &ternaryNode{cond, then, otherwise}, nil
+}
+
+// scriptPrecedence are the binary operators by increasing precedence.
+var scriptPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *scriptParser) binary(level int) (scriptNode, error) {
+	if level == len(scriptPrecedence) {
+		return p.unary()
+	}
+	x, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokenOperator || !containsString(scriptPrecedence[level], t.text) {
+			return x, nil
+		}
+		p.take()
+		p.skipNewLines()
+		y, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryNode{t.text, x, y}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, element := range list {
+		if element == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *scriptParser) unary() (scriptNode, error) {
+	if p.accept("-") {
+		x, err := p.unary()
+		return &unaryNode{"-", x}, err
+	}
+	if p.accept("!") {
+		x, err := p.unary()
+		return &unaryNode{"!", x}, err
+	}
+	return p.primary()
+}
+
+func (p *scriptParser) primary() (scriptNode, error) {
+	t := p.take()
+	switch t.kind {
+	case tokenNumber:
+		return &numberNode{t.number}, nil
+	case tokenOperator:
+		if t.text == "(" {
+			x, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		}
+		return nil, p.errorf(t, "unexpected %q", strings.Replace(t.text, "\n", "new line", 1))
+	case tokenEOF:
+		return nil, p.errorf(t, "unexpected end")
+	}
+
+	name := t.text
+	if p.accept("[") {
+		table, ok := tableNames[name]
+		if !ok {
+			return nil, p.errorf(t, "unknown table %q", name)
+		}
+		address, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return &indexNode{table, address}, p.expect("]")
+	}
+	if p.accept("(") {
+		fn, ok := scriptFunctions[name]
+		if !ok {
+			return nil, p.errorf(t, "unknown function %q", name)
+		}
+		var args []scriptNode
+		for !p.accept(")") {
+			if len(args) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		if len(args) < fn.min || fn.max >= 0 && len(args) > fn.max {
+			return nil, p.errorf(t, "wrong number of arguments for %s", name)
+		}
+		return &callNode{name, fn.call, args}, nil
+	}
+
+	switch {
+	case name == "true":
+		return &numberNode{1}, nil
+	case name == "false":
+		return &numberNode{0}, nil
+	case name == "pi":
+		return &numberNode{math.Pi}, nil
+	case p.vars[name]:
+		return &variableNode{name}, nil
+	case p.profile != nil && p.profile.Point(name) != nil:
+		return &pointNode{p.profile.Point(name)}, nil
+	}
+	return nil, p.errorf(t, "unknown name %q", name)
+}
+
+// Nodes.
+
+type numberNode struct {
+	value float64
+}
+
+func (n *numberNode) eval(env *scriptEnv) (float64, error) {
+	return n.value, nil
+}
+
+type variableNode struct {
+	name string
+}
+
+func (n *variableNode) eval(env *scriptEnv) (float64, error) {
+	return env.vars[n.name], nil
+}
+
+type pointNode struct {
+	point *Point
+}
+
+func (n *pointNode) eval(env *scriptEnv) (float64, error) {
+	value, err := n.point.Get(env.s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", n.point.Name, err)
+	}
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	}
+	return 0, fmt.Errorf("%s: %s points are not numbers", n.point.Name, n.point.Type)
+}
+
+type indexNode struct {
+	table   Table
+	address scriptNode
+}
+
+func (n *indexNode) resolve(env *scriptEnv) (int, error) {
+	address, err := n.address.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	if address != math.Trunc(address) || address < 0 || address > 65535 {
+		return 0, fmt.Errorf("%v[%v]: invalid address", n.table, address)
+	}
+	return int(address), nil
+}
+
+func (n *indexNode) eval(env *scriptEnv) (float64, error) {
+	address, err := n.resolve(env)
+	if err != nil {
+		return 0, err
+	}
+	return float64(env.s.readTable(n.table, address, 1)[0]), nil
+}
+
+type unaryNode struct {
+	op string
+	x  scriptNode
+}
+
+func (n *unaryNode) eval(env *scriptEnv) (float64, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	if n.op == "-" {
+		return -x, nil
+	}
+	return truth(x == 0), nil
+}
+
+type binaryNode struct {
+	op   string
+	x, y scriptNode
+}
+
+func truth(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (n *binaryNode) eval(env *scriptEnv) (float64, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	// && and || do not evaluate their right operand when the left decides.
+	switch {
+	case n.op == "&&" && x == 0:
+		return 0, nil
+	case n.op == "||" && x != 0:
+		return 1, nil
+	}
+	y, err := n.y.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/", "%":
+		if y == 0 {
+			return 0, errors.New("division by zero")
+		}
+		if n.op == "/" {
+			return x / y, nil
+		}
+		return math.Mod(x, y), nil
+	case "<":
+		return truth(x < y), nil
+	case "<=":
+		return truth(x <= y), nil
+	case ">":
+		return truth(x > y), nil
+	case ">=":
+		return truth(x >= y), nil
+	case "==":
+		return truth(x == y), nil
+	case "!=":
+		return truth(x != y), nil
+	}
+	// && and || with a left operand which did not decide.
+	return truth(y != 0), nil
+}
+
+type ternaryNode struct {
+	cond, then, otherwise scriptNode
+}
+
+func (n *ternaryNode) eval(env *scriptEnv) (float64, error) {
+	cond, err := n.cond.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	if cond != 0 {
+		return n.then.eval(env)
+	}
+	return n.otherwise.eval(env)
+}
+
+type callNode struct {
+	name string
+	call func(args []float64) (float64, error)
+	args []scriptNode
+}
+
+func (n *callNode) eval(env *scriptEnv) (float64, error) {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		var err error
+		if args[i], err = arg.eval(env); err != nil {
+			return 0, err
+		}
+	}
+	value, err := n.call(args)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", n.name, err)
+	}
+	return value, nil
+}
+
+// scriptFunction is a function of scripts with min to max arguments, max -1
+// meaning any number.
+type scriptFunction struct {
+	min, max int
+	call     func(args []float64) (float64, error)
+}
+
+func math1(f func(float64) float64) scriptFunction {
+	return scriptFunction{1, 1, func(args []float64) (float64, error) { return f(args[0]), nil }}
+}
+
+var scriptFunctions = map[string]scriptFunction{
+	"abs":   math1(math.Abs),
+	"round": math1(math.Round),
+	"floor": math1(math.Floor),
+	"ceil":  math1(math.Ceil),
+	"sqrt":  math1(math.Sqrt),
+	"sin":   math1(math.Sin),
+	"cos":   math1(math.Cos),
+	"int16": math1(func(x float64) float64 { return float64(int16(uint16(int64(x)))) }),
+	"min": {1, -1, func(args []float64) (float64, error) {
+		m := args[0]
+		for _, arg := range args[1:] {
+			m = math.Min(m, arg)
+		}
+		return m, nil
+	}},
+	"max": {1, -1, func(args []float64) (float64, error) {
+		m := args[0]
+		for _, arg := range args[1:] {
+			m = math.Max(m, arg)
+		}
+		return m, nil
+	}},
+	"clamp": {3, 3, func(args []float64) (float64, error) {
+		if args[1] > args[2] {
+			return 0, errors.New("lower bound is greater than upper bound")
+		}
+		return math.Max(args[1], math.Min(args[2], args[0])), nil
+	}},
+	"bit": {2, 2, func(args []float64) (float64, error) {
+		if args[1] < 0 || args[1] > 63 {
+			return 0, fmt.Errorf("invalid bit %v", args[1])
+		}
+		return float64(int64(args[0]) >> uint(args[1]) & 1), nil
+	}},
+	"rand": {0, 0, func([]float64) (float64, error) {
+		// The top-level source is safe for scripts of several servers.
+		return rand.Float64(), nil
+	}},
+	"now": {0, 0, func([]float64) (float64, error) {
+		return float64(time.Now().UnixNano()) / 1e9, nil
+	}},
+}
@@ -0,0 +1,116 @@
+package mbserver
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestScriptExpressions(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.HoldingRegisters[1] = 0xFFFE
+	s.Coils[2] = 1
+	tests := []struct {
+		source string
+		expect float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"-2 - -3", 1},
+		{"7 % 4 / 2", 1.5},
+		{"0x10 + 0b11", 19},
+		{"1 < 2 && 2 <= 2 && !(3 == 4)", 1},
+		{"0 || 3 > 4", 0},
+		{"c[2] ? 10 : 20", 10},
+		{"coils[3] ? 10 : c[2] ? 30 : 40", 30},
+		{"hr[1]", 65534},
+		{"int16(holding_registers[1])", -2},
+		{"clamp(15, 0, 10) + min(3, 1, 2) + max(4, 5) + abs(-1)", 17},
+		{"round(2.5) + floor(1.7) + ceil(1.2) + sqrt(9)", 9},
+		{"bit(6, 1) + bit(6, 0)", 1},
+		{"value * 2 # doubles", 8},
+	}
+	for _, test := range tests {
+		e, err := CompileExpression(test.source, nil, "value")
+		if err != nil {
+			t.Errorf("%s: expected nil, got %v", test.source, err)
+			continue
+		}
+		got, err := e.eval(s, map[string]float64{"value": 4})
+		if err != nil || math.Abs(got-test.expect) > 1e-9 {
+			t.Errorf("%s: expected %v, got %v %v", test.source, test.expect, got, err)
+		}
+	}
+}
+
+func TestScriptAssignments(t *testing.T) {
+	profile, err := ParseProfile([]byte("points:\n  - {name: level, table: holding_registers, address: 10, type: float32}\n"), "yaml")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s, err := NewServerFromProfile(profile)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer s.Close()
+
+	script, err := CompileScript(`
+		hr[0] = 5; hr[1] = -1
+		hr[0] += 2
+		coils[hr[0]] = 3 > 2
+		level = hr[0] / 2 +
+			0.25
+		level -= 1
+	`, profile)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := script.run(s, nil, ""); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if !isEqual([]uint16{7, 0xFFFF}, s.HoldingRegisters[0:2]) || s.Coils[7] != 1 {
+		t.Errorf("expected 7, 65535 and coil 7 set, got %v %v", s.HoldingRegisters[0:2], s.Coils[7])
+	}
+	if level, _ := profile.Point("level").Get(s); level != 2.75 {
+		t.Errorf("expected 2.75, got %v", level)
+	}
+
+	failures := map[string]string{
+		"hr[0] = 65536":          "out of range",
+		"hr[0] = 1 / 0":          "division by zero",
+		"hr[70000] = 1":          "invalid address",
+		"hr[0] = clamp(1, 2, 0)": "clamp: lower bound",
+	}
+	for source, expect := range failures {
+		script, err := CompileScript(source, profile)
+		if err != nil {
+			t.Errorf("%s: expected nil, got %v", source, err)
+			continue
+		}
+		if err := script.run(s, nil, ""); err == nil || !strings.Contains(err.Error(), expect) {
+			t.Errorf("%s: expected %q, got %v", source, expect, err)
+		}
+	}
+}
+
+func TestScriptCompileErrors(t *testing.T) {
+	tests := map[string]string{
+		"hr[0] = flow":     `position 9: unknown name "flow"`,
+		"registers[0] = 1": `position 1: unknown table "registers"`,
+		"hr[0] = log(1)":   `position 9: unknown function "log"`,
+		"hr[0] = min()":    "position 9: wrong number of arguments for min",
+		"1 = 2":            "position 1: expected a point or table address to assign",
+		"hr[0] == 1":       `position 7: expected an assignment, got "=="`,
+		"hr[0] = 1 2":      `position 11: expected the end of the statement, got "2"`,
+		"hr[0] = (1":       `position 11: expected ")" at the end`,
+		"hr[0] = 1 $":      `position 11: unexpected '$'`,
+		"hr[0] = 1.2.3":    `position 9: invalid number "1.2.3"`,
+		"hr[0] = value":    `position 9: unknown name "value"`,
+	}
+	for source, expect := range tests {
+		if _, err := CompileScript(source, nil); err == nil || err.Error() != expect {
+			t.Errorf("%s: expected %q, got %v", source, expect, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package mbserver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/goburrow/serial"
+)
+
+// maxASCIIFrame is the maximum length of a Modbus ASCII frame, from the
+// colon to the line feed.
+const maxASCIIFrame = 513
+
+var errASCIIFrameTooLong = fmt.Errorf("ASCII Frame error: frame exceeds %d characters", maxASCIIFrame)
+
+// ListenASCII starts the Modbus server listening for Modbus ASCII frames on a
+// serial device.
+// For example:  err := s.ListenASCII(&serial.Config{Address: "/dev/ttyUSB0", Parity: "E"})
+func (s *Server) ListenASCII(serialConfig *serial.Config) (err error) {
+	port, err := serial.Open(serialConfig)
+	if err != nil {
+		s.logger().Error("failed to open serial port", "listener", serialConfig.Address, "error", err)
+		return err
+	}
+	s.ports = append(s.ports, port)
+
+	s.portsWG.Add(1)
+	go func() {
+		defer s.portsWG.Done()
+		s.acceptASCIIRequests(port, serialConfig.Address)
+	}()
+
+	return err
+}
+
+func (s *Server) acceptASCIIRequests(port io.ReadWriteCloser, device string) {
+	buffer := make([]byte, 512)
+	var packet []byte
+	writer := &lateWriter{}
+	for {
+		select {
+		case <-s.portsCloseChan:
+			return
+		default:
+		}
+
+		bytesRead, err := port.Read(buffer)
+		if err == serial.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				s.logger().Error("serial read error", "listener", device, "error", err)
+			}
+			return
+		}
+
+		for _, b := range buffer[:bytesRead] {
+			if b == ':' {
+				// Start of frame, discard anything before it.
+				packet = packet[:0]
+			}
+			packet = append(packet, b)
+			if len(packet) > maxASCIIFrame {
+				s.Metrics.malformedFrame("ascii", errASCIIFrameTooLong)
+				s.logger().Warn("malformed frame", "listener", device, "error", errASCIIFrameTooLong)
+				packet = packet[:0]
+				continue
+			}
+			if b != '\n' {
+				continue
+			}
+
+			frame, err := NewASCIIFrame(packet)
+			if err != nil {
+				s.Metrics.malformedFrame("ascii", err)
+				s.logger().Warn("malformed frame", "listener", device, "error", err, "frame", hex.EncodeToString(packet))
+				packet = packet[:0]
+				continue
+			}
+			request := &Request{conn: port, frame: frame, transport: "ascii", listener: device, writer: writer}
+			s.logFrame("frame received", request, packet)
+			packet = packet[:0]
+
+			s.requestChan <- request
+		}
+	}
+}
@@ -4,16 +4,58 @@ package mbserver
 import (
 	"io"
 	"net"
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/goburrow/serial"
 )
 
 // Server is a Modbus slave with allocated memory for discrete inputs, coils, etc.
 type Server struct {
-	// Debug enables more verbose messaging.
-	Debug            bool
+	// Debug enables hex dumps of received and sent frames at debug level.
+	Debug bool
+	// Logger receives structured log events, the slog default logger is used when nil.
+	Logger Logger
+	// MaxConnections limits the number of concurrent TCP connections, zero means unlimited.
+	MaxConnections int
+	// MaxConnectionsPerIP limits the number of concurrent TCP connections from one source IP, zero means unlimited.
+	MaxConnectionsPerIP int
+	// IdleTimeout closes TCP connections that have not sent a request within the duration, zero disables the timeout.
+	IdleTimeout time.Duration
+	// EvictOldestIdle closes the longest idle connection when a connection limit is reached
+	// instead of rejecting the new connection.
+	EvictOldestIdle bool
+	// Policy controls which requests are passed to the function handlers, nil allows all requests.
+	Policy *Policy
+	// Metrics counts requests, exceptions and connections when not nil.
+	Metrics *Metrics
+	// Capture records requests and responses to a pcapng stream when not nil.
+	Capture *Capture
+	// Gateway forwards requests to downstream devices by unit ID when not nil.
+	Gateway *Gateway
+	// Mapping translates request addresses before they are handled or forwarded when not nil.
+	Mapping *Mapping
+	// Identification is returned by Read Device Identification (function 43) when not nil.
+	Identification *DeviceIdentification
+	// Persistence records writes to coils and holding registers when not nil.
+	Persistence *Persistence
+	// LineTiming emulates the timing of the serial line on RTU ports when not nil.
+	LineTiming *LineTiming
+	// Faults injects faults into the requests of Modbus clients when not nil.
+	Faults *Faults
+	// Profile is the device profile the server was built from, if any.
+	Profile          *Profile
+	httpServers      []*http.Server
 	listeners        []net.Listener
+	packetConns      []net.PacketConn
+	conns            map[*tcpConn]struct{}
+	connsMutex       sync.Mutex
+	dataMutex        sync.Mutex
+	subscribers      subscribers
+	bridges          []*MQTTBridge
+	bridgesMutex     sync.Mutex
+	behaviors        []*Behavior
 	ports            []serial.Port
 	portsWG          sync.WaitGroup
 	portsCloseChan   chan struct{}
@@ -27,8 +69,18 @@ type Server struct {
 
 // Request contains the connection and Modbus frame.
 type Request struct {
-	conn  io.ReadWriteCloser
-	frame Framer
+	conn      io.ReadWriteCloser
+	frame     Framer
+	transport string
+	readOnly  bool
+	listener  string
+	client    string
+	identity  string
+	// writer writes the responses of the request's connection, nil writes
+	// them on the handler.
+	writer *lateWriter
+	// line is the timing of the response on a serial line, if emulated.
+	line *lineSchedule
 }
 
 // NewServer creates a new Modbus server (slave).
@@ -41,6 +93,8 @@ func NewServer() *Server {
 	s.HoldingRegisters = make([]uint16, 65536)
 	s.InputRegisters = make([]uint16, 65536)
 
+	s.conns = make(map[*tcpConn]struct{})
+
 	// Add default functions.
 	s.function[1] = ReadCoils
 	s.function[2] = ReadDiscreteInputs
@@ -50,6 +104,7 @@ func NewServer() *Server {
 	s.function[6] = WriteHoldingRegister
 	s.function[15] = WriteMultipleCoils
 	s.function[16] = WriteHoldingRegisters
+	s.function[43] = ReadDeviceIdentification
 
 	s.requestChan = make(chan *Request)
 	s.portsCloseChan = make(chan struct{})
@@ -65,17 +120,29 @@ func (s *Server) RegisterFunctionHandler(funcCode uint8, function func(*Server,
 }
 
 func (s *Server) handle(request *Request) Framer {
-	var exception *Exception
 	var data []byte
+	var frame Framer
+	var rule *MapRule
 
 	response := request.frame.Copy()
 
-	function := request.frame.GetFunction()
-	if s.function[function] != nil {
-		data, exception = s.function[function](s, request.frame)
+	exception := s.authorize(request)
+	if exception == nil {
+		frame, rule, exception = s.translate(request)
+	}
+	if exception == nil {
+		function := frame.GetFunction()
+		if forwarded, forwardException, ok := s.forward(frame); ok {
+			data, exception = forwarded, forwardException
+		} else if s.function[function] != nil {
+			data, exception = s.call(request, frame)
+		} else {
+			exception = &IllegalFunction
+		}
+		if rule != nil && exception == &Success {
+			data = rule.response(request.frame, data)
+		}
 		response.SetData(data)
-	} else {
-		exception = &IllegalFunction
 	}
 
 	if exception != &Success {
@@ -85,20 +152,229 @@ func (s *Server) handle(request *Request) Framer {
 	return response
 }
 
+// call passes the frame to its function handler, holding the data lock so
+// that snapshots and restores see the tables between requests.
+func (s *Server) call(request *Request, frame Framer) ([]byte, *Exception) {
+	s.dataMutex.Lock()
+	defer s.dataMutex.Unlock()
+
+	var event *ChangeEvent
+	var old []uint16
+	table, address, number, ok := writeRange(frame)
+	if ok && (len(s.behaviors) > 0 || s.subscribed()) {
+		old = s.readTable(table, address, number)
+		if s.subscribed() {
+			event = &ChangeEvent{Table: table, Address: uint16(address), Old: old,
+				UnitID: getDevice(frame), Client: request.client, Identity: request.identity}
+		}
+	}
+
+	data, exception := s.function[frame.GetFunction()](s, frame)
+	if exception == &Success {
+		if err := s.Persistence.record(s, frame); err != nil {
+			s.logger().Error("persistence error", append(requestFields(request), "error", err)...)
+		}
+		if event != nil {
+			event.Time = time.Now()
+			event.New = s.readTable(event.Table, int(event.Address), len(event.Old))
+			s.publish(*event)
+		}
+		if old != nil {
+			s.triggerBehaviors(request, table, address, old)
+		}
+	}
+	return data, exception
+}
+
+// authorize returns nil if the request may be passed to its function handler,
+// otherwise the exception to respond with.
+func (s *Server) authorize(request *Request) *Exception {
+	if request.readOnly && isWriteFunction(request.frame.GetFunction()) {
+		return &IllegalFunction
+	}
+	if s.Policy != nil {
+		return s.Policy.check(request, s.logger())
+	}
+	return nil
+}
+
+// translate applies the Mapping to the request frame.
+func (s *Server) translate(request *Request) (Framer, *MapRule, *Exception) {
+	if s.Mapping == nil {
+		return request.frame, nil, nil
+	}
+	return s.Mapping.translate(request.frame)
+}
+
+// forward passes the frame to the Gateway, ok is false if it is to be
+// handled locally.
+func (s *Server) forward(frame Framer) (data []byte, exception *Exception, ok bool) {
+	if s.Gateway == nil {
+		return nil, nil, false
+	}
+	return s.Gateway.forward(frame)
+}
+
 // All requests are handled synchronously to prevent modbus memory corruption.
 func (s *Server) handler() {
 	for {
 		request := <-s.requestChan
-		response := s.handle(request)
-		request.conn.Write(response.Bytes())
+		s.respond(request)
 	}
 }
 
+// respond handles the request and writes the response to its connection.
+func (s *Server) respond(request *Request) {
+	start := time.Now()
+	faults := s.Faults.inject(request)
+	if len(faults.faults) > 0 {
+		s.logger().Debug("fault injected", append(requestFields(request), "faults", faults.faults)...)
+		s.Metrics.injectedFaults(faults.faults)
+	}
+	if faults.has(FaultDrop) || faults.has(FaultClose) {
+		s.Metrics.observeRequest(request, Success, time.Since(start))
+		s.publishRequest(request, Success, start, faults.faults)
+		s.capture(request, nil)
+		if conn, ok := request.conn.(*tcpConn); ok && faults.has(FaultClose) {
+			// Close after the responses still pending on the connection.
+			request.writer.schedule(time.Now(), func() { conn.Close() })
+		}
+		return
+	}
+
+	var response Framer
+	if faults.exception != nil {
+		response = request.frame.Copy()
+		response.SetException(faults.exception)
+	} else {
+		response = s.handle(request)
+	}
+	exception := GetException(response)
+	s.Metrics.observeRequest(request, exception, time.Since(start))
+	s.publishRequest(request, exception, start, faults.faults)
+	if exception != Success {
+		s.logger().Debug("exception response", append(requestFields(request), "exception", exception.String())...)
+	}
+
+	packet := faults.corrupt(request.frame, response.Bytes())
+	at := time.Now()
+	if request.line != nil {
+		at = request.line.at(len(packet))
+	}
+	request.writer.schedule(at.Add(faults.delay), func() {
+		s.logFrame("frame sent", request, packet)
+		s.capture(request, packet)
+		if _, err := request.conn.Write(packet); err != nil {
+			s.logger().Error("write error", append(requestFields(request), "error", err)...)
+		}
+	})
+}
+
+// capture writes the request and its response, nil if none is sent, to the
+// capture file if any. Requests of the REST API, MQTT bridges and replays,
+// which have no wire traffic, are not captured.
+func (s *Server) capture(request *Request, response []byte) {
+	if s.Capture == nil {
+		return
+	}
+	if _, ok := request.conn.(*replayConn); ok {
+		return
+	}
+	if err := s.Capture.captureRequest(request, response); err != nil {
+		s.logger().Error("capture error", append(requestFields(request), "error", err)...)
+	}
+}
+
+// lateWriter runs the writes of a connection at their times, in order, on
+// its own goroutine so that they do not hold up the handler.
+type lateWriter struct {
+	mutex sync.Mutex
+	queue []lateWrite
+	busy  bool
+}
+
+type lateWrite struct {
+	at    time.Time
+	write func()
+}
+
+// schedule runs the write at the time, after the writes scheduled before.
+// Writes due with none pending run at once.
+func (w *lateWriter) schedule(at time.Time, write func()) {
+	if w == nil {
+		time.Sleep(time.Until(at))
+		write()
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.busy && !time.Now().Before(at) {
+		write()
+		return
+	}
+	w.queue = append(w.queue, lateWrite{at, write})
+	if !w.busy {
+		w.busy = true
+		go w.run()
+	}
+}
+
+func (w *lateWriter) run() {
+	for {
+		w.mutex.Lock()
+		if len(w.queue) == 0 {
+			w.busy = false
+			w.mutex.Unlock()
+			return
+		}
+		next := w.queue[0]
+		w.queue = w.queue[1:]
+		w.mutex.Unlock()
+
+		time.Sleep(time.Until(next.at))
+		next.write()
+	}
+}
+
+// dispatch queues requests for the synchronous handler. Requests forwarded by
+// the Gateway do not access the server memory and are handled immediately on
+// the calling goroutine, so that slow upstream devices do not hold up local
+// requests.
+func (s *Server) dispatch(request *Request) {
+	if s.Gateway != nil {
+		frame, _, exception := s.translate(request)
+		if exception != nil || !s.Gateway.handlesLocally(frame) {
+			s.respond(request)
+			return
+		}
+	}
+	s.requestChan <- request
+}
+
 // Close stops listening to TCP/IP ports and closes serial ports.
 func (s *Server) Close() {
 	for _, listen := range s.listeners {
 		listen.Close()
 	}
+	for _, conn := range s.packetConns {
+		conn.Close()
+	}
+
+	s.closeConns()
+
+	for _, httpServer := range s.httpServers {
+		httpServer.Close()
+	}
+
+	s.bridgesMutex.Lock()
+	for _, bridge := range s.bridges {
+		bridge.Close()
+	}
+	s.bridgesMutex.Unlock()
+
+	if s.Gateway != nil {
+		s.Gateway.close()
+	}
 
 	close(s.portsCloseChan)
 	s.portsWG.Wait()
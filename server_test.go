@@ -1,6 +1,7 @@
 package mbserver
 
 import (
+	"net"
 	"testing"
 	"time"
 
@@ -136,3 +137,56 @@ func TestModbus(t *testing.T) {
 		t.Errorf("expected %v, got %v", expect, got)
 	}
 }
+
+func TestModbusUDP(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.HoldingRegisters[10] = 1234
+	if err := s.ListenUDP("127.0.0.1:0"); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+
+	conn, err := net.Dial("udp", s.packetConns[0].LocalAddr().String())
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer conn.Close()
+	frame := &TCPFrame{TransactionIdentifier: 7, Device: 1, Function: 3}
+	SetDataWithRegisterAndNumber(frame, 10, 1)
+	conn.Write(frame.Bytes())
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packet := make([]byte, 512)
+	n, err := conn.Read(packet)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	response, err := NewTCPFrame(packet[:n])
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []byte{2, 0x04, 0xD2}
+	if response.TransactionIdentifier != 7 || !isEqual(expect, response.GetData()) {
+		t.Errorf("expected %v, got %v", expect, response.GetData())
+	}
+}
+
+func TestModbusASCII(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.InputRegisters[7] = 0x1234
+	clientPort, serverPort := net.Pipe()
+	go s.acceptASCIIRequests(serverPort, "pipe")
+
+	client := newClient(&serialTransport{framing: asciiFraming, port: clientPort})
+	defer client.Close()
+	// Noise before the start of the frame is discarded.
+	clientPort.Write([]byte("\x00\xff"))
+	registers, err := client.ReadInputRegisters(7, 1)
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if !isEqual([]uint16{0x1234}, registers) {
+		t.Errorf("expected %v, got %v", []uint16{0x1234}, registers)
+	}
+}
@@ -1,8 +1,9 @@
 package mbserver
 
 import (
+	"encoding/hex"
 	"io"
-	"log"
+	"time"
 
 	"github.com/goburrow/serial"
 )
@@ -12,20 +13,23 @@ import (
 func (s *Server) ListenRTU(serialConfig *serial.Config) (err error) {
 	port, err := serial.Open(serialConfig)
 	if err != nil {
-		log.Fatalf("failed to open %s: %v\n", serialConfig.Address, err)
+		s.logger().Error("failed to open serial port", "listener", serialConfig.Address, "error", err)
+		return err
 	}
 	s.ports = append(s.ports, port)
 
 	s.portsWG.Add(1)
 	go func() {
 		defer s.portsWG.Done()
-		s.acceptSerialRequests(port)
+		s.acceptSerialRequests(port, serialConfig)
 	}()
 
 	return err
 }
 
-func (s *Server) acceptSerialRequests(port serial.Port) {
+func (s *Server) acceptSerialRequests(port io.ReadWriteCloser, serialConfig *serial.Config) {
+	device := serialConfig.Address
+	writer := &lateWriter{}
 	SkipFrameError:
 	for {
 		select {
@@ -37,9 +41,12 @@ func (s *Server) acceptSerialRequests(port serial.Port) {
 		buffer := make([]byte, 512)
 
 		bytesRead, err := port.Read(buffer)
+		if err == serial.ErrTimeout {
+			continue
+		}
 		if err != nil {
 			if err != io.EOF {
-				log.Printf("serial read error %v\n", err)
+				s.logger().Error("serial read error", "listener", device, "error", err)
 			}
 			return
 		}
@@ -51,15 +58,19 @@ func (s *Server) acceptSerialRequests(port serial.Port) {
 
 			frame, err := NewRTUFrame(packet)
 			if err != nil {
-				log.Printf("bad serial frame error %v\n", err)
+				s.Metrics.malformedFrame("rtu", err)
+				s.logger().Warn("malformed frame", "listener", device, "error", err, "frame", hex.EncodeToString(packet))
 				//The next line prevents RTU server from exiting when it receives a bad frame. Simply discard the erroneous 
 				//frame and wait for next frame by jumping back to the beginning of the 'for' loop.
-				log.Printf("Keep the RTU server running!!\n")
 				continue SkipFrameError
 				//return
 			}
 
-			request := &Request{port, frame}
+			request := &Request{conn: port, frame: frame, transport: "rtu", listener: device, writer: writer}
+			if s.LineTiming != nil {
+				request.line = s.LineTiming.schedule(serialConfig, time.Now(), bytesRead)
+			}
+			s.logFrame("frame received", request, packet)
 
 			s.requestChan <- request
 		}
@@ -2,72 +2,143 @@ package mbserver
 
 import (
 	"crypto/tls"
+	"encoding/hex"
 	"io"
-	"log"
 	"net"
 	"strings"
+	"time"
 )
 
-func (s *Server) accept(listen net.Listener) error {
+func (s *Server) accept(listen net.Listener, transport string, filter *IPFilter) error {
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") {
+			if isClosedConnError(err) {
 				return nil
 			}
-			log.Printf("Unable to accept connections: %#v\n", err)
+			s.logger().Error("unable to accept connections", "listener", listen.Addr().String(), "error", err)
 			return err
 		}
 
-		go func(conn net.Conn) {
+		listener := listen.Addr().String()
+		remote := conn.RemoteAddr().String()
+
+		accepted, write := filter.Check(net.ParseIP(remoteIP(conn)))
+		if !accepted {
+			s.logger().Warn("connection rejected", "listener", listener, "remote", remote, "reason", "denied by IP filter")
+			conn.Close()
+			continue
+		}
+
+		c, ok := s.addConn(conn)
+		if !ok {
+			s.logger().Warn("connection rejected", "listener", listener, "remote", remote, "reason", "connection limit reached")
+			conn.Close()
+			continue
+		}
+		s.logger().Debug("connection accepted", "listener", listener, "remote", remote, "read_only", !write)
+
+		go func(conn *tcpConn, readOnly bool) {
+			defer s.removeConn(conn)
 			defer conn.Close()
+			defer s.logger().Debug("connection closed", "listener", listener, "remote", remote)
+			writer := &lateWriter{}
 
 			for {
+				if s.IdleTimeout > 0 {
+					conn.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+				}
+
 				packet := make([]byte, 512)
 				bytesRead, err := conn.Read(packet)
 				if err != nil {
-					if err != io.EOF {
-						log.Printf("read error %v\n", err)
+					if ne, ok := err.(net.Error); ok && ne.Timeout() {
+						s.logger().Debug("idle timeout", "listener", listener, "remote", remote)
+					} else if err != io.EOF && !isClosedConnError(err) {
+						s.logger().Error("read error", "listener", listener, "remote", remote, "error", err)
 					}
 					return
 				}
+				s.touchConn(conn)
 				// Set the length of the packet to the number of read bytes.
 				packet = packet[:bytesRead]
 
 				frame, err := NewTCPFrame(packet)
 				if err != nil {
-					log.Printf("bad packet error %v\n", err)
+					s.Metrics.malformedFrame(transport, err)
+					s.logger().Warn("malformed frame", "listener", listener, "remote", remote,
+						"error", err, "frame", hex.EncodeToString(packet))
 					return
 				}
 
-				request := &Request{conn, frame}
+				request := &Request{
+					conn:      conn,
+					frame:     frame,
+					transport: transport,
+					readOnly:  readOnly,
+					listener:  listener,
+					client:    conn.ip,
+					identity:  tlsIdentity(conn.Conn),
+					writer:    writer,
+				}
+				s.logFrame("frame received", request, packet)
 
-				s.requestChan <- request
+				s.dispatch(request)
 			}
-		}(conn)
+		}(c, !write)
+	}
+}
+
+// tlsIdentity returns the common name of the client certificate on TLS
+// connections.
+func tlsIdentity(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return ""
 	}
+	return certificates[0].Subject.CommonName
+}
+
+func isClosedConnError(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
 }
 
 // ListenTCP starts the Modbus server listening on "address:port".
 func (s *Server) ListenTCP(addressPort string) (err error) {
+	return s.ListenTCPWithFilter(addressPort, nil)
+}
+
+// ListenTCPWithFilter starts the Modbus server listening on "address:port",
+// accepting only clients permitted by the IP filter.
+func (s *Server) ListenTCPWithFilter(addressPort string, filter *IPFilter) (err error) {
 	listen, err := net.Listen("tcp", addressPort)
 	if err != nil {
-		log.Printf("Failed to Listen: %v\n", err)
+		s.logger().Error("failed to listen", "listener", addressPort, "error", err)
 		return err
 	}
 	s.listeners = append(s.listeners, listen)
-	go s.accept(listen)
+	go s.accept(listen, "tcp", filter)
 	return err
 }
 
 // ListenTLS starts the Modbus server listening on "address:port".
 func (s *Server) ListenTLS(addressPort string, config *tls.Config) (err error) {
+	return s.ListenTLSWithFilter(addressPort, config, nil)
+}
+
+// ListenTLSWithFilter starts the Modbus server listening on "address:port",
+// accepting only clients permitted by the IP filter.
+func (s *Server) ListenTLSWithFilter(addressPort string, config *tls.Config, filter *IPFilter) (err error) {
 	listen, err := tls.Listen("tcp", addressPort, config)
 	if err != nil {
-		log.Printf("Failed to Listen on TLS: %v\n", err)
+		s.logger().Error("failed to listen on TLS", "listener", addressPort, "error", err)
 		return err
 	}
 	s.listeners = append(s.listeners, listen)
-	go s.accept(listen)
+	go s.accept(listen, "tls", filter)
 	return err
 }
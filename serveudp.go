@@ -0,0 +1,87 @@
+package mbserver
+
+import (
+	"encoding/hex"
+	"io"
+	"net"
+)
+
+// ListenUDP starts the Modbus server listening for Modbus TCP frames in UDP
+// datagrams on "address:port", answering each datagram with a datagram.
+func (s *Server) ListenUDP(addressPort string) (err error) {
+	conn, err := net.ListenPacket("udp", addressPort)
+	if err != nil {
+		s.logger().Error("failed to listen on UDP", "listener", addressPort, "error", err)
+		return err
+	}
+	s.packetConns = append(s.packetConns, conn)
+	go s.acceptDatagrams(conn)
+	return err
+}
+
+func (s *Server) acceptDatagrams(conn net.PacketConn) {
+	listener := conn.LocalAddr().String()
+	for {
+		packet := make([]byte, 512)
+		bytesRead, addr, err := conn.ReadFrom(packet)
+		if err != nil {
+			if !isClosedConnError(err) {
+				s.logger().Error("UDP read error", "listener", listener, "error", err)
+			}
+			return
+		}
+		packet = packet[:bytesRead]
+
+		frame, err := NewTCPFrame(packet)
+		if err != nil {
+			s.Metrics.malformedFrame("udp", err)
+			s.logger().Warn("malformed frame", "listener", listener, "remote", addr.String(),
+				"error", err, "frame", hex.EncodeToString(packet))
+			continue
+		}
+
+		client := addr.String()
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+		request := &Request{
+			conn:      &datagramConn{conn, addr},
+			frame:     frame,
+			transport: "udp",
+			listener:  listener,
+			client:    client,
+			writer:    &lateWriter{},
+		}
+		s.logFrame("frame received", request, packet)
+
+		s.dispatch(request)
+	}
+}
+
+// datagramConn writes responses to the sender of a datagram.
+type datagramConn struct {
+	conn net.PacketConn
+	addr net.Addr
+}
+
+func (c *datagramConn) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *datagramConn) Write(p []byte) (int, error) {
+	return c.conn.WriteTo(p, c.addr)
+}
+
+func (c *datagramConn) Close() error {
+	return nil
+}
+
+// LocalAddr returns the listener address.
+func (c *datagramConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the sender.
+func (c *datagramConn) RemoteAddr() net.Addr {
+	return c.addr
+}
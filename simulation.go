@@ -0,0 +1,252 @@
+package mbserver
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Simulation drives a point of the server's Profile with a generator,
+// updating it on every interval:
+//
+//	sine         oscillates between Min and Max over Period, starting halfway
+//	ramp         rises from Min to Max over Period, then starts again
+//	square       is Min for the first half of Period and Max for the second
+//	random_walk  starts halfway and moves by up to Step per update within Min and Max
+//	counter      counts from Min by Step, wrapping after Max if Max > Min
+//	csv          plays back a column of File, one row per update, repeating
+//
+// Bool points are set when the value is not zero and integer points are set
+// to the nearest integer.
+type Simulation struct {
+	// Point is the name of the profile point driven.
+	Point     string `json:"point" yaml:"point"`
+	Generator string `json:"generator" yaml:"generator"`
+	// Interval is the time between updates, such as "500ms", "1s" when empty.
+	Interval string `json:"interval" yaml:"interval"`
+	// Period is the period of the sine, ramp and square waves, "1m" when empty.
+	Period string  `json:"period" yaml:"period"`
+	Min    float64 `json:"min" yaml:"min"`
+	Max    float64 `json:"max" yaml:"max"`
+	// Step is the increment of the counter, 1 when zero, and the largest
+	// change of the random walk, a hundredth of Max - Min when zero.
+	Step float64 `json:"step" yaml:"step"`
+	// Seed seeds the random walk, zero seeds it from the time.
+	Seed int64 `json:"seed" yaml:"seed"`
+	// File is the CSV file played back. Its first line names the columns.
+	File string `json:"file" yaml:"file"`
+	// Column is the name of the column played back, the first when empty.
+	Column   string `json:"column" yaml:"column"`
+	point    *Point
+	interval time.Duration
+	period   time.Duration
+}
+
+// generator returns the value of a simulation at the time elapsed since it
+// started. It is called once per update.
+type generator func(elapsed time.Duration) float64
+
+func parseDuration(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+// validate checks the simulation and resolves its point in the profile.
+func (sim *Simulation) validate(p *Profile) error {
+	var err error
+	if sim.point = p.Point(sim.Point); sim.point == nil {
+		return fmt.Errorf("unknown point %q", sim.Point)
+	}
+	if sim.interval, err = parseDuration(sim.Interval, time.Second); err != nil {
+		return fmt.Errorf("interval: %v", err)
+	}
+	if sim.period, err = parseDuration(sim.Period, time.Minute); err != nil {
+		return fmt.Errorf("period: %v", err)
+	}
+	switch sim.Generator {
+	case "sine", "ramp", "square", "random_walk":
+		if sim.Min > sim.Max {
+			return errors.New("min is greater than max")
+		}
+	case "counter":
+	case "csv":
+		if sim.File == "" {
+			return errors.New("generator csv requires a file")
+		}
+	default:
+		return fmt.Errorf("unknown generator %q", sim.Generator)
+	}
+	return nil
+}
+
+// generator returns the simulation's generator, reading the CSV file.
+func (sim *Simulation) generator() (generator, error) {
+	span := sim.Max - sim.Min
+	phase := func(elapsed time.Duration) float64 {
+		return float64(elapsed%sim.period) / float64(sim.period)
+	}
+	switch sim.Generator {
+	case "sine":
+		return func(elapsed time.Duration) float64 {
+			return sim.Min + span*(1+math.Sin(2*math.Pi*phase(elapsed)))/2
+		}, nil
+	case "ramp":
+		return func(elapsed time.Duration) float64 {
+			return sim.Min + span*phase(elapsed)
+		}, nil
+	case "square":
+		return func(elapsed time.Duration) float64 {
+			if phase(elapsed) < 0.5 {
+				return sim.Min
+			}
+			return sim.Max
+		}, nil
+	case "random_walk":
+		seed := sim.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		random := rand.New(rand.NewSource(seed))
+		step := sim.Step
+		if step == 0 {
+			step = span / 100
+		}
+		value := sim.Min + span/2
+		return func(time.Duration) float64 {
+			value = math.Max(sim.Min, math.Min(sim.Max, value+(2*random.Float64()-1)*step))
+			return value
+		}, nil
+	case "counter":
+		step := sim.Step
+		if step == 0 {
+			step = 1
+		}
+		value := sim.Min - step
+		return func(time.Duration) float64 {
+			value += step
+			if sim.Max > sim.Min && value > sim.Max {
+				value = sim.Min
+			}
+			return value
+		}, nil
+	case "csv":
+		values, err := readCSVColumn(sim.File, sim.Column)
+		if err != nil {
+			return nil, err
+		}
+		row := -1
+		return func(time.Duration) float64 {
+			row = (row + 1) % len(values)
+			return values[row]
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown generator %q", sim.Generator)
+}
+
+// readCSVColumn reads the numbers of the named column, or the first column,
+// of a CSV file with a header line.
+func readCSVColumn(filename string, column string) ([]float64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("%s: no rows", filename)
+	}
+
+	index := 0
+	if column != "" {
+		index = -1
+		for i, name := range records[0] {
+			if name == column {
+				index = i
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("%s: unknown column %q", filename, column)
+		}
+	}
+	values := make([]float64, len(records)-1)
+	for i, record := range records[1:] {
+		if values[i], err = strconv.ParseFloat(record[index], 64); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid number %q", filename, i+2, record[index])
+		}
+	}
+	return values, nil
+}
+
+// simulatedValue converts a generated value for the point's type.
+func simulatedValue(point *Point, value float64) interface{} {
+	switch point.Type {
+	case "bool":
+		return value != 0
+	case "string":
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	case "float32", "float64":
+		return value
+	}
+	return math.Round(value)
+}
+
+// Simulate starts driving points of the server's Profile with the
+// simulations until the server is closed. Values are updated between
+// requests. Values out of the range of a point's type are logged and skipped.
+func (s *Server) Simulate(simulations ...*Simulation) error {
+	if s.Profile == nil {
+		return errors.New("simulation: the server has no profile")
+	}
+	generators := make([]generator, len(simulations))
+	for i, sim := range simulations {
+		if err := sim.validate(s.Profile); err != nil {
+			return fmt.Errorf("simulations[%d] (%s): %v", i, sim.Point, err)
+		}
+		var err error
+		if generators[i], err = sim.generator(); err != nil {
+			return fmt.Errorf("simulations[%d] (%s): %v", i, sim.Point, err)
+		}
+	}
+	for i, sim := range simulations {
+		go s.simulate(sim, generators[i])
+	}
+	return nil
+}
+
+func (s *Server) simulate(sim *Simulation, next generator) {
+	ticker := time.NewTicker(sim.interval)
+	defer ticker.Stop()
+	start := time.Now()
+	failed := false
+	for now := start; ; {
+		value := simulatedValue(sim.point, next(now.Sub(start)))
+		s.dataMutex.Lock()
+		err := s.writePoint(sim.point, value, ChangeEvent{Source: "simulation " + sim.Point})
+		s.dataMutex.Unlock()
+		// Log the first of consecutive errors only.
+		if err != nil && !failed {
+			s.logger().Warn("simulation error", "point", sim.Point, "generator", sim.Generator, "error", err)
+		}
+		failed = err != nil
+
+		select {
+		case <-s.portsCloseChan:
+			return
+		case now = <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package mbserver
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func simulationProfile(t *testing.T, simulations string) *Profile {
+	profile, err := ParseProfile([]byte(`
+points:
+  - {name: level, table: input_registers, address: 0, type: float32}
+  - {name: count, table: input_registers, address: 2, type: uint16}
+  - {name: running, table: discrete_inputs, address: 0, type: bool}
+simulations:
+`+simulations), "yaml")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	return profile
+}
+
+func TestSimulationGenerators(t *testing.T) {
+	profile := simulationProfile(t, `
+  - {point: level, generator: sine, period: 4s, min: 10, max: 20}
+  - {point: level, generator: ramp, period: 4s, min: 0, max: 100}
+  - {point: running, generator: square, period: 2s, max: 1}
+  - {point: count, generator: counter, min: 5, max: 7}
+  - {point: level, generator: random_walk, min: 0, max: 1, step: 0.5, seed: 1}
+`)
+	expect := [][]float64{
+		{15, 20, 15, 10, 15},
+		{0, 25, 50, 75, 0},
+		{0, 1, 0, 1, 0},
+		{5, 6, 7, 5, 6},
+	}
+	for i, values := range expect {
+		next, err := profile.Simulations[i].generator()
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		for j, value := range values {
+			elapsed := time.Duration(j) * time.Second
+			if got := next(elapsed); math.Abs(got-value) > 1e-9 {
+				t.Errorf("%s at %v: expected %v, got %v", profile.Simulations[i].Generator, elapsed, value, got)
+			}
+		}
+	}
+
+	next, _ := profile.Simulations[4].generator()
+	previous := 0.5
+	for i := 0; i < 100; i++ {
+		value := next(0)
+		if value < 0 || value > 1 || math.Abs(value-previous) > 0.5 {
+			t.Fatalf("expected a step within 0 and 1, got %v after %v", value, previous)
+		}
+		previous = value
+	}
+}
+
+func TestSimulationCSV(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "level.csv")
+	os.WriteFile(file, []byte("time,level\n0,1.5\n1,2.5\n"), 0644)
+	profile := simulationProfile(t, "  - {point: level, generator: csv, file: "+file+", column: level}\n")
+	next, err := profile.Simulations[0].generator()
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	for _, value := range []float64{1.5, 2.5, 1.5} {
+		if got := next(0); got != value {
+			t.Errorf("expected %v, got %v", value, got)
+		}
+	}
+
+	profile.Simulations[0].Column = "flow"
+	if _, err := profile.Simulations[0].generator(); err == nil || !strings.Contains(err.Error(), `unknown column "flow"`) {
+		t.Errorf("expected unknown column, got %v", err)
+	}
+}
+
+func TestSimulationValidate(t *testing.T) {
+	for simulation, expect := range map[string]string{
+		"{point: flow, generator: sine}":              `simulations[0] (flow): unknown point "flow"`,
+		"{point: level, generator: noise}":            `simulations[0] (level): unknown generator "noise"`,
+		"{point: level, generator: ramp, min: 2}":     "simulations[0] (level): min is greater than max",
+		"{point: level, generator: csv}":              "simulations[0] (level): generator csv requires a file",
+		"{point: level, generator: sine, period: 0s}": `simulations[0] (level): period: invalid duration "0s"`,
+	} {
+		_, err := ParseProfile([]byte("points: [{name: level, table: input_registers, address: 0, type: float32}]\n"+
+			"simulations: ["+simulation+"]\n"), "yaml")
+		if err == nil || err.Error() != expect {
+			t.Errorf("expected %q, got %v", expect, err)
+		}
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	profile := simulationProfile(t, `
+  - {point: count, generator: counter, interval: 5ms}
+  - {point: running, generator: square, interval: 5ms, period: 1h, min: 1, max: 1}
+`)
+	s, err := NewServerFromProfile(profile)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := s.Simulate(profile.Simulations...); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	var count uint16
+	for start := time.Now(); time.Since(start) < 5*time.Second && count < 3; time.Sleep(5 * time.Millisecond) {
+		s.dataMutex.Lock()
+		count = s.InputRegisters[2]
+		s.dataMutex.Unlock()
+	}
+	if count < 3 {
+		t.Errorf("expected the counter to count, got %v", count)
+	}
+	s.dataMutex.Lock()
+	running := s.DiscreteInputs[0]
+	s.dataMutex.Unlock()
+	if running != 1 {
+		t.Errorf("expected 1, got %v", running)
+	}
+	s.Close()
+
+	if err := NewServer().Simulate(profile.Simulations...); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
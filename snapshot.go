@@ -0,0 +1,332 @@
+package mbserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const snapshotBinaryMagic = "MBSNAP1\x00"
+
+// Snapshot is a copy of all four tables of a server at a point in time. It
+// serializes to a compact binary form with MarshalBinary and a line based
+// text form with MarshalText, both storing only the runs of non-zero values.
+type Snapshot struct {
+	Time             time.Time
+	DiscreteInputs   []byte
+	Coils            []byte
+	HoldingRegisters []uint16
+	InputRegisters   []uint16
+}
+
+// Difference is an address whose value differs between two snapshots. Bits
+// are reported as 0 or 1.
+type Difference struct {
+	Table   Table
+	Address uint16
+	Old     uint16
+	New     uint16
+}
+
+func (d Difference) String() string {
+	return fmt.Sprintf("%v %d: %d -> %d", d.Table, d.Address, d.Old, d.New)
+}
+
+// Snapshot returns a copy of the server's tables, taken between requests.
+func (s *Server) Snapshot() *Snapshot {
+	s.dataMutex.Lock()
+	defer s.dataMutex.Unlock()
+	return &Snapshot{
+		Time:             time.Now(),
+		DiscreteInputs:   append([]byte(nil), s.DiscreteInputs...),
+		Coils:            append([]byte(nil), s.Coils...),
+		HoldingRegisters: append([]uint16(nil), s.HoldingRegisters...),
+		InputRegisters:   append([]uint16(nil), s.InputRegisters...),
+	}
+}
+
+// Restore replaces the server's tables with the snapshot between requests,
+// so that no request sees a partly restored state. The restored coils and
+// holding registers are written to a new snapshot of the server's
+// Persistence, if any.
+func (s *Server) Restore(snapshot *Snapshot) error {
+	if len(snapshot.DiscreteInputs) != len(s.DiscreteInputs) || len(snapshot.Coils) != len(s.Coils) ||
+		len(snapshot.HoldingRegisters) != len(s.HoldingRegisters) || len(snapshot.InputRegisters) != len(s.InputRegisters) {
+		return errors.New("snapshot tables do not match the server tables")
+	}
+
+	s.dataMutex.Lock()
+	defer s.dataMutex.Unlock()
+	copy(s.DiscreteInputs, snapshot.DiscreteInputs)
+	copy(s.Coils, snapshot.Coils)
+	copy(s.HoldingRegisters, snapshot.HoldingRegisters)
+	copy(s.InputRegisters, snapshot.InputRegisters)
+	if s.Persistence != nil {
+		s.Persistence.mutex.Lock()
+		defer s.Persistence.mutex.Unlock()
+		return s.Persistence.snapshot(s)
+	}
+	return nil
+}
+
+// newSnapshot returns an empty snapshot with tables of 65536 entries.
+func newSnapshot() *Snapshot {
+	return &Snapshot{
+		DiscreteInputs:   make([]byte, 65536),
+		Coils:            make([]byte, 65536),
+		HoldingRegisters: make([]uint16, 65536),
+		InputRegisters:   make([]uint16, 65536),
+	}
+}
+
+// value returns the value of the table at the address.
+func (snapshot *Snapshot) value(table Table, address int) uint16 {
+	switch table {
+	case DiscreteInputTable:
+		return uint16(snapshot.DiscreteInputs[address])
+	case CoilTable:
+		return uint16(snapshot.Coils[address])
+	case HoldingRegisterTable:
+		return snapshot.HoldingRegisters[address]
+	}
+	return snapshot.InputRegisters[address]
+}
+
+func (snapshot *Snapshot) setValue(table Table, address int, value uint16) {
+	switch table {
+	case DiscreteInputTable:
+		snapshot.DiscreteInputs[address] = byte(value)
+	case CoilTable:
+		snapshot.Coils[address] = byte(value)
+	case HoldingRegisterTable:
+		snapshot.HoldingRegisters[address] = value
+	case InputRegisterTable:
+		snapshot.InputRegisters[address] = value
+	}
+}
+
+func (snapshot *Snapshot) size(table Table) int {
+	switch table {
+	case DiscreteInputTable:
+		return len(snapshot.DiscreteInputs)
+	case CoilTable:
+		return len(snapshot.Coils)
+	case HoldingRegisterTable:
+		return len(snapshot.HoldingRegisters)
+	}
+	return len(snapshot.InputRegisters)
+}
+
+// snapshotTables are the tables in serialization order.
+var snapshotTables = []Table{DiscreteInputTable, CoilTable, HoldingRegisterTable, InputRegisterTable}
+
+// Diff returns the addresses whose values differ in the other snapshot, by
+// table and address.
+func (snapshot *Snapshot) Diff(other *Snapshot) []Difference {
+	var differences []Difference
+	for _, table := range snapshotTables {
+		n := snapshot.size(table)
+		if other.size(table) < n {
+			n = other.size(table)
+		}
+		for address := 0; address < n; address++ {
+			before, after := snapshot.value(table, address), other.value(table, address)
+			if before != after {
+				differences = append(differences, Difference{table, uint16(address), before, after})
+			}
+		}
+	}
+	return differences
+}
+
+// run is a range of consecutive non-zero values of a table.
+type run struct {
+	address int
+	values  []uint16
+}
+
+func (snapshot *Snapshot) runs(table Table) []run {
+	var runs []run
+	var current *run
+	for address := 0; address < snapshot.size(table); address++ {
+		value := snapshot.value(table, address)
+		if value == 0 {
+			current = nil
+			continue
+		}
+		if current == nil {
+			runs = append(runs, run{address: address})
+			current = &runs[len(runs)-1]
+		}
+		current.values = append(current.values, value)
+	}
+	return runs
+}
+
+// MarshalBinary encodes the snapshot as the time and, for each table, the
+// runs of non-zero values, followed by a CRC-32.
+func (snapshot *Snapshot) MarshalBinary() ([]byte, error) {
+	data := []byte(snapshotBinaryMagic)
+	var nanoseconds int64
+	if !snapshot.Time.IsZero() {
+		nanoseconds = snapshot.Time.UnixNano()
+	}
+	data = binary.BigEndian.AppendUint64(data, uint64(nanoseconds))
+	for _, table := range snapshotTables {
+		runs := snapshot.runs(table)
+		data = binary.BigEndian.AppendUint32(data, uint32(len(runs)))
+		for _, r := range runs {
+			data = binary.BigEndian.AppendUint16(data, uint16(r.address))
+			data = binary.BigEndian.AppendUint32(data, uint32(len(r.values)))
+			if isBitTable(table) {
+				packed := make([]byte, (len(r.values)+7)/8)
+				for i := range r.values {
+					packed[i/8] |= 1 << (uint(i) % 8)
+				}
+				data = append(data, packed...)
+			} else {
+				data = append(data, Uint16ToBytes(r.values)...)
+			}
+		}
+	}
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data)), nil
+}
+
+// UnmarshalBinary decodes a snapshot encoded by MarshalBinary.
+func (snapshot *Snapshot) UnmarshalBinary(data []byte) error {
+	if len(data) < len(snapshotBinaryMagic)+12 || !bytes.HasPrefix(data, []byte(snapshotBinaryMagic)) {
+		return errors.New("not a binary snapshot")
+	}
+	n := len(data) - 4
+	if crc32.ChecksumIEEE(data[:n]) != binary.BigEndian.Uint32(data[n:]) {
+		return errors.New("snapshot checksum mismatch")
+	}
+	data = data[len(snapshotBinaryMagic):n]
+
+	decoded := newSnapshot()
+	if nanoseconds := int64(binary.BigEndian.Uint64(data)); nanoseconds != 0 {
+		decoded.Time = time.Unix(0, nanoseconds)
+	}
+	data = data[8:]
+	for _, table := range snapshotTables {
+		if len(data) < 4 {
+			return errors.New("snapshot is truncated")
+		}
+		runs := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		for i := 0; i < runs; i++ {
+			if len(data) < 6 {
+				return errors.New("snapshot is truncated")
+			}
+			address := int(binary.BigEndian.Uint16(data))
+			length := int(binary.BigEndian.Uint32(data[2:]))
+			data = data[6:]
+			if address+length > 65536 {
+				return fmt.Errorf("snapshot run %d-%d exceeds the %v table", address, address+length-1, table)
+			}
+			size := 2 * length
+			if isBitTable(table) {
+				size = (length + 7) / 8
+			}
+			if len(data) < size {
+				return errors.New("snapshot is truncated")
+			}
+			for j := 0; j < length; j++ {
+				if isBitTable(table) {
+					decoded.setValue(table, address+j, uint16(data[j/8]>>(uint(j)%8)&1))
+				} else {
+					decoded.setValue(table, address+j, binary.BigEndian.Uint16(data[2*j:]))
+				}
+			}
+			data = data[size:]
+		}
+	}
+	if len(data) != 0 {
+		return errors.New("snapshot has trailing data")
+	}
+	*snapshot = *decoded
+	return nil
+}
+
+// MarshalText encodes the snapshot as a time line followed by one line per
+// run of non-zero values: the table name, the first address and the values.
+//
+//	time 2024-03-01T12:00:00Z
+//	coils 3 1 1
+//	holding_registers 100 7 8 9
+func (snapshot *Snapshot) MarshalText() ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "time %s\n", snapshot.Time.Format(time.RFC3339Nano))
+	for _, table := range snapshotTables {
+		for _, r := range snapshot.runs(table) {
+			fmt.Fprintf(&b, "%v %d", table, r.address)
+			for _, value := range r.values {
+				fmt.Fprintf(&b, " %d", value)
+			}
+			b.WriteByte('\n')
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// UnmarshalText decodes a snapshot encoded by MarshalText. Empty lines and
+// lines starting with # are ignored.
+func (snapshot *Snapshot) UnmarshalText(text []byte) error {
+	decoded := newSnapshot()
+	scanner := bufio.NewScanner(bytes.NewReader(text))
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] == "time" {
+			if len(fields) != 2 {
+				return fmt.Errorf("line %d: expected time and a timestamp", line)
+			}
+			t, err := time.Parse(time.RFC3339Nano, fields[1])
+			if err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+			decoded.Time = t
+			continue
+		}
+
+		table, err := ParseTable(fields[0])
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if len(fields) < 3 {
+			return fmt.Errorf("line %d: expected an address and values", line)
+		}
+		address, err := strconv.ParseUint(fields[1], 10, 16)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid address %q", line, fields[1])
+		}
+		max := uint64(65535)
+		if isBitTable(table) {
+			max = 1
+		}
+		for i, field := range fields[2:] {
+			if int(address)+i > 65535 {
+				return fmt.Errorf("line %d: values exceed the %v table", line, table)
+			}
+			value, err := strconv.ParseUint(field, 10, 16)
+			if err != nil || value > max {
+				return fmt.Errorf("line %d: invalid %v value %q", line, table, field)
+			}
+			decoded.setValue(table, int(address)+i, uint16(value))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	*snapshot = *decoded
+	return nil
+}
@@ -0,0 +1,164 @@
+package mbserver
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotDiff(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.HoldingRegisters[5] = 50
+	before := s.Snapshot()
+
+	s.handle(gatewayRequest(1, 6, 5, 51))
+	s.handle(gatewayRequest(1, 5, 7, 0xFF00))
+	s.InputRegisters[65535] = 9
+	after := s.Snapshot()
+
+	expect := []Difference{
+		{CoilTable, 7, 0, 1},
+		{HoldingRegisterTable, 5, 50, 51},
+		{InputRegisterTable, 65535, 0, 9},
+	}
+	if !isEqual(expect, before.Diff(after)) {
+		t.Errorf("expected %v, got %v", expect, before.Diff(after))
+	}
+	if diff := after.Diff(after); len(diff) != 0 {
+		t.Errorf("expected no differences, got %v", diff)
+	}
+
+	if err := s.Restore(before); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if s.HoldingRegisters[5] != 50 || s.Coils[7] != 0 || s.InputRegisters[65535] != 0 {
+		t.Errorf("expected the restored values, got %v %v %v", s.HoldingRegisters[5], s.Coils[7], s.InputRegisters[65535])
+	}
+	if err := s.Restore(&Snapshot{}); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
+
+func testSnapshot() *Snapshot {
+	snapshot := newSnapshot()
+	snapshot.Time = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	snapshot.DiscreteInputs[0] = 1
+	snapshot.Coils[3] = 1
+	snapshot.Coils[4] = 1
+	snapshot.Coils[65535] = 1
+	snapshot.HoldingRegisters[100] = 7
+	snapshot.HoldingRegisters[101] = 65535
+	snapshot.HoldingRegisters[103] = 9
+	snapshot.InputRegisters[42] = 1
+	return snapshot
+}
+
+func TestSnapshotBinary(t *testing.T) {
+	snapshot := testSnapshot()
+	data, err := snapshot.MarshalBinary()
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(data) > 100 {
+		t.Errorf("expected a compact encoding, got %d bytes", len(data))
+	}
+
+	var decoded Snapshot
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if diff := snapshot.Diff(&decoded); len(diff) != 0 || !decoded.Time.Equal(snapshot.Time) {
+		t.Errorf("expected no differences, got %v %v", diff, decoded.Time)
+	}
+
+	data[len(data)-5] ^= 1
+	if err := decoded.UnmarshalBinary(data); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
+
+func TestSnapshotText(t *testing.T) {
+	snapshot := testSnapshot()
+	text, err := snapshot.MarshalText()
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := "time 2024-03-01T12:00:00Z\n" +
+		"discrete_inputs 0 1\n" +
+		"coils 3 1 1\n" +
+		"coils 65535 1\n" +
+		"holding_registers 100 7 65535\n" +
+		"holding_registers 103 9\n" +
+		"input_registers 42 1\n"
+	if string(text) != expect {
+		t.Errorf("expected %q, got %q", expect, text)
+	}
+
+	var decoded Snapshot
+	if err := decoded.UnmarshalText(append([]byte("# fixture\n\n"), text...)); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if diff := snapshot.Diff(&decoded); len(diff) != 0 {
+		t.Errorf("expected no differences, got %v", diff)
+	}
+
+	for text, expect := range map[string]string{
+		"coils 1 2\n":                   `line 1: invalid coils value "2"`,
+		"time now\n":                    "line 1: parsing time",
+		"registers 1 2\n":               `line 1: unknown table "registers"`,
+		"\ninput_registers 65535 1 2\n": "line 2: values exceed the input_registers table",
+		"coils 1\n":                     "line 1: expected an address and values",
+	} {
+		err := decoded.UnmarshalText([]byte(text))
+		if err == nil || !strings.HasPrefix(err.Error(), expect) {
+			t.Errorf("%q: expected %q, got %v", text, expect, err)
+		}
+	}
+}
+
+func TestSnapshotRestoreWhileServing(t *testing.T) {
+	s := NewServer()
+	addr := getFreePort()
+	if err := s.ListenTCP(addr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	ones, twos := newSnapshot(), newSnapshot()
+	for i := 0; i < 100; i++ {
+		ones.HoldingRegisters[i] = 1
+		twos.HoldingRegisters[i] = 2
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if i%2 == 0 {
+				s.Restore(ones)
+			} else {
+				s.Restore(twos)
+			}
+		}
+	}()
+
+	client := NewTCPClient(addr)
+	defer client.Close()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		registers, err := client.ReadHoldingRegisters(0, 100)
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		for _, register := range registers {
+			if register != registers[0] {
+				t.Fatalf("expected uniform registers, got %v", registers)
+			}
+		}
+	}
+}
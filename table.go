@@ -0,0 +1,107 @@
+package mbserver
+
+import (
+	"fmt"
+	"time"
+)
+
+// Table identifies one of the four Modbus data tables.
+type Table uint8
+
+// Modbus data tables.
+const (
+	CoilTable Table = iota
+	DiscreteInputTable
+	HoldingRegisterTable
+	InputRegisterTable
+)
+
+func (t Table) String() string {
+	switch t {
+	case CoilTable:
+		return "coils"
+	case DiscreteInputTable:
+		return "discrete_inputs"
+	case HoldingRegisterTable:
+		return "holding_registers"
+	case InputRegisterTable:
+		return "input_registers"
+	}
+	return fmt.Sprintf("table(%d)", uint8(t))
+}
+
+// tableNames are the names of the tables and their short aliases.
+var tableNames = map[string]Table{
+	"coils": CoilTable, "c": CoilTable,
+	"discrete_inputs": DiscreteInputTable, "di": DiscreteInputTable,
+	"holding_registers": HoldingRegisterTable, "hr": HoldingRegisterTable,
+	"input_registers": InputRegisterTable, "ir": InputRegisterTable,
+}
+
+// ParseTable returns the table of a name, "coils", "discrete_inputs",
+// "holding_registers" or "input_registers", or of its alias, "c", "di", "hr"
+// or "ir".
+func ParseTable(name string) (Table, error) {
+	table, ok := tableNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown table %q, expected coils (c), discrete_inputs (di), holding_registers (hr) or input_registers (ir)", name)
+	}
+	return table, nil
+}
+
+// functionTable returns the table accessed by a standard Modbus function.
+func functionTable(function uint8) (table Table, ok bool) {
+	switch function {
+	case 1, 5, 15:
+		return CoilTable, true
+	case 2:
+		return DiscreteInputTable, true
+	case 3, 6, 16:
+		return HoldingRegisterTable, true
+	case 4:
+		return InputRegisterTable, true
+	}
+	return 0, false
+}
+
+// readTable returns the values of number addresses of the table starting at
+// address, with bits as 0 or 1.
+func (s *Server) readTable(table Table, address int, number int) []uint16 {
+	values := make([]uint16, number)
+	for i := range values {
+		switch table {
+		case CoilTable:
+			values[i] = uint16(s.Coils[address+i])
+		case DiscreteInputTable:
+			values[i] = uint16(s.DiscreteInputs[address+i])
+		case HoldingRegisterTable:
+			values[i] = s.HoldingRegisters[address+i]
+		case InputRegisterTable:
+			values[i] = s.InputRegisters[address+i]
+		}
+	}
+	return values
+}
+
+// writeTable writes the values to the table at the address on behalf of the
+// application, like a client write: coils and holding registers are recorded
+// to the Persistence and the change is published with the writer's UnitID,
+// Client, Identity and Source. The caller holds the data lock.
+func (s *Server) writeTable(table Table, address int, values []uint16, writer ChangeEvent) error {
+	subscribed := s.subscribed()
+	var old []uint16
+	if subscribed {
+		old = s.readTable(table, address, len(values))
+	}
+	for i, value := range values {
+		setTableValue(s, table, address+i, value)
+	}
+	err := s.Persistence.recordRange(s, table, address, len(values))
+	if subscribed {
+		writer.Time = time.Now()
+		writer.Table, writer.Address = table, uint16(address)
+		writer.Old, writer.New = old, s.readTable(table, address, len(values))
+		s.publish(writer)
+	}
+	return err
+}